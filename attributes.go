@@ -0,0 +1,112 @@
+package s3rpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// maxAttributes is the max number of request attributes, see Input.Attributes.
+// This is the max number of message attributes SQS accepts on a message.
+const maxAttributes = 10
+
+// maxAttributeNameLen is the max length of a request attribute name, as for SQS message attributes.
+const maxAttributeNameLen = 256
+
+// validateAttributes validates the attributes of a request, see Input.Attributes,
+// by the rules SQS applies to message attribute names, so they fail when submitted
+// and not when sent to a queue.
+func validateAttributes(attrs map[string]string) error {
+	if len(attrs) > maxAttributes {
+		return fmt.Errorf("too many attributes: %d, max is %d", len(attrs), maxAttributes)
+	}
+	for k, v := range attrs {
+		if k == "" || v == "" {
+			return fmt.Errorf("attribute %q: name and value must not be empty", k)
+		}
+		if err := validateAttributeName(k); err != nil {
+			return fmt.Errorf("attribute %q: %w", k, err)
+		}
+	}
+	return nil
+}
+
+func validateAttributeName(name string) error {
+	if len(name) > maxAttributeNameLen {
+		return fmt.Errorf("name must not be longer than %d characters", maxAttributeNameLen)
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' || r == '.') {
+			return fmt.Errorf("name may only contain A-Z, a-z, 0-9, underscore, hyphen and period, got %q", r)
+		}
+	}
+	lower := strings.ToLower(name)
+	if strings.HasPrefix(lower, "aws.") || strings.HasPrefix(lower, "amazon.") {
+		return errors.New("name must not start with AWS. or Amazon., which are reserved")
+	}
+	if strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".") || strings.Contains(name, "..") {
+		return errors.New("name must not start or end with a period or contain consecutive periods")
+	}
+	return nil
+}
+
+// encodeAttributes returns the s3rpc metadata carrying attrs, or nil if there are none.
+// The attributes are always stored with the objects, as S3 event notifications cannot carry them.
+func encodeAttributes(attrs map[string]string) (map[string]string, error) {
+	if len(attrs) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(attrs)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{metaAttributes: encodeMetadataValue(string(b))}, nil
+}
+
+// messageAttributes returns the message attributes of note, falling back to the ones
+// stored in the s3rpc metadata of the object it refers to.
+func messageAttributes(note Note, internal map[string]string) map[string]string {
+	if len(note.Attributes) > 0 {
+		return note.Attributes
+	}
+	v := internal[metaAttributes]
+	if v == "" {
+		return nil
+	}
+	var attrs map[string]string
+	if err := json.Unmarshal([]byte(decodeMetadataValue(v)), &attrs); err != nil {
+		return nil
+	}
+	return attrs
+}
+
+// sqsMessageAttributes converts attrs to SQS string attributes.
+func sqsMessageAttributes(attrs map[string]string) map[string]types.MessageAttributeValue {
+	if len(attrs) == 0 {
+		return nil
+	}
+	m := make(map[string]types.MessageAttributeValue, len(attrs))
+	for k, v := range attrs {
+		m[k] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+	}
+	return m
+}
+
+// fromSQSMessageAttributes converts the SQS string attributes in m, ignoring others.
+func fromSQSMessageAttributes(m map[string]types.MessageAttributeValue) map[string]string {
+	var attrs map[string]string
+	for k, v := range m {
+		if v.StringValue == nil {
+			continue
+		}
+		if attrs == nil {
+			attrs = make(map[string]string)
+		}
+		attrs[k] = *v.StringValue
+	}
+	return attrs
+}
@@ -0,0 +1,120 @@
+package s3rpc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestAttributes(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// dropAttributes simulates S3 event notifications, which cannot carry message attributes.
+		dropAttributes bool
+	}{
+		{"Notifier", false},
+		{"S3Event", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			bus := newMemBus()
+			blobs := newMemBlobStore()
+
+			var clientNotifier, serverNotifier Notifier = bus.notifier(toClient), bus.notifier(toServer)
+			if test.dropAttributes {
+				clientNotifier = attributeDroppingNotifier{clientNotifier}
+				serverNotifier = attributeDroppingNotifier{serverNotifier}
+			}
+
+			attrs := map[string]string{"tenant": "acme", "Priority": "high"}
+
+			var got map[string]string
+			handlers := Handlers{
+				"upper": func(ctx context.Context, input Input) (Output, error) {
+					got = input.Attributes
+					return upperHandler(ctx, input)
+				},
+			}
+			client := newTestClient(c, bus, blobs, ClientOptions{Notifier: clientNotifier})
+			newTestServer(c, bus, blobs, ServerOptions{Notifier: serverNotifier, Handlers: handlers})
+
+			output, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo"), Attributes: attrs})
+			c.Assert(err, qt.IsNil)
+			c.Assert(got, qt.DeepEquals, attrs)
+			c.Assert(output.Attributes, qt.DeepEquals, attrs)
+		})
+	}
+}
+
+func TestAttributesTooMany(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+	client := newTestClient(c, bus, blobs, ClientOptions{})
+
+	attrs := make(map[string]string)
+	for i := 0; i < 11; i++ {
+		attrs[fmt.Sprintf("a%d", i)] = "v"
+	}
+
+	_, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo"), Attributes: attrs})
+	c.Assert(err, qt.ErrorMatches, "apply: too many attributes: 11, max is 10")
+	c.Assert(blobs.keys(), qt.HasLen, 0)
+}
+
+func TestValidateAttributes(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range []struct {
+		name  string
+		attrs map[string]string
+		err   string
+	}{
+		{"Valid", map[string]string{"tenant": "a", "Trace-ID_1.x": "b"}, ""},
+		{"None", nil, ""},
+		{"Empty name", map[string]string{"": "a"}, `attribute "": name and value must not be empty`},
+		{"Empty value", map[string]string{"tenant": ""}, `attribute "tenant": name and value must not be empty`},
+		{"Too long", map[string]string{strings.Repeat("a", 257): "a"}, `attribute "a+": name must not be longer than 256 characters`},
+		{"Max length", map[string]string{strings.Repeat("a", 256): "a"}, ""},
+		{"Space", map[string]string{"my tenant": "a"}, `attribute "my tenant": name may only contain .*, got ' '`},
+		{"Non-ASCII", map[string]string{"tenänt": "a"}, `attribute "tenänt": name may only contain .*, got 'ä'`},
+		{"AWS prefix", map[string]string{"AWS.Trace": "a"}, `attribute "AWS.Trace": name must not start with AWS. or Amazon., which are reserved`},
+		{"Amazon prefix", map[string]string{"amazon.foo": "a"}, `attribute "amazon.foo": name must not start with AWS. .*`},
+		{"AWS without period", map[string]string{"awsTrace": "a"}, ""},
+		{"Leading period", map[string]string{".tenant": "a"}, `attribute ".tenant": name must not start or end with a period or contain consecutive periods`},
+		{"Trailing period", map[string]string{"tenant.": "a"}, `attribute "tenant.": name must not start or end .*`},
+		{"Consecutive periods", map[string]string{"ten..ant": "a"}, `attribute "ten..ant": name must not start or end .*`},
+	} {
+		c.Run(test.name, func(c *qt.C) {
+			err := validateAttributes(test.attrs)
+			if test.err == "" {
+				c.Assert(err, qt.IsNil)
+			} else {
+				c.Assert(err, qt.ErrorMatches, test.err)
+			}
+		})
+	}
+}
+
+func TestSQSMessageAttributes(t *testing.T) {
+	c := qt.New(t)
+
+	attrs := map[string]string{"a": "b", "c": "d"}
+	c.Assert(fromSQSMessageAttributes(sqsMessageAttributes(attrs)), qt.DeepEquals, attrs)
+	c.Assert(sqsMessageAttributes(nil), qt.IsNil)
+	c.Assert(fromSQSMessageAttributes(nil), qt.IsNil)
+}
+
+type attributeDroppingNotifier struct {
+	Notifier
+}
+
+func (n attributeDroppingNotifier) Send(ctx context.Context, note Note) error {
+	note.Attributes = nil
+	return n.Notifier.Send(ctx, note)
+}
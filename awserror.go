@@ -0,0 +1,67 @@
+package s3rpc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/smithy-go"
+)
+
+// AWSError is a failed S3 or SQS request, with the details AWS support asks for.
+// Use errors.As to get it from the errors returned by Client and Server.
+type AWSError struct {
+	// Op is the failed operation, e.g. "S3 GetObject".
+	Op string
+
+	// Code is the service's error code, e.g. "AccessDenied", if any.
+	Code string
+
+	// RequestID is the AWS request ID, if any.
+	RequestID string
+
+	// Err is the underlying SDK error.
+	Err error
+}
+
+func (e *AWSError) Error() string {
+	var details []string
+	if e.Code != "" {
+		details = append(details, "code: "+e.Code)
+	}
+	if e.RequestID != "" {
+		details = append(details, "request id: "+e.RequestID)
+	}
+	if len(details) == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s (%s)", e.Err, strings.Join(details, ", "))
+}
+
+func (e *AWSError) Unwrap() error {
+	return e.Err
+}
+
+// newAWSError wraps err in an AWSError if it is an AWS SDK operation error.
+// Other errors, e.g. from the context, are returned as is.
+func newAWSError(err error) error {
+	var opErr *smithy.OperationError
+	if err == nil || !errors.As(err, &opErr) {
+		return err
+	}
+	var existing *AWSError
+	if errors.As(err, &existing) {
+		return err
+	}
+
+	e := &AWSError{Op: opErr.Service() + " " + opErr.Operation(), Err: err}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		e.Code = apiErr.ErrorCode()
+	}
+	var reqErr interface{ ServiceRequestID() string }
+	if errors.As(err, &reqErr) {
+		e.RequestID = reqErr.ServiceRequestID()
+	}
+	return e
+}
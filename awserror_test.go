@@ -0,0 +1,74 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	qt "github.com/frankban/quicktest"
+)
+
+func newTestOperationError(service, operation, code, requestID string) error {
+	return &smithy.OperationError{
+		ServiceID:     service,
+		OperationName: operation,
+		Err: &awshttp.ResponseError{
+			ResponseError: &smithyhttp.ResponseError{
+				Response: &smithyhttp.Response{Response: &http.Response{StatusCode: 403}},
+				Err:      &smithy.GenericAPIError{Code: code, Message: "denied"},
+			},
+			RequestID: requestID,
+		},
+	}
+}
+
+func TestNewAWSError(t *testing.T) {
+	c := qt.New(t)
+
+	err := newAWSError(newTestOperationError("S3", "GetObject", "AccessDenied", "req123"))
+	var awsErr *AWSError
+	c.Assert(errors.As(err, &awsErr), qt.IsTrue)
+	c.Assert(awsErr.Op, qt.Equals, "S3 GetObject")
+	c.Assert(awsErr.Code, qt.Equals, "AccessDenied")
+	c.Assert(awsErr.RequestID, qt.Equals, "req123")
+	c.Assert(err, qt.ErrorMatches, `operation error S3: GetObject, .* \(code: AccessDenied, request id: req123\)`)
+	c.Assert(isFatalError(err), qt.IsTrue)
+
+	// Wrapped once only.
+	c.Assert(newAWSError(err), qt.Equals, err)
+
+	// Not an SDK error.
+	c.Assert(newAWSError(nil), qt.IsNil)
+	c.Assert(newAWSError(context.Canceled), qt.Equals, context.Canceled)
+	c.Assert(errors.As(newAWSError(io.ErrUnexpectedEOF), &awsErr), qt.IsFalse)
+}
+
+// awsErrorBlobStore wraps a BlobStore and fails all Gets of response objects with an SDK error.
+type awsErrorBlobStore struct {
+	BlobStore
+}
+
+func (b *awsErrorBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, map[string]string, error) {
+	return nil, nil, newAWSError(newTestOperationError("S3", "GetObject", "InternalError", "req456"))
+}
+
+func TestExecuteAWSError(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	client := newTestClient(c, bus, &awsErrorBlobStore{BlobStore: blobs}, ClientOptions{})
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}})
+
+	_, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	var awsErr *AWSError
+	c.Assert(errors.As(err, &awsErr), qt.IsTrue)
+	c.Assert(awsErr.RequestID, qt.Equals, "req456")
+	c.Assert(awsErr.Op, qt.Equals, "S3 GetObject")
+}
@@ -0,0 +1,103 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ItemResult is the outcome of one item in ExecuteBatch.
+type ItemResult struct {
+	// Index is the index of the item's input.
+	Index int
+
+	// Output is set if Err is nil.
+	Output Output
+	Err    error
+}
+
+// BatchResult is the outcome of ExecuteBatch, with one ItemResult per input in input order.
+type BatchResult struct {
+	Items []ItemResult
+}
+
+// Err returns a *BatchError if any item failed, else nil.
+func (r BatchResult) Err() error {
+	failed := r.Failed()
+	if len(failed) == 0 {
+		return nil
+	}
+	return &BatchError{Failed: failed, Total: len(r.Items)}
+}
+
+// Failed returns the items that failed, e.g. to retry them.
+func (r BatchResult) Failed() []ItemResult {
+	var failed []ItemResult
+	for _, item := range r.Items {
+		if item.Err != nil {
+			failed = append(failed, item)
+		}
+	}
+	return failed
+}
+
+// Succeeded returns the items that succeeded.
+func (r BatchResult) Succeeded() []ItemResult {
+	var succeeded []ItemResult
+	for _, item := range r.Items {
+		if item.Err == nil {
+			succeeded = append(succeeded, item)
+		}
+	}
+	return succeeded
+}
+
+// BatchError is returned by BatchResult.Err when one or more items failed.
+type BatchError struct {
+	Failed []ItemResult
+	Total  int
+}
+
+func (e *BatchError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d of %d items failed", len(e.Failed), e.Total)
+	for i, item := range e.Failed {
+		if i == 0 {
+			b.WriteString(": ")
+		} else {
+			b.WriteString("; ")
+		}
+		fmt.Fprintf(&b, "item %d: %s", item.Index, item.Err)
+	}
+	return b.String()
+}
+
+// Is reports whether any of the failed items' errors matches target.
+func (e *BatchError) Is(target error) bool {
+	for _, item := range e.Failed {
+		if errors.Is(item.Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExecuteBatch executes op with each of inputs concurrently and waits for all of them to finish.
+// A failing item does not stop the others; see BatchResult for the per item outcomes.
+// The concurrency is bounded by ClientOptions.MaxInFlight, if set.
+func (c *Client) ExecuteBatch(ctx context.Context, op string, inputs []Input) BatchResult {
+	result := BatchResult{Items: make([]ItemResult, len(inputs))}
+	var wg sync.WaitGroup
+	for i, input := range inputs {
+		wg.Add(1)
+		go func(i int, input Input) {
+			defer wg.Done()
+			output, err := c.Execute(ctx, op, input)
+			result.Items[i] = ItemResult{Index: i, Output: output, Err: err}
+		}(i, input)
+	}
+	wg.Wait()
+	return result
+}
@@ -0,0 +1,62 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestExecuteBatch(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	client := newTestClient(c, bus, blobs, ClientOptions{MaxInFlight: 2})
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}})
+
+	var inputs []Input
+	for i := 0; i < 5; i++ {
+		filename := writeTestFile(c, fmt.Sprintf("in%d.txt", i), fmt.Sprintf("foo%d", i))
+		if i%2 == 1 {
+			// Fails on upload.
+			filename += ".missing"
+		}
+		inputs = append(inputs, Input{Filename: filename})
+	}
+
+	result := client.ExecuteBatch(context.Background(), "upper", inputs)
+	c.Assert(result.Items, qt.HasLen, 5)
+
+	succeeded := result.Succeeded()
+	c.Assert(succeeded, qt.HasLen, 3)
+	for _, item := range succeeded {
+		b, err := os.ReadFile(item.Output.Filename)
+		c.Assert(err, qt.IsNil)
+		c.Assert(string(b), qt.Equals, fmt.Sprintf("FOO%d", item.Index))
+	}
+
+	failed := result.Failed()
+	c.Assert(failed, qt.HasLen, 2)
+	c.Assert(failed[0].Index, qt.Equals, 1)
+	c.Assert(failed[1].Index, qt.Equals, 3)
+
+	err := result.Err()
+	c.Assert(err, qt.ErrorMatches, "2 of 5 items failed: item 1: .*; item 3: .*")
+	c.Assert(errors.Is(err, os.ErrNotExist), qt.IsTrue)
+	var batchErr *BatchError
+	c.Assert(errors.As(err, &batchErr), qt.IsTrue)
+	c.Assert(batchErr.Total, qt.Equals, 5)
+	c.Assert(batchErr.Failed, qt.HasLen, 2)
+
+	// Retry the failures.
+	var retry []Input
+	for _, item := range failed {
+		retry = append(retry, Input{Filename: writeTestFile(c, fmt.Sprintf("retry%d.txt", item.Index), "bar")})
+	}
+	c.Assert(client.ExecuteBatch(context.Background(), "upper", retry).Err(), qt.IsNil)
+}
@@ -0,0 +1,149 @@
+package s3rpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// BlobStore abstracts the storage of inputs and outputs.
+//
+// The default implementation is backed by S3, see NewS3BlobStore.
+type BlobStore interface {
+	// Put stores body with the given metadata below key.
+	Put(ctx context.Context, key string, body io.Reader, metadata map[string]string) error
+
+	// Get opens the object stored below key.
+	// The caller must close the returned reader.
+	Get(ctx context.Context, key string) (io.ReadCloser, map[string]string, error)
+
+	// Delete deletes the object stored below key.
+	Delete(ctx context.Context, key string) error
+}
+
+// Stater is an optional interface a BlobStore may implement
+// to read the metadata of an object without its content.
+// Without it, the object is opened with Get and closed right away.
+type Stater interface {
+	// Stat returns the metadata of the object stored below key.
+	Stat(ctx context.Context, key string) (map[string]string, error)
+}
+
+// NewS3BlobStore creates a new BlobStore storing objects in the given S3 bucket.
+func NewS3BlobStore(client *s3.Client, bucket string) BlobStore {
+	return &s3BlobStore{client: client, bucket: bucket, uploader: newUploader(client, AWSConfig{})}
+}
+
+// NewS3BlobStoreWithACL is like NewS3BlobStore, but stores the objects with the given
+// canned ACL, see AWSConfig.ObjectACL.
+func NewS3BlobStoreWithACL(client *s3.Client, bucket, acl string) (BlobStore, error) {
+	return newS3BlobStore(client, AWSConfig{Bucket: bucket, ObjectACL: acl})
+}
+
+// newS3BlobStore creates a new BlobStore as configured in cfg.
+func newS3BlobStore(client *s3.Client, cfg AWSConfig) (BlobStore, error) {
+	if err := validateObjectACL(cfg.ObjectACL); err != nil {
+		return nil, err
+	}
+	if cfg.PartSize != 0 && cfg.PartSize < manager.MinUploadPartSize {
+		return nil, fmt.Errorf("part size %d is below the minimum of %d bytes", cfg.PartSize, manager.MinUploadPartSize)
+	}
+	if cfg.TransferConcurrency < 0 {
+		return nil, fmt.Errorf("invalid transfer concurrency %d", cfg.TransferConcurrency)
+	}
+	return &s3BlobStore{
+		client:   client,
+		bucket:   cfg.Bucket,
+		acl:      types.ObjectCannedACL(cfg.ObjectACL),
+		uploader: newUploader(client, cfg),
+	}, nil
+}
+
+// newUploader creates the uploader shared by all uploads of a blob store,
+// so they share its pool of part buffers.
+func newUploader(client manager.UploadAPIClient, cfg AWSConfig) *manager.Uploader {
+	return manager.NewUploader(client, func(u *manager.Uploader) {
+		if cfg.TransferConcurrency > 0 {
+			u.Concurrency = cfg.TransferConcurrency
+		}
+		if cfg.PartSize > 0 {
+			u.PartSize = cfg.PartSize
+		}
+	})
+}
+
+type s3BlobStore struct {
+	client   *s3.Client
+	bucket   string
+	acl      types.ObjectCannedACL
+	uploader *manager.Uploader
+}
+
+func validateObjectACL(acl string) error {
+	if acl == "" {
+		return nil
+	}
+	for _, v := range types.ObjectCannedACL("").Values() {
+		if string(v) == acl {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid object ACL %q", acl)
+}
+
+func (b *s3BlobStore) Put(ctx context.Context, key string, body io.Reader, metadata map[string]string) error {
+	_, err := b.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket:   aws.String(b.bucket),
+		Key:      aws.String(key),
+		Body:     body,
+		Metadata: metadata,
+		ACL:      b.acl,
+	})
+	return newAWSError(err)
+}
+
+func (b *s3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, map[string]string, error) {
+	o, err := b.client.GetObject(
+		ctx,
+		&s3.GetObjectInput{
+			Bucket: aws.String(b.bucket),
+			Key:    aws.String(key),
+		},
+	)
+	if err != nil {
+		return nil, nil, newAWSError(err)
+	}
+	return o.Body, o.Metadata, nil
+}
+
+func (b *s3BlobStore) Stat(ctx context.Context, key string) (map[string]string, error) {
+	o, err := b.client.HeadObject(
+		ctx,
+		&s3.HeadObjectInput{
+			Bucket: aws.String(b.bucket),
+			Key:    aws.String(key),
+		},
+	)
+	if err != nil {
+		return nil, newAWSError(err)
+	}
+	return o.Metadata, nil
+}
+
+func (b *s3BlobStore) Delete(ctx context.Context, key string) error {
+	_, err := b.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	return newAWSError(err)
+}
+
+func (b *s3BlobStore) Validate(ctx context.Context) error {
+	_, err := b.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(b.bucket)})
+	return newAWSError(err)
+}
@@ -0,0 +1,166 @@
+package s3rpc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	qt "github.com/frankban/quicktest"
+)
+
+// recordingHTTPClient records the requests and responds with an empty 200 OK,
+// with header, if set.
+type recordingHTTPClient struct {
+	header http.Header
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func (c *recordingHTTPClient) Do(r *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	c.requests = append(c.requests, r)
+	c.mu.Unlock()
+	header := c.header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{StatusCode: 200, Header: header, Body: io.NopCloser(strings.NewReader("")), Request: r}, nil
+}
+
+func TestS3BlobStoreObjectACL(t *testing.T) {
+	c := qt.New(t)
+
+	put := func(acl string) *http.Request {
+		httpClient := &recordingHTTPClient{}
+		client := s3.New(s3.Options{
+			Region:      "eu-north-1",
+			Credentials: credentials.NewStaticCredentialsProvider("id", "secret", ""),
+			HTTPClient:  httpClient,
+		})
+		blobs, err := NewS3BlobStoreWithACL(client, "s3rpctest", acl)
+		c.Assert(err, qt.IsNil)
+		c.Assert(blobs.Put(context.Background(), "to_server/foo", strings.NewReader("foo"), nil), qt.IsNil)
+		c.Assert(httpClient.requests, qt.HasLen, 1)
+		return httpClient.requests[0]
+	}
+
+	// Cross-account: the bucket owner gets full control of the objects we write.
+	c.Assert(put("bucket-owner-full-control").Header.Get("X-Amz-Acl"), qt.Equals, "bucket-owner-full-control")
+	c.Assert(put("").Header.Get("X-Amz-Acl"), qt.Equals, "")
+
+	_, err := NewS3BlobStoreWithACL(nil, "s3rpctest", "everyone")
+	c.Assert(err, qt.ErrorMatches, `invalid object ACL "everyone"`)
+}
+
+func TestS3BlobStoreStat(t *testing.T) {
+	c := qt.New(t)
+
+	httpClient := &recordingHTTPClient{header: http.Header{"X-Amz-Meta-S3rpc-Checksum": {"abc"}, "Content-Length": {"123"}}}
+	client := s3.New(s3.Options{
+		Region:      "eu-north-1",
+		Credentials: credentials.NewStaticCredentialsProvider("id", "secret", ""),
+		HTTPClient:  httpClient,
+	})
+	blobs := NewS3BlobStore(client, "s3rpctest")
+	metadata, err := blobs.(Stater).Stat(context.Background(), "cache/upper/foo")
+	c.Assert(err, qt.IsNil)
+	c.Assert(metadata, qt.DeepEquals, map[string]string{"s3rpc-checksum": "abc"})
+
+	// The content is not fetched.
+	c.Assert(httpClient.requests, qt.HasLen, 1)
+	c.Assert(httpClient.requests[0].Method, qt.Equals, http.MethodHead)
+	c.Assert(httpClient.requests[0].URL.Path, qt.Equals, "/cache/upper/foo")
+}
+
+func TestS3BlobStoreTransferOptions(t *testing.T) {
+	c := qt.New(t)
+
+	blobs, err := newS3BlobStore(nil, AWSConfig{Bucket: "s3rpctest", TransferConcurrency: 2, PartSize: 10 << 20})
+	c.Assert(err, qt.IsNil)
+	u := blobs.(*s3BlobStore).uploader
+	c.Assert(u.Concurrency, qt.Equals, 2)
+	c.Assert(u.PartSize, qt.Equals, int64(10<<20))
+
+	blobs, err = newS3BlobStore(nil, AWSConfig{Bucket: "s3rpctest"})
+	c.Assert(err, qt.IsNil)
+	u = blobs.(*s3BlobStore).uploader
+	c.Assert(u.Concurrency, qt.Equals, manager.DefaultUploadConcurrency)
+	c.Assert(u.PartSize, qt.Equals, manager.DefaultUploadPartSize)
+
+	_, err = newS3BlobStore(nil, AWSConfig{PartSize: 1 << 20})
+	c.Assert(err, qt.ErrorMatches, "part size 1048576 is below the minimum of 5242880 bytes")
+	_, err = newS3BlobStore(nil, AWSConfig{TransferConcurrency: -1})
+	c.Assert(err, qt.ErrorMatches, "invalid transfer concurrency -1")
+}
+
+// BenchmarkUploadPartBuffers compares creating an uploader per upload, each with its own
+// pool of part buffers, with the uploader shared by the uploads of an s3BlobStore.
+// The shared pool reuses the buffers while uploads overlap, so run it with -cpu 4 or so.
+func BenchmarkUploadPartBuffers(b *testing.B) {
+	const size = 3 * manager.MinUploadPartSize
+	data := make([]byte, size)
+	client := &discardingUploadClient{}
+	cfg := AWSConfig{TransferConcurrency: 2, PartSize: manager.MinUploadPartSize}
+
+	upload := func(b *testing.B, u *manager.Uploader) {
+		// Not an io.ReaderAt, so the parts are buffered.
+		body := struct{ io.Reader }{bytes.NewReader(data)}
+		_, err := u.Upload(context.Background(), &s3.PutObjectInput{Bucket: aws.String("s3rpctest"), Key: aws.String("foo"), Body: body})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("PerUpload", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				upload(b, newUploader(client, cfg))
+			}
+		})
+	})
+
+	b.Run("Shared", func(b *testing.B) {
+		u := newUploader(client, cfg)
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				upload(b, u)
+			}
+		})
+	})
+}
+
+// discardingUploadClient is a manager.UploadAPIClient discarding the uploaded content.
+type discardingUploadClient struct{}
+
+func (discardingUploadClient) PutObject(ctx context.Context, in *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	_, err := io.Copy(io.Discard, in.Body)
+	return &s3.PutObjectOutput{}, err
+}
+
+func (discardingUploadClient) UploadPart(ctx context.Context, in *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	_, err := io.Copy(io.Discard, in.Body)
+	return &s3.UploadPartOutput{ETag: aws.String("etag")}, err
+}
+
+func (discardingUploadClient) CreateMultipartUpload(ctx context.Context, in *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload")}, nil
+}
+
+func (discardingUploadClient) CompleteMultipartUpload(ctx context.Context, in *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (discardingUploadClient) AbortMultipartUpload(ctx context.Context, in *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
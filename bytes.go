@@ -0,0 +1,90 @@
+package s3rpc
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// bytesInputName is the name part of the key of inputs sent with ExecuteBytes.
+const bytesInputName = "bytes"
+
+// emptyOutputName is the name of the file uploaded for handlers responding without an output file.
+const emptyOutputName = "empty"
+
+// ExecuteBytes is like Execute, but with the input and output passed in memory,
+// which is convenient for small payloads.
+// The input is still sent through a temporary file, which counts against ClientOptions.MaxTempBytes
+// along with the output, so ExecuteBytes fails with ErrNoSpace rather than exceed it.
+func (c *Client) ExecuteBytes(ctx context.Context, op string, data []byte, meta map[string]string) ([]byte, map[string]string, error) {
+	// The input is written within the Execute call, so it is subject to Close and MaxInFlight.
+	output, err := c.do(ctx, "apply", func(ctx context.Context) (Output, error) {
+		reservation, err := c.reserveTemp(int64(len(data)))
+		if err != nil {
+			return Output{}, fmt.Errorf("apply: %w", err)
+		}
+		defer reservation.release("")
+		filename, err := c.writeTemp(bytesInputName, data)
+		if err != nil {
+			return Output{}, fmt.Errorf("apply: %w", err)
+		}
+		defer os.Remove(filename)
+
+		return c.execute(ctx, op, Input{Filename: filename, Metadata: meta})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(output.Filename)
+
+	b, err := os.ReadFile(output.Filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("apply: %w", err)
+	}
+	return b, output.Metadata, nil
+}
+
+// BytesHandler handles an operation with the input and output in memory,
+// see HandleBytes.
+type BytesHandler func(ctx context.Context, in []byte, meta map[string]string) (out []byte, outMeta map[string]string, err error)
+
+// HandleBytes adapts h to a HandlerFunc, e.g. for small payloads.
+// The input is read into memory, and the output is written to a temporary file
+// removed once the response is sent.
+func HandleBytes(h BytesHandler) HandlerFunc {
+	return func(ctx context.Context, input Input) (Output, error) {
+		in, err := os.ReadFile(input.Filename)
+		if err != nil {
+			return Output{}, err
+		}
+		out, outMeta, err := h(ctx, in, input.Metadata)
+		if err != nil {
+			return Output{}, err
+		}
+		filename := input.Filename + ".out"
+		if err := os.WriteFile(filename, out, 0o644); err != nil {
+			return Output{}, noSpaceErr(err)
+		}
+		if info := requestInfoFromContext(ctx); info != nil {
+			info.tempFiles = append(info.tempFiles, filename)
+		}
+		return Output{Filename: filename, Metadata: outMeta}, nil
+	}
+}
+
+// writeTemp writes data to a new temporary file named *_<name> and returns its name.
+func (c *common) writeTemp(name string, data []byte) (string, error) {
+	f, err := os.CreateTemp(c.tempDir, "*_"+name)
+	if err != nil {
+		return "", noSpaceErr(fmt.Errorf("tempfile: %w", err))
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", noSpaceErr(err)
+	}
+	return f.Name(), nil
+}
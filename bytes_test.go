@@ -0,0 +1,66 @@
+package s3rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestExecuteBytes(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+	client := newTestClient(c, bus, blobs, ClientOptions{MaxTempBytes: 10})
+	server := newTestServer(c, bus, blobs, ServerOptions{
+		Handlers: Handlers{
+			"upper": HandleBytes(func(ctx context.Context, in []byte, meta map[string]string) ([]byte, map[string]string, error) {
+				if len(in) == 0 {
+					return nil, nil, errors.New("empty")
+				}
+				return bytes.ToUpper(in), map[string]string{"Lang": meta["Lang"]}, nil
+			}),
+		},
+	})
+
+	out, meta, err := client.ExecuteBytes(ctx, "upper", []byte("foo"), map[string]string{"Lang": "en"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(out), qt.Equals, "FOO")
+	c.Assert(meta, qt.DeepEquals, map[string]string{"Lang": "en"})
+
+	// No files left behind.
+	c.Assert(tempFiles(c, client.tempDir), qt.HasLen, 0)
+	waitFor(c, func() bool { return len(tempFiles(c, server.tempDir)) == 0 })
+
+	_, _, err = client.ExecuteBytes(ctx, "upper", []byte("foo bar baz"), nil)
+	c.Assert(errors.Is(err, ErrNoSpace), qt.IsTrue, qt.Commentf("%v", err))
+	c.Assert(tempFiles(c, client.tempDir), qt.HasLen, 0)
+}
+
+func TestExecuteBytesClosed(t *testing.T) {
+	c := qt.New(t)
+
+	client := newTestClient(c, newMemBus(), newMemBlobStore(), ClientOptions{})
+	c.Assert(client.Close(), qt.IsNil)
+
+	_, _, err := client.ExecuteBytes(context.Background(), "upper", []byte("foo"), nil)
+	c.Assert(errors.Is(err, ErrClientClosed), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, "apply: client closed")
+}
+
+// tempFiles returns the names of the files in dir.
+func tempFiles(c *qt.C, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	c.Assert(err, qt.IsNil)
+	var names []string
+	for _, e := range entries {
+		names = append(names, filepath.Join(dir, e.Name()))
+	}
+	return names
+}
@@ -0,0 +1,107 @@
+package s3rpc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// cachePrefix is the key prefix of the server's result cache.
+// Set up a bucket lifecycle rule expiring objects below it after ServerOptions.ResultCacheTTL.
+const cachePrefix = "cache"
+
+// resultCacheKey returns the result cache key for op with the input in filename and the given user metadata.
+func resultCacheKey(op, filename string, metadata map[string]string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	// Handlers may behave differently depending on the metadata.
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h.Write([]byte{0})
+		io.WriteString(h, k)
+		h.Write([]byte{0})
+		io.WriteString(h, metadata[k])
+	}
+
+	return cachePrefix + "/" + op + "/" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// isCacheable reports whether the result of op should be cached.
+func (s *Server) isCacheable(op string) bool {
+	if s.resultCacheTTL <= 0 {
+		return false
+	}
+	if len(s.resultCacheOps) == 0 {
+		return true
+	}
+	for _, o := range s.resultCacheOps {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupCache looks for an unexpired cached result stored below key
+// and returns its checksum if found.
+func (s *Server) lookupCache(ctx context.Context, key string) (string, bool) {
+	metadata, err := s.statObject(ctx, key)
+	if err != nil {
+		// Most likely not found.
+		return "", false
+	}
+	h, err := readHeader(metadata)
+	if err != nil {
+		return "", false
+	}
+	expires, err := time.Parse(time.RFC3339, metadata[metaExpires])
+	return h.Checksum, err == nil && time.Now().Before(expires)
+}
+
+// cacheResult stores the handler result in the result cache below key and returns its checksum.
+func (s *Server) cacheResult(ctx context.Context, key string, result Output) (string, error) {
+	h, err := fileHeader(result.Filename)
+	if err != nil {
+		return "", err
+	}
+	internal := mergeMetadata(h.metadata(), map[string]string{
+		metaExpires: time.Now().Add(s.resultCacheTTL).UTC().Format(time.RFC3339),
+	})
+	return h.Checksum, s.upload(ctx, result.Filename, key, result.Metadata, internal)
+}
+
+// respondRef responds to the request with a reference to the output stored below ref,
+// which content has the given checksum.
+// The client reads the output from ref, and deletes it afterwards if owned is set.
+func (s *Server) respondRef(ctx context.Context, parts keyParts, replyTo string, attrs map[string]string, ref, checksum string, owned bool) error {
+	key := s.responseKey(parts, replyTo)
+	attrsMeta, err := encodeAttributes(attrs)
+	if err != nil {
+		return err
+	}
+	meta := mergeMetadata(mergeMetadata(map[string]string{metaRef: ref}, s.signature(parts.id, checksum)), attrsMeta)
+	if owned {
+		meta[metaRefOwned] = "true"
+	}
+	if err := s.putBytes(ctx, key, nil, "", meta); err != nil {
+		return err
+	}
+	return s.notifyClient(ctx, replyTo, key, attrs)
+}
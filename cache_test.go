@@ -0,0 +1,141 @@
+package s3rpc
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestResultCache(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	var (
+		mu    sync.Mutex
+		calls int
+	)
+	handlers := Handlers{
+		"upper": func(ctx context.Context, input Input) (Output, error) {
+			mu.Lock()
+			calls++
+			mu.Unlock()
+			return upperHandler(ctx, input)
+		},
+	}
+
+	client1 := newTestClient(c, bus, blobs, ClientOptions{})
+	client2 := newTestClient(c, bus, blobs, ClientOptions{})
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: handlers, ResultCacheTTL: time.Hour})
+
+	execute := func(client *Client, content string, metadata map[string]string) Output {
+		output, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", content), Metadata: metadata})
+		c.Assert(err, qt.IsNil)
+		b, err := os.ReadFile(output.Filename)
+		c.Assert(err, qt.IsNil)
+		c.Assert(string(b), qt.Equals, strings.ToUpper(content))
+		return output
+	}
+
+	output := execute(client1, "foo", map[string]string{"a": "b"})
+	c.Assert(output.Metadata, qt.DeepEquals, map[string]string{"a": "b"})
+	output = execute(client2, "foo", map[string]string{"a": "b"})
+	c.Assert(output.Metadata, qt.DeepEquals, map[string]string{"a": "b"})
+	c.Assert(calls, qt.Equals, 1)
+
+	// Different metadata.
+	execute(client2, "foo", nil)
+	c.Assert(calls, qt.Equals, 2)
+
+	// Different input.
+	execute(client1, "bar", map[string]string{"a": "b"})
+	c.Assert(calls, qt.Equals, 3)
+
+	// Only the cached results are left.
+	waitFor(c, func() bool { return len(blobs.keys()) == 3 })
+	for _, key := range blobs.keys() {
+		c.Assert(strings.HasPrefix(key, cachePrefix+"/upper/"), qt.IsTrue)
+	}
+}
+
+func TestResultCacheLookupStat(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := &getRecordingBlobStore{memBlobStore: newMemBlobStore()}
+
+	client := newTestClient(c, bus, blobs, ClientOptions{})
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}, ResultCacheTTL: time.Hour})
+
+	for i := 0; i < 2; i++ {
+		_, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+		c.Assert(err, qt.IsNil)
+	}
+
+	// The cached result is looked up without fetching it,
+	// and only fetched by the client.
+	var cacheGets int
+	for _, key := range blobs.getKeys() {
+		if strings.HasPrefix(key, cachePrefix+"/") {
+			cacheGets++
+		}
+	}
+	c.Assert(cacheGets, qt.Equals, 2)
+}
+
+// getRecordingBlobStore records the keys of the objects fetched with Get.
+type getRecordingBlobStore struct {
+	*memBlobStore
+
+	mu   sync.Mutex
+	gets []string
+}
+
+func (b *getRecordingBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, map[string]string, error) {
+	b.mu.Lock()
+	b.gets = append(b.gets, key)
+	b.mu.Unlock()
+	return b.memBlobStore.Get(ctx, key)
+}
+
+func (b *getRecordingBlobStore) getKeys() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.gets...)
+}
+
+func TestResultCacheExpired(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	var calls int
+	handlers := Handlers{
+		"upper": func(ctx context.Context, input Input) (Output, error) {
+			calls++
+			return upperHandler(ctx, input)
+		},
+		"uncached": upperHandler,
+	}
+
+	client := newTestClient(c, bus, blobs, ClientOptions{})
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: handlers, ResultCacheTTL: time.Nanosecond, ResultCacheOps: []string{"upper"}})
+
+	for i := 0; i < 2; i++ {
+		_, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+		c.Assert(err, qt.IsNil)
+	}
+	c.Assert(calls, qt.Equals, 2)
+
+	_, err := client.Execute(context.Background(), "uncached", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.IsNil)
+	waitFor(c, func() bool { return len(blobs.keys()) == 1 })
+}
@@ -0,0 +1,134 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// cancelPrefix is the key prefix of the cancellation markers written by Client.Cancel.
+const cancelPrefix = "cancel"
+
+// cancelKey returns the key of the cancellation marker of the request with the given ID.
+// It does not depend on the key template, so the server only needs the request ID to find it.
+func cancelKey(id string) string {
+	return cancelPrefix + "/" + id
+}
+
+// ErrRequestCancelled is returned (wrapped) by Trigger when the request was cancelled, see Client.Cancel.
+var ErrRequestCancelled = errors.New("request cancelled")
+
+// Cancel cancels the request with the given id, e.g. from PrepareUpload, Progress.ID or Server.InFlight.
+// It works the same for requests sent by Execute and Trigger, from this or any other client.
+//
+// It writes a cancellation marker, which servers check for (with a HEAD request) for every request they pick up,
+// so a request not yet picked up by a server is never handled.
+// If the request is one of this client's, i.e. an Execute or Trigger in progress or an upload
+// prepared within ClientOptions.UploadURLExpiry, Cancel also deletes its input.
+// The input of any other request is only deleted once a server picks it up and drops it.
+// Once picked up, the handler is only stopped if the server has ServerOptions.CancelCheckInterval set;
+// its context is then cancelled and any output discarded.
+// A request already responded to is not affected, so Cancel does not tell whether the request was handled;
+// an Execute or Trigger waiting for the response gets either the output or ErrRequestCancelled.
+//
+// Nothing deletes the markers, so the bucket needs a lifecycle rule expiring the objects below cancel/,
+// such as the rule expiring all objects after a day that NewProvisioner sets up.
+func (c *Client) Cancel(ctx context.Context, id string) error {
+	id = strings.ToLower(id)
+	if _, err := ulid.Parse(id); err != nil {
+		return fmt.Errorf("cancel: invalid request id %q: %w", id, err)
+	}
+	// Mark it first, so a server that has already downloaded the input sees it.
+	if err := c.putBytes(ctx, cancelKey(id), nil, "", nil); err != nil {
+		return fmt.Errorf("cancel: %w", err)
+	}
+	if key, found := c.inputKey(id); found {
+		if err := c.deleteObject(ctx, key); err != nil {
+			return fmt.Errorf("cancel: %w", err)
+		}
+	}
+	return nil
+}
+
+// pendingInput is the input key of one of the client's requests, see Client.trackInput.
+type pendingInput struct {
+	key string
+
+	// expires is when to forget the key, if not forgotten before.
+	expires time.Time
+}
+
+// trackInput remembers the input key of the request with the given id, so Cancel can delete the input,
+// until expires, if set, or until the returned func is called.
+func (c *Client) trackInput(id, key string, expires time.Time) func() {
+	now := time.Now()
+	c.inputsMu.Lock()
+	defer c.inputsMu.Unlock()
+	for id, input := range c.inputs {
+		if !input.expires.IsZero() && now.After(input.expires) {
+			delete(c.inputs, id)
+		}
+	}
+	c.inputs[id] = pendingInput{key: key, expires: expires}
+	return func() {
+		c.inputsMu.Lock()
+		delete(c.inputs, id)
+		c.inputsMu.Unlock()
+	}
+}
+
+// inputKey returns the input key of the request with the given id, if it is one of the client's.
+func (c *Client) inputKey(id string) (string, bool) {
+	c.inputsMu.Lock()
+	defer c.inputsMu.Unlock()
+	input, found := c.inputs[id]
+	if !found || (!input.expires.IsZero() && time.Now().After(input.expires)) {
+		return "", false
+	}
+	return input.key, true
+}
+
+// isCancelled reports whether the request with the given id has been cancelled, see Client.Cancel.
+func (s *Server) isCancelled(ctx context.Context, id string) bool {
+	if _, err := s.statObject(ctx, cancelKey(id)); err != nil {
+		// Most likely not found.
+		return false
+	}
+	return true
+}
+
+// watchCancel returns a context that is cancelled once the request with the given id is cancelled,
+// checking every CancelCheckInterval, and a func reporting whether it was.
+// The returned stop func must be called when done.
+func (s *Server) watchCancel(ctx context.Context, id string) (_ context.Context, cancelled func() bool, stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	var flag int32
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(s.cancelCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if s.isCancelled(ctx, id) {
+					atomic.StoreInt32(&flag, 1)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return ctx, func() bool { return atomic.LoadInt32(&flag) == 1 }, func() {
+		close(done)
+		cancel()
+	}
+}
@@ -0,0 +1,181 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestCancel(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	prepare := func(c *qt.C, client *Client, blobs BlobStore) string {
+		putURL, id, err := client.PrepareUpload(ctx, "upper")
+		c.Assert(err, qt.IsNil)
+		key := strings.TrimSuffix(strings.TrimPrefix(putURL, "https://example.com/"), "?expires=15m0s")
+		c.Assert(blobs.Put(ctx, key, strings.NewReader("foo"), nil), qt.IsNil)
+		return id
+	}
+
+	c.Run("Before pickup", func(c *qt.C) {
+		bus := newMemBus()
+		blobs := &presigningBlobStore{memBlobStore: newMemBlobStore()}
+		client := newTestClient(c, bus, blobs, ClientOptions{})
+
+		var calls int32
+		newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{
+			"upper": func(ctx context.Context, input Input) (Output, error) {
+				atomic.AddInt32(&calls, 1)
+				return upperHandler(ctx, input)
+			},
+		}})
+
+		id := prepare(c, client, blobs)
+		c.Assert(client.Cancel(ctx, id), qt.IsNil)
+		// The input of a prepared upload is deleted right away.
+		c.Assert(blobs.keys(), qt.DeepEquals, []string{cancelKey(id)})
+
+		_, err := client.Trigger(ctx, "upper", id)
+		c.Assert(errors.Is(err, ErrRequestCancelled), qt.IsTrue)
+		c.Assert(atomic.LoadInt32(&calls), qt.Equals, int32(0))
+	})
+
+	c.Run("Other client before pickup", func(c *qt.C) {
+		bus := newMemBus()
+		blobs := &presigningBlobStore{memBlobStore: newMemBlobStore()}
+		client := newTestClient(c, bus, blobs, ClientOptions{})
+		other := newTestClient(c, newMemBus(), blobs, ClientOptions{})
+
+		var calls int32
+		newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{
+			"upper": func(ctx context.Context, input Input) (Output, error) {
+				atomic.AddInt32(&calls, 1)
+				return upperHandler(ctx, input)
+			},
+		}})
+
+		id := prepare(c, client, blobs)
+		c.Assert(other.Cancel(ctx, id), qt.IsNil)
+		// The other client only writes the marker.
+		c.Assert(blobs.keys(), qt.HasLen, 2)
+
+		_, err := client.Trigger(ctx, "upper", id)
+		c.Assert(errors.Is(err, ErrRequestCancelled), qt.IsTrue)
+		c.Assert(atomic.LoadInt32(&calls), qt.Equals, int32(0))
+		// The server deletes the input.
+		waitFor(c, func() bool { return len(blobs.keys()) == 1 })
+		c.Assert(blobs.has(cancelKey(id)), qt.IsTrue)
+	})
+
+	c.Run("Execute before pickup", func(c *qt.C) {
+		bus := newMemBus()
+		blobs := newMemBlobStore()
+		client := newTestClient(c, bus, blobs, ClientOptions{})
+
+		errc := make(chan error, 1)
+		go func() {
+			_, err := client.Execute(ctx, "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+			errc <- err
+		}()
+
+		// Cancel it by its ID alone before any server is running.
+		waitFor(c, func() bool { return bus.queue(toServer).len() == 1 })
+		keys := blobs.keys()
+		c.Assert(keys, qt.HasLen, 1)
+		_, parts, err := client.keys.parse(keys[0])
+		c.Assert(err, qt.IsNil)
+		c.Assert(client.Cancel(ctx, parts.id), qt.IsNil)
+		c.Assert(blobs.keys(), qt.DeepEquals, []string{cancelKey(parts.id)})
+
+		var calls int32
+		newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{
+			"upper": func(ctx context.Context, input Input) (Output, error) {
+				atomic.AddInt32(&calls, 1)
+				return upperHandler(ctx, input)
+			},
+		}})
+
+		err = <-errc
+		c.Assert(errors.Is(err, ErrRequestCancelled), qt.IsTrue)
+		c.Assert(err, qt.ErrorMatches, "apply: request cancelled")
+		c.Assert(atomic.LoadInt32(&calls), qt.Equals, int32(0))
+		c.Assert(blobs.keys(), qt.DeepEquals, []string{cancelKey(parts.id)})
+	})
+
+	c.Run("Execute during processing", func(c *qt.C) {
+		bus := newMemBus()
+		blobs := newMemBlobStore()
+		client := newTestClient(c, bus, blobs, ClientOptions{})
+
+		started := make(chan string)
+		server := newTestServer(c, bus, blobs, ServerOptions{
+			CancelCheckInterval: 5 * time.Millisecond,
+			Handlers: Handlers{
+				"upper": func(ctx context.Context, input Input) (Output, error) {
+					started <- RequestIDFromContext(ctx)
+					<-ctx.Done()
+					return Output{}, ctx.Err()
+				},
+			},
+		})
+
+		errc := make(chan error, 1)
+		go func() {
+			_, err := client.Execute(ctx, "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+			errc <- err
+		}()
+
+		id := <-started
+		c.Assert(server.InFlight()[0].ID, qt.Equals, id)
+		c.Assert(client.Cancel(ctx, id), qt.IsNil)
+		err := <-errc
+		c.Assert(errors.Is(err, ErrRequestCancelled), qt.IsTrue)
+		c.Assert(err, qt.ErrorMatches, "apply: request cancelled")
+	})
+
+	c.Run("During processing", func(c *qt.C) {
+		bus := newMemBus()
+		blobs := &presigningBlobStore{memBlobStore: newMemBlobStore()}
+		client := newTestClient(c, bus, blobs, ClientOptions{})
+
+		started := make(chan struct{})
+		handlerErr := make(chan error, 1)
+		newTestServer(c, bus, blobs, ServerOptions{
+			CancelCheckInterval: 5 * time.Millisecond,
+			Handlers: Handlers{
+				"upper": func(ctx context.Context, input Input) (Output, error) {
+					close(started)
+					<-ctx.Done()
+					handlerErr <- ctx.Err()
+					// The output is discarded.
+					return upperHandler(context.Background(), input)
+				},
+			},
+		})
+
+		id := prepare(c, client, blobs)
+		errc := make(chan error, 1)
+		go func() {
+			_, err := client.Trigger(ctx, "upper", id)
+			errc <- err
+		}()
+
+		<-started
+		c.Assert(client.Cancel(ctx, id), qt.IsNil)
+		c.Assert(<-handlerErr, qt.Equals, context.Canceled)
+		err := <-errc
+		c.Assert(errors.Is(err, ErrRequestCancelled), qt.IsTrue)
+		c.Assert(err, qt.ErrorMatches, "trigger: request cancelled")
+	})
+
+	c.Run("Invalid id", func(c *qt.C) {
+		client := newTestClient(c, newMemBus(), newMemBlobStore(), ClientOptions{})
+		c.Assert(client.Cancel(ctx, "foo"), qt.ErrorMatches, `cancel: invalid request id "foo": .*`)
+	})
+}
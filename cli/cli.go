@@ -0,0 +1,177 @@
+// Package cli implements a command line interface for s3rpc clients,
+// e.g. for use in shell pipelines:
+//
+//	cat in.txt | s3rpc exec upper > out.txt
+//
+// It lives in its own package so library users don't pull in the flag parsing.
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bep/s3rpc"
+)
+
+// The environment variables used as flag defaults.
+// The queue and credentials match the output of s3rpc.PrintProvisionResults.
+const (
+	envQueue           = "S3RPC_CLIENT_QUEUE"
+	envAccessKeyID     = "S3RPC_CLIENT_ACCESS_KEY_ID"
+	envSecretAccessKey = "S3RPC_CLIENT_SECRET_ACCESS_KEY"
+	envBucket          = "S3RPC_BUCKET"
+	envRegion          = "S3RPC_REGION"
+)
+
+const usage = `Usage: s3rpc exec [flags] <op>
+
+Executes op with the input read from stdin and writes the output to stdout.
+The credentials are read from the ` + envAccessKeyID + ` and ` + envSecretAccessKey + `
+environment variables.
+
+Flags:
+`
+
+// Run runs the command line interface with the given arguments (without the program name),
+// reading the input from os.Stdin and writing the output to os.Stdout.
+// An interrupt or SIGTERM cancels the request, and the temporary files are removed before Run returns.
+func Run(args []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	r := &runner{
+		stdin:     os.Stdin,
+		stdout:    os.Stdout,
+		stderr:    os.Stderr,
+		getenv:    os.Getenv,
+		newClient: s3rpc.NewClient,
+	}
+	return r.run(ctx, args)
+}
+
+type runner struct {
+	stdin          io.Reader
+	stdout, stderr io.Writer
+	getenv         func(string) string
+	newClient      func(s3rpc.ClientOptions) (*s3rpc.Client, error)
+}
+
+func (r *runner) run(ctx context.Context, args []string) error {
+	if len(args) == 0 || args[0] != "exec" {
+		fmt.Fprint(r.stderr, usage)
+		return errors.New("expected the exec command")
+	}
+	return r.exec(ctx, args[1:])
+}
+
+func (r *runner) exec(ctx context.Context, args []string) error {
+	var (
+		opts    s3rpc.ClientOptions
+		name    string
+		verbose bool
+		meta    = make(metadataFlag)
+	)
+
+	fs := flag.NewFlagSet("exec", flag.ContinueOnError)
+	fs.SetOutput(r.stderr)
+	fs.Usage = func() {
+		fmt.Fprint(r.stderr, usage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&opts.Queue, "queue", r.getenv(envQueue), "the client's SQS queue URL (default $"+envQueue+")")
+	fs.StringVar(&opts.Bucket, "bucket", r.getenv(envBucket), "the S3 bucket (default $"+envBucket+")")
+	fs.StringVar(&opts.Region, "region", r.getenv(envRegion), "the AWS region (default $"+envRegion+")")
+	fs.DurationVar(&opts.Timeout, "timeout", 5*time.Minute, "how long to wait for the response, 0 to wait forever")
+	fs.StringVar(&name, "name", "stdin", "the input's filename, passed on to the server")
+	fs.Var(meta, "meta", "input metadata as key=value, may be repeated")
+	fs.BoolVar(&verbose, "v", false, "log to stderr")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected exactly one op")
+	}
+	op := fs.Arg(0)
+
+	opts.AccessKeyID = r.getenv(envAccessKeyID)
+	opts.SecretAccessKey = r.getenv(envSecretAccessKey)
+	// stdout is for the output only.
+	opts.Infof = func(format string, args ...interface{}) {
+		if verbose {
+			fmt.Fprintf(r.stderr, "s3rpc: "+format+"\n", args...)
+		}
+	}
+
+	client, err := r.newClient(opts)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	dir, err := os.MkdirTemp("", "s3rpc_cli")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, filepath.Base(name))
+	if err := writeFile(filename, r.stdin); err != nil {
+		return err
+	}
+
+	output, err := client.Execute(ctx, op, s3rpc.Input{Filename: filename, Metadata: meta})
+	if err != nil {
+		return err
+	}
+	defer os.Remove(output.Filename)
+
+	f, err := os.Open(output.Filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(r.stdout, f)
+	return err
+}
+
+func writeFile(filename string, r io.Reader) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// metadataFlag is a repeatable key=value flag.
+type metadataFlag map[string]string
+
+func (f metadataFlag) String() string {
+	var pairs []string
+	for k, v := range f {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f metadataFlag) Set(s string) error {
+	k, v, found := strings.Cut(s, "=")
+	if !found || k == "" {
+		return fmt.Errorf("expected key=value, got %q", s)
+	}
+	f[k] = v
+	return nil
+}
@@ -0,0 +1,194 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bep/s3rpc"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestExec(t *testing.T) {
+	c := qt.New(t)
+
+	blobs := &memBlobStore{objects: make(map[string][]byte), metadata: make(map[string]map[string]string)}
+	bus := &memBus{queues: make(map[string]chan s3rpc.Note)}
+
+	server, err := s3rpc.NewServer(s3rpc.ServerOptions{
+		Notifier:     bus.notifier("to_server"),
+		BlobStore:    blobs,
+		PollInterval: time.Millisecond,
+		Handlers: s3rpc.Handlers{
+			"upper": func(ctx context.Context, input s3rpc.Input) (s3rpc.Output, error) {
+				b, err := os.ReadFile(input.Filename)
+				if err != nil {
+					return s3rpc.Output{}, err
+				}
+				filename := input.Filename + ".out"
+				s := strings.ToUpper(string(b)) + fmt.Sprintf(" %s=%s", "lang", input.Metadata["lang"])
+				return s3rpc.Output{Filename: filename}, os.WriteFile(filename, []byte(s), 0o644)
+			},
+		},
+		Infof:     func(format string, args ...interface{}) {},
+		AWSConfig: s3rpc.AWSConfig{Bucket: "testbucket"},
+	})
+	c.Assert(err, qt.IsNil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.ListenAndServe(ctx) }()
+	defer func() {
+		cancel()
+		server.Close()
+		<-done
+	}()
+
+	env := map[string]string{
+		envQueue:           "https://sqs.eu-north-1.amazonaws.com/123456789012/s3rpctest_client",
+		envBucket:          "testbucket",
+		envAccessKeyID:     "id",
+		envSecretAccessKey: "secret",
+	}
+
+	var gotOpts s3rpc.ClientOptions
+	var stdout, stderr bytes.Buffer
+	r := &runner{
+		stdin:  strings.NewReader("foo"),
+		stdout: &stdout,
+		stderr: &stderr,
+		getenv: func(k string) string { return env[k] },
+		newClient: func(opts s3rpc.ClientOptions) (*s3rpc.Client, error) {
+			gotOpts = opts
+			opts.Notifier = bus.notifier("to_client")
+			opts.BlobStore = blobs
+			return s3rpc.NewClient(opts)
+		},
+	}
+
+	c.Assert(r.run(context.Background(), []string{"exec", "-meta", "lang=en", "-timeout", "10s", "upper"}), qt.IsNil)
+	c.Assert(stdout.String(), qt.Equals, "FOO lang=en")
+	c.Assert(stderr.String(), qt.Equals, "")
+	c.Assert(gotOpts.Queue, qt.Equals, env[envQueue])
+	c.Assert(gotOpts.Bucket, qt.Equals, "testbucket")
+	c.Assert(gotOpts.AccessKeyID, qt.Equals, "id")
+	c.Assert(gotOpts.SecretAccessKey, qt.Equals, "secret")
+	c.Assert(gotOpts.Timeout, qt.Equals, 10*time.Second)
+}
+
+func TestExecArgs(t *testing.T) {
+	c := qt.New(t)
+
+	run := func(args ...string) error {
+		r := &runner{
+			stdin:  strings.NewReader(""),
+			stdout: io.Discard,
+			stderr: io.Discard,
+			getenv: func(string) string { return "" },
+			newClient: func(opts s3rpc.ClientOptions) (*s3rpc.Client, error) {
+				return s3rpc.NewClient(opts)
+			},
+		}
+		return r.run(context.Background(), args)
+	}
+
+	c.Assert(run(), qt.ErrorMatches, "expected the exec command")
+	c.Assert(run("foo"), qt.ErrorMatches, "expected the exec command")
+	c.Assert(run("exec"), qt.ErrorMatches, "expected exactly one op")
+	c.Assert(run("exec", "a", "b"), qt.ErrorMatches, "expected exactly one op")
+	c.Assert(run("exec", "-meta", "foo", "upper"), qt.ErrorMatches, `invalid value "foo" for flag -meta: expected key=value, got "foo"`)
+	c.Assert(run("exec", "upper"), qt.ErrorMatches, "access key id is required")
+}
+
+type memBlobStore struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	metadata map[string]map[string]string
+}
+
+func (b *memBlobStore) Put(ctx context.Context, key string, body io.Reader, metadata map[string]string) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[key] = data
+	b.metadata[key] = metadata
+	return nil
+}
+
+func (b *memBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, map[string]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, found := b.objects[key]
+	if !found {
+		return nil, nil, fmt.Errorf("%s: not found", key)
+	}
+	return io.NopCloser(bytes.NewReader(data)), b.metadata[key], nil
+}
+
+func (b *memBlobStore) Delete(ctx context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.objects, key)
+	delete(b.metadata, key)
+	return nil
+}
+
+// memBus routes the notes to a queue named after the first path element of the key.
+type memBus struct {
+	mu     sync.Mutex
+	queues map[string]chan s3rpc.Note
+}
+
+func (b *memBus) queue(name string) chan s3rpc.Note {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, found := b.queues[name]
+	if !found {
+		q = make(chan s3rpc.Note, 100)
+		b.queues[name] = q
+	}
+	return q
+}
+
+func (b *memBus) notifier(name string) s3rpc.Notifier {
+	return &memNotifier{bus: b, name: name}
+}
+
+type memNotifier struct {
+	bus  *memBus
+	name string
+}
+
+func (n *memNotifier) Send(ctx context.Context, note s3rpc.Note) error {
+	name, _, _ := strings.Cut(note.Key, "/")
+	n.bus.queue(name) <- note
+	return nil
+}
+
+func (n *memNotifier) Receive(ctx context.Context) ([]s3rpc.Note, error) {
+	select {
+	case note := <-n.bus.queue(n.name):
+		return []s3rpc.Note{note}, nil
+	case <-time.After(50 * time.Millisecond):
+		return nil, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (n *memNotifier) Ack(ctx context.Context, note s3rpc.Note) error {
+	return nil
+}
+
+func (n *memNotifier) Nack(ctx context.Context, note s3rpc.Note) error {
+	n.bus.queue(n.name) <- note
+	return nil
+}
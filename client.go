@@ -2,21 +2,20 @@ package s3rpc
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
-	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/credentials"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/oklog/ulid/v2"
-
-	"golang.org/x/sync/errgroup"
 )
 
 // NewClient creates a new client.
@@ -30,8 +29,16 @@ func NewClient(opts ClientOptions) (*Client, error) {
 		Credentials: credentials.NewStaticCredentialsProvider(opts.AccessKeyID, opts.SecretAccessKey, ""),
 	}
 
-	if opts.Timeout == 0 {
-		opts.Timeout = 5 * time.Minute
+	if opts.MaxReceiveRetries == 0 {
+		opts.MaxReceiveRetries = defaultMaxReceiveRetries
+	}
+
+	if opts.UploadURLExpiry == 0 {
+		opts.UploadURLExpiry = defaultUploadURLExpiry
+	}
+
+	if opts.DuplicateResponseTTL == 0 {
+		opts.DuplicateResponseTTL = defaultDuplicateResponseTTL
 	}
 
 	if opts.Infof == nil {
@@ -40,119 +47,455 @@ func NewClient(opts ClientOptions) (*Client, error) {
 		}
 	}
 
-	tempDir, err := os.MkdirTemp("", "s3rpc_client")
+	blobs := opts.BlobStore
+	if blobs == nil {
+		var err error
+		blobs, err = newS3BlobStore(newS3Client(opts.AWSConfig, awsCfg, opts.Infof), opts.AWSConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	notifier := opts.Notifier
+	if notifier == nil && len(opts.ReplyEndpoints) == 0 {
+		sqsClient, err := newSQSClient(opts.AWSConfig, awsCfg, opts.Queue, opts.Infof)
+		if err != nil {
+			return nil, err
+		}
+		notifier = NewSQSNotifier(sqsClient, opts.Queue)
+	}
+
+	keys, err := newKeyLayout(opts.KeyTemplate)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Client{
-		timeout: opts.Timeout,
+	c := &Client{
+		timeout:           opts.Timeout,
+		uploadTimeout:     opts.UploadTimeout,
+		uploadURLExpiry:   opts.UploadURLExpiry,
+		maxReceiveRetries: opts.MaxReceiveRetries,
+		duplicateTTL:      opts.DuplicateResponseTTL,
+		onProgress:        opts.OnProgress,
+		onOutputPath:      opts.OnOutputPath,
+		onMetrics:         opts.OnMetrics,
+		replyTo:           opts.ReplyTo,
+		maxTempBytes:      opts.MaxTempBytes,
+		maxTempFiles:      opts.MaxTempFiles,
+		tempFilePolicy:    opts.TempFilePolicy,
+		keepObjects:       opts.KeepObjects,
 		common: &common{
-			bucket:    opts.Bucket,
-			queue:     opts.Queue,
-			s3Client:  s3.NewFromConfig(awsCfg),
-			sqsClient: sqs.NewFromConfig(awsCfg),
-			tempDir:   tempDir,
-			infof:     opts.Infof,
+			bucket:            opts.Bucket,
+			keys:              keys,
+			blobs:             blobs,
+			notifier:          notifier,
+			hmacKey:           opts.ResponseHMACKey,
+			releaseVisibility: opts.ReleaseVisibility,
+			infof:             opts.Infof,
 		},
-	}, nil
+	}
+	if err := c.initReplyEndpoints(opts.ReplyEndpoints, opts.AWSConfig, awsCfg); err != nil {
+		return nil, err
+	}
+	if len(c.endpoints) > 0 {
+		c.notifier = c.endpoints[0].Notifier
+	}
+
+	// Last, so it is not left behind if any of the above fails.
+	c.tempDir, err = os.MkdirTemp("", "s3rpc_client")
+	if err != nil {
+		return nil, err
+	}
+	if opts.MaxInFlight > 0 {
+		c.slots = make(chan struct{}, opts.MaxInFlight)
+	}
+	c.dispatcher = newDispatcher(c)
+	c.inputs = make(map[string]pendingInput)
+	c.closed, c.cancelClose = context.WithCancel(context.Background())
+
+	return c, nil
 
 }
 
 // Client is a client for executing operations on a server.
 type Client struct {
-	timeout time.Duration
+	// active is the number of Execute calls in progress.
+	// Accessed atomically, and first in the struct to be 64-bit aligned.
+	active int64
+
+	timeout           time.Duration
+	uploadTimeout     time.Duration
+	uploadURLExpiry   time.Duration
+	maxReceiveRetries int
+	duplicateTTL      time.Duration
+	onProgress        func(Progress)
+	onOutputPath      func(id, filename string)
+	onMetrics         func(Metrics)
+	replyTo           string
+	maxTempBytes      int64
+	maxTempFiles      int
+	tempFilePolicy    TempFilePolicy
+	keepObjects       bool
+
+	// endpoints are the reply endpoints, see ClientOptions.ReplyEndpoints.
+	// endpoint is the index of the active one, guarded by endpointMu.
+	endpoints  []ReplyEndpoint
+	endpointMu sync.Mutex
+	endpoint   int
+
+	// slots limits the Execute calls in progress, nil if unlimited.
+	slots chan struct{}
+
+	// Guards tempBytes, the bytes reserved for temporary files, see reserveTemp,
+	// tempOutputs, the sizes of the outputs they include,
+	// and tempFiles, the outputs not yet removed, oldest first.
+	tempMu      sync.Mutex
+	tempBytes   int64
+	tempOutputs map[string]int64
+	tempFiles   []string
+
+	dispatcher *dispatcher
+
+	// inputs maps the IDs of this client's requests to their input keys, see Cancel.
+	// Guarded by inputsMu.
+	inputsMu sync.Mutex
+	inputs   map[string]pendingInput
+
+	// closed is cancelled by Close.
+	// inflight tracks the Execute calls Close waits for.
+	closedMu    sync.Mutex
+	closed      context.Context
+	cancelClose context.CancelFunc
+	inflight    sync.WaitGroup
+
 	*common
 }
 
+// ErrClientClosed is returned (wrapped) by Execute when the client is closed.
+var ErrClientClosed = errors.New("client closed")
+
 // Execute executes the given op on a server with input.Filename as its main input.
 // This will block until the response is received or the timeout is reached.
 // Note that Output.Filename should be considered temporary and will be removed on Close.
+//
+// The uploaded input is handed over to the server, which deletes it once it has downloaded it.
+// The client only deletes the input if Execute fails, e.g. on timeout.
+//
+// Close cancels the outstanding Execute calls, which then fail with ErrClientClosed.
 func (c *Client) Execute(ctx context.Context, op string, input Input) (Output, error) {
+	return c.do(ctx, "apply", func(ctx context.Context) (Output, error) {
+		return c.execute(ctx, op, input)
+	})
+}
+
+// do runs fn as an Execute call, see begin and acquire.
+// Errors not returned by fn are prefixed with prefix.
+func (c *Client) do(ctx context.Context, prefix string, fn func(ctx context.Context) (Output, error)) (Output, error) {
+	ctx, done, err := c.begin(ctx)
+	if err != nil {
+		return Output{}, fmt.Errorf("%s: %w", prefix, err)
+	}
+	defer done()
+
+	release, err := c.acquire(ctx)
+	if err != nil {
+		if c.closed.Err() != nil {
+			err = ErrClientClosed
+		}
+		return Output{}, fmt.Errorf("%s: %w", prefix, err)
+	}
+	defer release()
+
+	if err := c.checkTempFiles(); err != nil {
+		return Output{}, fmt.Errorf("%s: %w", prefix, err)
+	}
+
+	output, err := fn(ctx)
+	if err != nil && c.closed.Err() != nil {
+		return Output{}, fmt.Errorf("%s: %w", prefix, ErrClientClosed)
+	}
+	return output, err
+}
+
+// begin registers an Execute call and returns a context that is also cancelled by Close.
+// The returned func must be called when done.
+func (c *Client) begin(ctx context.Context) (context.Context, func(), error) {
+	c.closedMu.Lock()
+	defer c.closedMu.Unlock()
+	if c.closed.Err() != nil {
+		return nil, nil, ErrClientClosed
+	}
+	c.inflight.Add(1)
+
+	ctx, cancel := context.WithCancel(ctx)
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-c.closed.Done():
+			cancel()
+		case <-stop:
+		}
+	}()
+
+	return ctx, func() {
+		close(stop)
+		cancel()
+		c.inflight.Done()
+	}, nil
+}
+
+// acquire waits for an in-flight slot, see ClientOptions.MaxInFlight.
+// The returned func must be called to release it.
+func (c *Client) acquire(ctx context.Context) (func(), error) {
+	if c.slots != nil {
+		select {
+		case c.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	atomic.AddInt64(&c.active, 1)
+	return func() {
+		atomic.AddInt64(&c.active, -1)
+		if c.slots != nil {
+			<-c.slots
+		}
+	}, nil
+}
+
+// InFlight returns the number of Execute calls in progress,
+// not counting calls waiting for a slot, see ClientOptions.MaxInFlight.
+func (c *Client) InFlight() int {
+	return int(atomic.LoadInt64(&c.active))
+}
+
+func (c *Client) execute(ctx context.Context, op string, input Input) (_ Output, err error) {
+	start := time.Now()
 	// ULID is case insensitive, and lower case works better for filenames.
 	id := strings.ToLower(ulid.Make().String())
-	key := fmt.Sprintf("%s/%s/%s_%s", toServer, op, id, filepath.Base(input.Filename))
+	defer func() { c.reportMetrics(op, id, start, err) }()
+	key := c.keys.key(toServer, keyParts{op: op, id: id, name: filepath.Base(input.Filename)}, start)
 
-	// First upload the file to the input folder.
-	if err := c.upload(input.Filename, key, input.Metadata); err != nil {
-		return Output{}, fmt.Errorf("apply: %v", err)
+	internal := map[string]string{
+		metaSubmittedAt: start.UTC().Format(time.RFC3339Nano),
+	}
+	if c.onProgress != nil {
+		internal[metaWantProgress] = "true"
+	}
+	if replyTo, fallbacks := c.replyQueues(); replyTo != "" {
+		internal[metaReplyTo] = replyTo
+		if len(fallbacks) > 0 {
+			internal[metaReplyToFallback] = strings.Join(fallbacks, ",")
+		}
+	}
+	if c.keepObjects {
+		internal[metaKeep] = "true"
+	}
+	if deadline, ok := c.deadline(ctx, time.Now()); ok {
+		internal[metaDeadline] = deadline.UTC().Format(time.RFC3339Nano)
 	}
 
-	var output Output
+	// Listen for the response before sending the request, so a fast server's
+	// response is never released for lack of a waiter.
+	w, unregister := c.dispatcher.register(id)
+	defer unregister()
+	defer c.trackInput(id, key, time.Time{})()
+
+	// Then upload the file to the input folder.
+	if err := c.send(ctx, input, key, internal); err != nil {
+		return Output{}, fmt.Errorf("apply: %w", err)
+	}
 
 	// Now, wait for the response from server.
-	ctx, cancel := context.WithTimeout(ctx, c.timeout)
-	defer cancel()
-
-	g, ctx := errgroup.WithContext(ctx)
-	g.Go(func() error {
-		for {
-			select {
-			case <-ctx.Done():
-				return nil
-			default:
-				//c.infof("Checking queue %q for new messages", c.queue)
-				ms, err := c.Receive(ctx)
-				if err != nil {
-					return err
-				}
-				for _, m := range ms {
-					if m.Bucket != c.bucket {
-						return fmt.Errorf("expected bucket %q, got %q", c.bucket, m.Bucket)
-					}
-
-					if !strings.Contains(m.Key, id) {
-						if err := c.releaseMessage(ctx, m.ReceiptHandle); err != nil {
-							return err
-						}
-						continue
-					}
-
-					// We found the message we are looking for.
-					// Delete the message from the queue and download the file from S3.
-					if err := c.deleteMessage(ctx, m.ReceiptHandle); err != nil {
-						return err
-					}
-
-					return func() error {
-						f, err := os.CreateTemp(c.tempDir, "*_"+path.Base(m.Key))
-						if err != nil {
-							return fmt.Errorf("tempfile: %w", err)
-						}
-						output.Filename = f.Name()
-						defer f.Close()
-
-						metaData, err := c.getObject(ctx, f, m.Key)
-						if err != nil {
-							return err
-						}
-						output.Metadata = metaData
-
-						// We don't need these anymore.
-						// They will eventually also expire,
-						// if the below should somehow fail,
-						// so ignore any error.
-						_ = c.deleteObject(ctx, m.Key)
-						_ = c.deleteObject(ctx, key)
-						return nil
-					}()
-				}
+	output, err := c.await(ctx, op, id, key, w)
+	if err != nil {
+		return Output{}, fmt.Errorf("apply: %w", err)
+	}
+
+	return output, nil
+
+}
+
+// await waits for the response to the request with the given id and input key, within Timeout if set.
+func (c *Client) await(ctx context.Context, op, id, key string, w *waiter) (Output, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	output, err := c.awaitResponse(ctx, op, id, w)
+	if err != nil {
+		// The server may never have picked up the input, so we need to clean it up.
+		// Use a fresh context, as ctx may be the reason we got here.
+		c.cleanup(context.Background(), key)
+		return Output{}, err
+	}
+	return output, nil
+}
+
+// send uploads the input and notifies the server, within UploadTimeout if set.
+func (c *Client) send(ctx context.Context, input Input, key string, internal map[string]string) error {
+	if c.uploadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.uploadTimeout)
+		defer cancel()
+	}
+	if err := validateAttributes(input.Attributes); err != nil {
+		return err
+	}
+	attrs, err := encodeAttributes(input.Attributes)
+	if err != nil {
+		return err
+	}
+	err = c.upload(ctx, input.Filename, key, input.Metadata, mergeMetadata(internal, attrs))
+	if err == nil {
+		err = c.notifier.Send(ctx, Note{Bucket: c.bucket, Key: key, Attributes: input.Attributes})
+	}
+	if err != nil && ctx.Err() != nil {
+		// The upload may have completed just in time.
+		// Use a fresh context, as ctx is the reason we got here.
+		c.cleanup(context.Background(), key)
+	}
+	return err
+}
+
+// awaitResponse waits for the response to the request with the given id.
+func (c *Client) awaitResponse(ctx context.Context, op, id string, w *waiter) (Output, error) {
+	for {
+		var m Message
+		select {
+		case <-ctx.Done():
+			return Output{}, ctx.Err()
+		case <-w.failed:
+			return Output{}, w.err
+		case m = <-w.messages:
+		}
+
+		// We found the message we are looking for.
+		// Delete the message from the queue and download the file from S3.
+		if err := c.DeleteMessage(ctx, m); err != nil {
+			return Output{}, err
+		}
+
+		body, metaData, err := c.openObject(ctx, m.Key)
+		if err != nil {
+			return Output{}, err
+		}
+		metaData, internal := splitMetadata(metaData)
+
+		if internal[metaKind] == kindProgress {
+			err := c.handleProgress(ctx, op, id, body, internal)
+			_ = c.deleteObject(ctx, m.Key)
+			if err != nil {
+				c.infof("Failed to read progress for %q: %s", id, err)
 			}
+			continue
+		}
+
+		// This is the response, so any duplicates of it are discarded.
+		c.dispatcher.markConsumed(id)
+
+		if internal[metaKind] == kindError {
+			err := c.readError(ctx, id, body, internal)
+			body.Close()
+			c.cleanup(ctx, m.Key)
+			return Output{}, err
 		}
-	})
 
-	if err := g.Wait(); err != nil {
-		return Output{}, fmt.Errorf("apply: %v", err)
+		// The signature covers the content, which may be stored elsewhere.
+		signature := internal[metaSignature]
+		attrs := messageAttributes(m.Note, internal)
+
+		var ownedRef string
+		if ref := internal[metaRef]; ref != "" {
+			// The output is stored elsewhere, e.g. in the server's result cache.
+			if internal[metaRefOwned] == "true" {
+				// The server handed the object over to us, see Output.Unchanged.
+				ownedRef = ref
+			}
+			body.Close()
+			body, metaData, err = c.openObject(ctx, ref)
+			if err != nil {
+				return Output{}, err
+			}
+			metaData, internal = splitMetadata(metaData)
+		}
+
+		defer body.Close()
+		h, err := readHeader(internal)
+		if err != nil {
+			return Output{}, err
+		}
+		if err := c.verifySignature(id, h.Checksum, signature); err != nil {
+			return Output{}, err
+		}
+		reservation, err := c.reserveTemp(h.Size)
+		if err != nil {
+			return Output{}, err
+		}
+		var onPath func(string)
+		if c.onOutputPath != nil {
+			onPath = func(filename string) { c.onOutputPath(id, filename) }
+		}
+		filename, err := c.downloadTemp(ctx, reservation.limit(body), tempPattern(m), h.Checksum, onPath)
+		// The output is the caller's to remove.
+		reservation.release(filename)
+		if err != nil {
+			return Output{}, err
+		}
+		c.trackTempFile(filename)
+
+		// We don't need this anymore.
+		// It will eventually also expire,
+		// if the below should somehow fail,
+		// so ignore any error.
+		// Note that the input is owned by the server once it's picked up,
+		// unless handed back to us.
+		c.cleanup(ctx, m.Key)
+		if ownedRef != "" {
+			c.cleanup(ctx, ownedRef)
+		}
+
+		return Output{Filename: filename, Metadata: metaData, ID: id, Attributes: attrs}, nil
 	}
+}
 
-	return output, nil
+// cleanup deletes the object stored below key unless ClientOptions.KeepObjects is set.
+func (c *Client) cleanup(ctx context.Context, key string) {
+	if c.keepObjects {
+		c.infof("Keeping %s/%s, see ClientOptions.KeepObjects", c.bucket, key)
+		return
+	}
+	_ = c.deleteObject(ctx, key)
+}
 
+func (c *Client) handleProgress(ctx context.Context, op, id string, body io.ReadCloser, internal map[string]string) error {
+	defer body.Close()
+	b, err := readBytes(ctx, body, internal)
+	if err != nil {
+		return err
+	}
+	var p progressBody
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	c.onProgress(Progress{Op: op, ID: id, Percent: p.Percent, Message: p.Message})
+	return nil
 }
 
-// Close removes the temporary directory.
+// Close cancels the outstanding Execute calls and waits for them to return,
+// then stops the poller and removes the temporary directory.
+// It is safe to call Close more than once.
 func (c *Client) Close() error {
 	var err error
 	c.closeOnce.Do(func() {
+		c.closedMu.Lock()
+		c.cancelClose()
+		c.closedMu.Unlock()
+		// Wait for the outstanding Execute calls to return before we remove their files.
+		c.inflight.Wait()
+		c.dispatcher.stop()
 		err = os.RemoveAll(c.tempDir)
 	})
 	return err
@@ -160,11 +503,129 @@ func (c *Client) Close() error {
 
 type ClientOptions struct {
 	// The out queue to listen for responses from server.
+	// Not used if Notifier is set.
 	Queue string
 
-	// Timeout is the maximum time to wait for a response from the server.
+	// ReplyTo, if set, is the SQS queue (URL or ARN) the server should send the responses to
+	// directly, instead of relying on the bucket's event notifications.
+	// This is typically the same queue as Queue, and allows a server to serve clients listening on different queues.
+	// The server falls back to the default route if its Notifier does not support it, see ReplyToSender.
+	ReplyTo string
+
+	// Notifier is used to receive responses from the server.
+	// If not set, an SQS notifier listening on Queue is used.
+	Notifier Notifier
+
+	// ReplyEndpoints, if set, are the queues to receive responses from, possibly in different regions,
+	// primary first, replacing Queue, ReplyTo and Notifier.
+	// The client receives from one endpoint at a time, starting with the primary,
+	// and fails over to the next one after MaxReceiveRetries consecutive failing receives
+	// (or a fatal error); Execute only fails once every endpoint has failed in a row.
+	// There is no automatic failback.
+	//
+	// Each request tells the server to send the responses to the endpoint active when it was submitted,
+	// falling back to the other endpoints, in order, if that fails, see ReplyTo.
+	// So a response lands in the first of these queues accepting it, and the client finds it there
+	// as long as it has not failed over since; responses already sent to an endpoint
+	// the client fails over from are not received, and those Execute calls time out.
+	ReplyEndpoints []ReplyEndpoint
+
+	// BlobStore is used to store inputs and fetch outputs.
+	// If not set, an S3 blob store using Bucket is used.
+	BlobStore BlobStore
+
+	// Timeout is the maximum time to wait for a response from the server
+	// once the input is uploaded, so it bounds the time the server may take to handle the request.
+	// If zero, Execute waits until the context passed to it is done,
+	// so make sure it has a deadline or is cancelled eventually.
+	// The time Execute gives up is sent with the request if known, i.e. if the context
+	// has a deadline or UploadTimeout is set as well, so the server can drop requests no one waits for.
 	Timeout time.Duration
 
+	// UploadTimeout, if set, is the maximum time to upload the input and notify the server.
+	// Execute fails without waiting for a response if it is exceeded.
+	// Execute may then take up to UploadTimeout + Timeout in total,
+	// both bounded by the deadline of the context passed to Execute.
+	UploadTimeout time.Duration
+
+	// MaxReceiveRetries is the number of consecutive failing receives from the
+	// Notifier tolerated (with backoff) before Execute fails.
+	// Fatal errors, e.g. access denied, fail fast.
+	// Defaults to 5, set to a negative value to fail on the first error.
+	MaxReceiveRetries int
+
+	// DuplicateResponseTTL is how long the client remembers the IDs of the responses it has consumed,
+	// so any duplicates of them, e.g. from a request handled twice under at-least-once delivery,
+	// are deleted from the queue and their objects cleaned up instead of being released over and over.
+	// Defaults to 15 minutes; set it to a negative value to release duplicates
+	// as any other message no one waits for.
+	DuplicateResponseTTL time.Duration
+
+	// OnProgress, if set, receives progress notifications from handlers, see ReportProgress.
+	// It may be called concurrently from different Execute calls.
+	OnProgress func(Progress)
+
+	// OnOutputPath, if set, is called with the request ID and the name of the output's
+	// temporary file (see Output.Filename) before the download starts, e.g. for debugging.
+	// The file is named <id>_<random>_<name>, where name is the input's base filename,
+	// and it appears once the download is complete; it is written to a .part file until then.
+	// It may be called concurrently from different Execute calls.
+	OnOutputPath func(id, filename string)
+
+	// OnMetrics, if set, receives the end-to-end duration of every request, see Metrics.
+	// It may be called concurrently from different Execute calls.
+	OnMetrics func(Metrics)
+
+	// MaxTempBytes, if set, is the budget in bytes for the client's temporary files,
+	// which includes the outputs not yet removed by the caller.
+	// Execute fails with ErrNoSpace rather than starting a download that would exceed it,
+	// or once a download exceeds the size in its object header,
+	// or, if the size is not known, once the bytes downloaded exceed it.
+	MaxTempBytes int64
+
+	// MaxTempFiles, if set, is the max number of outputs not yet removed by the caller,
+	// which guards long-lived clients against leaking them until Close.
+	// What happens when it is reached is controlled by TempFilePolicy;
+	// the default is to fail Execute with ErrTooManyTempFiles.
+	// Concurrent Execute calls may overshoot it by up to MaxInFlight.
+	// See Client.TempFileCount.
+	MaxTempFiles int
+
+	// TempFilePolicy controls what happens when MaxTempFiles is reached.
+	TempFilePolicy TempFilePolicy
+
+	// ReleaseVisibility is how long a message released by the client stays invisible
+	// before it is delivered again, e.g. a response to another client sharing the queue.
+	// The default is to make it visible again immediately (ChangeMessageVisibility with 0),
+	// so the right client gets it with the least delay.
+	// In a busy shared queue this may make the clients receive the same messages over and over,
+	// which costs SQS requests (and throughput); a short delay, e.g. a second, trades some latency for fewer requests.
+	// Only whole seconds are supported by SQS.
+	ReleaseVisibility time.Duration
+
+	// MaxInFlight, if set, is the max number of Execute calls in progress at a time,
+	// which bounds the concurrent uploads, downloads and temporary files.
+	// Further calls block until a call is done or their context is done.
+	// Zero means no limit.
+	MaxInFlight int
+
+	// KeepObjects, if set, keeps the input and output objects in the bucket for inspection,
+	// e.g. while debugging a handler, instead of deleting them once done.
+	// The server is asked to leave the input alone as well.
+	// Set up lifecycle rules to eventually clean them up.
+	KeepObjects bool
+
+	// ResponseHMACKey, if set, makes Execute reject responses not signed with this key,
+	// failing with ErrInvalidResponseSignature.
+	// The server must be configured with the same ServerOptions.ResponseHMACKey.
+	// This protects against other servers reading from a shared queue responding
+	// on behalf of this one. Progress notifications are not signed.
+	ResponseHMACKey []byte
+
+	// UploadURLExpiry is how long the URLs returned by PrepareUpload are valid.
+	// Defaults to 15 minutes.
+	UploadURLExpiry time.Duration
+
 	// Infof logs info messages.
 	Infof func(format string, args ...interface{})
 
@@ -177,17 +638,41 @@ func (opts *ClientOptions) init() error {
 		opts.Region = defaultRegion
 	}
 
-	if opts.AccessKeyID == "" {
-		return errors.New("access key id is required")
+	needsNotifier := opts.Notifier == nil && len(opts.ReplyEndpoints) == 0
+	for _, e := range opts.ReplyEndpoints {
+		if e.Notifier == nil {
+			needsNotifier = true
+		}
 	}
 
-	if opts.SecretAccessKey == "" {
-		return errors.New("secret access key is required")
+	if opts.BlobStore == nil || needsNotifier {
+		if opts.AccessKeyID == "" {
+			return errors.New("access key id is required")
+		}
+
+		if opts.SecretAccessKey == "" {
+			return errors.New("secret access key is required")
+		}
+	}
+
+	if len(opts.ReplyEndpoints) > 0 {
+		if opts.Queue != "" || opts.ReplyTo != "" || opts.Notifier != nil {
+			return errors.New("ReplyEndpoints cannot be combined with Queue, ReplyTo or Notifier")
+		}
+		return nil
 	}
 
-	if opts.Queue == "" {
+	if opts.Queue == "" && opts.Notifier == nil {
 		return fmt.Errorf("queue is required")
 	}
 
+	if opts.ReplyTo != "" {
+		replyTo, err := normalizeReplyTo(opts.ReplyTo)
+		if err != nil {
+			return err
+		}
+		opts.ReplyTo = replyTo
+	}
+
 	return nil
 }
@@ -0,0 +1,560 @@
+package s3rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/aws/smithy-go"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestExecuteInputOwnership(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+	clientBlobs := &hookBlobStore{BlobStore: blobs}
+	serverBlobs := &hookBlobStore{BlobStore: blobs}
+
+	var inputPresent bool
+	serverBlobs.onGet = func(key string) {
+		if !strings.HasPrefix(key, toServer) {
+			// E.g. the cancellation marker.
+			return
+		}
+		// Simulate a slow server picking up the input.
+		time.Sleep(200 * time.Millisecond)
+		inputPresent = blobs.has(key)
+	}
+
+	client := newTestClient(c, bus, clientBlobs, ClientOptions{})
+	newTestServer(c, bus, serverBlobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}})
+
+	output, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.IsNil)
+	b, err := os.ReadFile(output.Filename)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "FOO")
+
+	c.Assert(inputPresent, qt.IsTrue)
+	// The server deletes the input once the request is acknowledged.
+	waitFor(c, func() bool { return len(blobs.keys()) == 0 })
+	for _, key := range clientBlobs.deletedKeys() {
+		c.Assert(strings.HasPrefix(key, toServer), qt.IsFalse, qt.Commentf("client deleted input %q", key))
+	}
+	var serverDeletedInput bool
+	for _, key := range serverBlobs.deletedKeys() {
+		if strings.HasPrefix(key, toServer) {
+			serverDeletedInput = true
+		}
+	}
+	c.Assert(serverDeletedInput, qt.IsTrue)
+}
+
+func TestExecuteDeletesInputOnAbort(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	// No server.
+	client := newTestClient(c, bus, blobs, ClientOptions{Timeout: 100 * time.Millisecond})
+
+	_, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.ErrorMatches, ".*deadline exceeded")
+	c.Assert(blobs.keys(), qt.HasLen, 0)
+}
+
+func TestExecuteReceiveRetries(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+	notifier := &failingNotifier{Notifier: bus.notifier(toClient), err: errors.New("connection reset"), failures: 3}
+
+	var (
+		mu     sync.Mutex
+		logged []string
+	)
+	client := newTestClient(c, bus, blobs, ClientOptions{
+		Notifier: notifier,
+		Infof: func(format string, args ...interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			logged = append(logged, fmt.Sprintf(format, args...))
+		},
+	})
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}})
+
+	output, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.IsNil)
+	b, err := os.ReadFile(output.Filename)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "FOO")
+
+	mu.Lock()
+	defer mu.Unlock()
+	var retries int
+	for _, l := range logged {
+		if strings.HasPrefix(l, "Receive failed") {
+			retries++
+		}
+	}
+	c.Assert(retries, qt.Equals, 3)
+}
+
+func TestExecuteReceiveRetriesExhausted(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+	notifier := &failingNotifier{Notifier: bus.notifier(toClient), err: errors.New("connection reset"), failures: 100}
+
+	client := newTestClient(c, bus, blobs, ClientOptions{Notifier: notifier, MaxReceiveRetries: 2})
+
+	_, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.ErrorMatches, ".*connection reset")
+	c.Assert(notifier.receiveCalls(), qt.Equals, 3)
+}
+
+func TestExecuteReceiveFatalError(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+	notifier := &failingNotifier{Notifier: bus.notifier(toClient), err: &smithy.GenericAPIError{Code: "AccessDenied"}, failures: 100}
+
+	client := newTestClient(c, bus, blobs, ClientOptions{Notifier: notifier})
+
+	_, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.ErrorMatches, ".*AccessDenied.*")
+	c.Assert(notifier.receiveCalls(), qt.Equals, 1)
+}
+
+func TestExecuteCancelDuringUpload(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	client := newTestClient(c, bus, &slowBlobStore{BlobStore: blobs}, ClientOptions{})
+
+	// 10 MB takes about 10 seconds to upload.
+	filename := writeTestFile(c, "in.txt", strings.Repeat("a", 10<<20))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := client.Execute(ctx, "upper", Input{Filename: filename})
+	c.Assert(err, qt.ErrorMatches, ".*context deadline exceeded")
+	c.Assert(time.Since(start) < 2*time.Second, qt.IsTrue)
+	c.Assert(blobs.keys(), qt.HasLen, 0)
+}
+
+func TestExecuteCancelDuringDownload(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	client := newTestClient(c, bus, &slowBlobStore{BlobStore: blobs}, ClientOptions{})
+	started := make(chan struct{})
+	handlers := Handlers{
+		"large": func(ctx context.Context, input Input) (Output, error) {
+			close(started)
+			filename := input.Filename + ".large"
+			// 10 MB takes about 10 seconds to download.
+			return Output{Filename: filename}, os.WriteFile(filename, []byte(strings.Repeat("a", 10<<20)), 0644)
+		},
+	}
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: handlers})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		// Give the client some time to start the download.
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err := client.Execute(ctx, "large", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.ErrorMatches, ".*context canceled")
+	c.Assert(time.Since(start) < 2*time.Second, qt.IsTrue)
+
+	entries, err := os.ReadDir(client.tempDir)
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 0)
+}
+
+// truncatingBlobStore wraps a BlobStore and fails reading the response objects halfway through.
+type truncatingBlobStore struct {
+	BlobStore
+	corrupt bool
+}
+
+func (b *truncatingBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, map[string]string, error) {
+	body, metadata, err := b.BlobStore.Get(ctx, key)
+	if err != nil || !strings.HasPrefix(key, toClient+"/") {
+		return body, metadata, err
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	if b.corrupt {
+		data[0]++
+		return io.NopCloser(bytes.NewReader(data)), metadata, nil
+	}
+	return io.NopCloser(io.MultiReader(bytes.NewReader(data[:len(data)/2]), iotest.ErrReader(errors.New("connection reset")))), metadata, nil
+}
+
+func TestExecuteDownloadInterrupted(t *testing.T) {
+	c := qt.New(t)
+
+	for _, corrupt := range []bool{false, true} {
+		c.Run(fmt.Sprintf("corrupt=%t", corrupt), func(c *qt.C) {
+			bus := newMemBus()
+			blobs := newMemBlobStore()
+
+			client := newTestClient(c, bus, &truncatingBlobStore{BlobStore: blobs, corrupt: corrupt}, ClientOptions{})
+			newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}})
+
+			_, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+			if corrupt {
+				c.Assert(err, qt.ErrorMatches, "apply: checksum mismatch.*")
+			} else {
+				c.Assert(err, qt.ErrorMatches, "apply: connection reset")
+			}
+
+			// No partial output is left behind.
+			entries, err := os.ReadDir(client.tempDir)
+			c.Assert(err, qt.IsNil)
+			c.Assert(entries, qt.HasLen, 0)
+		})
+	}
+}
+
+func TestExecuteDownloadRenamed(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	client := newTestClient(c, bus, blobs, ClientOptions{})
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}})
+
+	output, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.IsNil)
+	c.Assert(strings.HasSuffix(output.Filename, partSuffix), qt.IsFalse)
+	entries, err := os.ReadDir(client.tempDir)
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 1)
+	c.Assert(filepath.Join(client.tempDir, entries[0].Name()), qt.Equals, output.Filename)
+}
+
+func TestExecuteOutputPath(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	var gotID, gotPath string
+	onOutputPath := func(id, filename string) {
+		gotID, gotPath = id, filename
+		// The download has not completed yet.
+		_, err := os.Stat(filename)
+		c.Check(os.IsNotExist(err), qt.IsTrue)
+	}
+	client := newTestClient(c, bus, blobs, ClientOptions{OnOutputPath: onOutputPath})
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}})
+
+	output, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.IsNil)
+	c.Assert(gotID, qt.Equals, output.ID)
+	c.Assert(gotPath, qt.Equals, output.Filename)
+	c.Assert(filepath.Base(output.Filename), qt.Matches, output.ID+`_\d+_in\.txt`)
+}
+
+func TestExecuteKeepObjects(t *testing.T) {
+	for name, semantics := range map[string]DeliverySemantics{"AtLeastOnce": AtLeastOnce, "AtMostOnce": AtMostOnce} {
+		semantics := semantics
+		t.Run(name, func(t *testing.T) {
+			c := qt.New(t)
+
+			bus := newMemBus()
+			blobs := newMemBlobStore()
+
+			client := newTestClient(c, bus, blobs, ClientOptions{KeepObjects: true})
+			newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}, DeliverySemantics: semantics})
+
+			_, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+			c.Assert(err, qt.IsNil)
+
+			// Wait for the server to finish up.
+			waitFor(c, func() bool { return bus.queue(toServer).len() == 0 })
+			time.Sleep(20 * time.Millisecond)
+
+			keys := blobs.keys()
+			c.Assert(keys, qt.HasLen, 2)
+			c.Assert(strings.HasPrefix(keys[0], toClient+"/"), qt.IsTrue)
+			c.Assert(strings.HasPrefix(keys[1], toServer+"/"), qt.IsTrue)
+		})
+	}
+}
+
+// hangingBlobStore wraps a BlobStore and never completes a Put.
+type hangingBlobStore struct {
+	BlobStore
+}
+
+func (b *hangingBlobStore) Put(ctx context.Context, key string, body io.Reader, metadata map[string]string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestExecuteUploadTimeout(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	client := newTestClient(c, bus, &hangingBlobStore{BlobStore: blobs}, ClientOptions{UploadTimeout: 50 * time.Millisecond, Timeout: time.Minute})
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}})
+
+	start := time.Now()
+	_, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.ErrorMatches, "apply: upload: context deadline exceeded")
+	c.Assert(time.Since(start) < time.Second, qt.IsTrue)
+	c.Assert(bus.queue(toServer).len(), qt.Equals, 0)
+}
+
+func TestExecuteUploadTimeoutSlowServer(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	handlers := Handlers{
+		"slow": func(ctx context.Context, input Input) (Output, error) {
+			time.Sleep(200 * time.Millisecond)
+			return upperHandler(ctx, input)
+		},
+	}
+	client := newTestClient(c, bus, blobs, ClientOptions{UploadTimeout: 50 * time.Millisecond, Timeout: time.Minute})
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: handlers})
+
+	_, err := client.Execute(context.Background(), "slow", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.IsNil)
+}
+
+func TestCloseCancelsExecute(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	client := newTestClient(c, bus, blobs, ClientOptions{Timeout: time.Minute})
+	// No server, so Execute blocks waiting for a response.
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+		errc <- err
+	}()
+	waitFor(c, func() bool { return client.dispatcher.numWaiters() == 1 })
+
+	c.Assert(client.Close(), qt.IsNil)
+	err := <-errc
+	c.Assert(errors.Is(err, ErrClientClosed), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, "apply: client closed")
+
+	// The input was cleaned up.
+	c.Assert(blobs.keys(), qt.HasLen, 0)
+
+	_, err = client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(errors.Is(err, ErrClientClosed), qt.IsTrue)
+
+	c.Assert(client.Close(), qt.IsNil)
+}
+
+func TestExecuteNoTimeout(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	client := newTestClient(c, bus, blobs, ClientOptions{})
+	// newTestClient sets a default timeout.
+	client.timeout = 0
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+	handlers := Handlers{
+		"stuck": func(ctx context.Context, input Input) (Output, error) {
+			<-unblock
+			return upperHandler(ctx, input)
+		},
+	}
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: handlers})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := client.Execute(ctx, "stuck", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.ErrorMatches, "apply: context canceled")
+	c.Assert(time.Since(start) >= 100*time.Millisecond, qt.IsTrue)
+}
+
+func TestExecuteInstantResponse(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	// Send does not return until the server has responded and the response
+	// had the chance to be routed.
+	notifier := &instantResponseNotifier{Notifier: bus.notifier(toClient), blobs: blobs, c: c}
+	client := newTestClient(c, bus, blobs, ClientOptions{Notifier: notifier})
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}})
+
+	// Keep the poller running, as with concurrent Execute calls.
+	_, unregister := client.dispatcher.register("other")
+	defer unregister()
+
+	output, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.IsNil)
+	b, err := os.ReadFile(output.Filename)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "FOO")
+	c.Assert(notifier.numNacks(), qt.Equals, 0)
+}
+
+// instantResponseNotifier is a client Notifier that simulates a server responding
+// before Send returns.
+type instantResponseNotifier struct {
+	Notifier
+	blobs *memBlobStore
+	c     *qt.C
+
+	mu    sync.Mutex
+	nacks int
+}
+
+func (n *instantResponseNotifier) Send(ctx context.Context, note Note) error {
+	if err := n.Notifier.Send(ctx, note); err != nil {
+		return err
+	}
+	waitFor(n.c, func() bool {
+		for _, key := range n.blobs.keys() {
+			if strings.HasPrefix(key, toClient+"/") {
+				return true
+			}
+		}
+		return false
+	})
+	time.Sleep(200 * time.Millisecond)
+	return nil
+}
+
+func (n *instantResponseNotifier) Nack(ctx context.Context, note Note) error {
+	n.mu.Lock()
+	n.nacks++
+	n.mu.Unlock()
+	return n.Notifier.Nack(ctx, note)
+}
+
+func (n *instantResponseNotifier) numNacks() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.nacks
+}
+
+func TestExecuteMaxInFlight(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	var (
+		mu                  sync.Mutex
+		handling, maxHandle int
+	)
+	handlers := Handlers{
+		"upper": func(ctx context.Context, input Input) (Output, error) {
+			mu.Lock()
+			handling++
+			if handling > maxHandle {
+				maxHandle = handling
+			}
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			handling--
+			mu.Unlock()
+			return upperHandler(ctx, input)
+		},
+	}
+
+	client := newTestClient(c, bus, blobs, ClientOptions{MaxInFlight: 2})
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: handlers, DefaultOpConfig: OpConfig{Concurrency: 10}})
+
+	stop := make(chan struct{})
+	maxInFlight := make(chan int)
+	go func() {
+		var max int
+		for {
+			select {
+			case <-stop:
+				maxInFlight <- max
+				return
+			default:
+			}
+			if n := client.InFlight(); n > max {
+				max = n
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			output, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, fmt.Sprintf("in%d.txt", i), "foo")})
+			c.Check(err, qt.IsNil)
+			c.Check(output.Filename, qt.Not(qt.Equals), "")
+		}(i)
+	}
+	wg.Wait()
+	close(stop)
+
+	c.Assert(<-maxInFlight <= 2, qt.IsTrue)
+	c.Assert(maxHandle <= 2, qt.IsTrue)
+	c.Assert(client.InFlight(), qt.Equals, 0)
+
+	// A call waiting for a slot respects its context.
+	release, err := client.acquire(context.Background())
+	c.Assert(err, qt.IsNil)
+	defer release()
+	release2, err := client.acquire(context.Background())
+	c.Assert(err, qt.IsNil)
+	defer release2()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = client.Execute(ctx, "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.ErrorMatches, "apply: context deadline exceeded")
+}
@@ -0,0 +1,16 @@
+// Command s3rpc executes s3rpc ops from the command line, see package cli.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/bep/s3rpc/cli"
+)
+
+func main() {
+	if err := cli.Run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "s3rpc:", err)
+		os.Exit(1)
+	}
+}
@@ -2,18 +2,19 @@ package s3rpc
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
+	"path"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-
-	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/smithy-go"
 )
 
 const (
@@ -25,122 +26,328 @@ const (
 	// This gives us some time to determine if this is "our" message.
 	// If so, we will delete it so that it is not processed again.
 	visibilitySeconds = 7
+
+	// How often to extend the visibility of a message being processed.
+	heartbeatInterval = visibilitySeconds * time.Second / 2
+
+	// The default number of consecutive failing receives tolerated before giving up.
+	defaultMaxReceiveRetries = 5
+
+	// The default validity of the URLs returned by Client.PrepareUpload.
+	defaultUploadURLExpiry = 15 * time.Minute
+
+	// The default time the client remembers the IDs of consumed responses.
+	defaultDuplicateResponseTTL = 15 * time.Minute
+
+	// The default cap of the server's poll interval, in multiples of the poll interval.
+	defaultMaxPollIntervalFactor = 4
+
+	// How long NewClient and NewServer wait for the bucket's region, see AWSConfig.AutoResolveRegion.
+	regionLookupTimeout = 30 * time.Second
+)
+
+// Object metadata keys used by s3rpc itself.
+// These are never exposed in Input.Metadata or Output.Metadata.
+const (
+	metaPrefix = "s3rpc-"
+
+	// metaKind marks side objects, e.g. progress notifications.
+	metaKind = metaPrefix + "kind"
+
+	// metaWantProgress is set by the client if it wants progress notifications.
+	metaWantProgress = metaPrefix + "progress"
+
+	// metaRef is set on a response without a body.
+	// The output is then stored in the object with this key, which is not owned by the client
+	// unless metaRefOwned is set.
+	metaRef = metaPrefix + "ref"
+
+	// metaRefOwned is set on a metaRef response if the client should delete the object once read.
+	metaRefOwned = metaPrefix + "ref-owned"
+
+	// metaReplyTo is the queue the client wants the responses sent to, see ClientOptions.ReplyTo.
+	metaReplyTo = metaPrefix + "reply-to"
+
+	// metaReplyToFallback are the queues, comma separated, to send the responses to
+	// if sending to metaReplyTo fails, see ClientOptions.ReplyEndpoints.
+	metaReplyToFallback = metaPrefix + "reply-to-fallback"
+
+	// metaHeader is the object header describing the content, see objectHeader.
+	metaHeader = metaPrefix + "meta"
+
+	// metaSHA256 is the hex encoded SHA-256 checksum of the object.
+	// It is only read from objects written before metaHeader was introduced.
+	metaSHA256 = metaPrefix + "sha256"
+
+	// metaKeep is set by the client if the server should not delete the input, see ClientOptions.KeepObjects.
+	metaKeep = metaPrefix + "keep"
+
+	// metaSize is the size of the object in bytes.
+	// It is only read from objects written before metaHeader was introduced.
+	metaSize = metaPrefix + "size"
+
+	// metaExpires is the expiry time (RFC 3339) of a cached result.
+	metaExpires = metaPrefix + "expires"
+
+	// metaSignature is the response signature, see ClientOptions.ResponseHMACKey.
+	metaSignature = metaPrefix + "signature"
+
+	// metaAttributes are the JSON encoded request attributes, see Input.Attributes.
+	metaAttributes = metaPrefix + "attributes"
+
+	// metaSubmittedAt is the time (RFC 3339) the client submitted the request, see ServerOptions.MaxRequestAge.
+	metaSubmittedAt = metaPrefix + "submitted-at"
+
+	// metaDeadline is the time (RFC 3339) the client gives up waiting for the response, if known.
+	metaDeadline = metaPrefix + "deadline"
 )
 
+// splitMetadata splits the object metadata m into user and s3rpc metadata.
+// The user metadata is decoded, see encodeMetadata.
+func splitMetadata(m map[string]string) (user, internal map[string]string) {
+	for k, v := range m {
+		if strings.HasPrefix(k, metaPrefix) {
+			if internal == nil {
+				internal = make(map[string]string)
+			}
+			internal[k] = v
+			continue
+		}
+		if user == nil {
+			user = make(map[string]string)
+		}
+		user[k] = v
+	}
+	return decodeMetadata(user, internal), internal
+}
+
+// mergeMetadata merges the user and s3rpc metadata into a new map.
+func mergeMetadata(user, internal map[string]string) map[string]string {
+	if len(internal) == 0 {
+		return user
+	}
+	m := make(map[string]string, len(user)+len(internal))
+	for k, v := range user {
+		m[k] = v
+	}
+	for k, v := range internal {
+		m[k] = v
+	}
+	return m
+}
+
 type AWSConfig struct {
 	Region          string
 	Bucket          string
 	AccessKeyID     string
 	SecretAccessKey string
+
+	// KeyTemplate is the object key layout below the to_server/to_client prefixes.
+	// The supported placeholders are {op}, {id}, {name} (the input's base filename)
+	// and {date} (YYYY-MM-DD in UTC, e.g. for lifecycle rules).
+	// {id} is required (and {op} on a server without ServerOptions.ResolveOp),
+	// and client and server must use the same template.
+	// Defaults to DefaultKeyTemplate.
+	KeyTemplate string
+
+	// AutoResolveRegion controls what happens when the bucket or queue lives in another
+	// region than Region.
+	// If set, the bucket's or queue's region is used.
+	// The queue's region is inferred from its URL, and if not set, NewClient and NewServer fail
+	// with an error naming both regions when it differs.
+	// The bucket's region is only looked up if set: NewClient and NewServer then call GetBucketLocation,
+	// which blocks for up to 30 seconds and cannot be cancelled; without it, requests to a bucket
+	// in another region fail when the bucket is first used.
+	AutoResolveRegion bool
+
+	// ObjectACL, if set, is the canned ACL the objects are stored with, e.g. bucket-owner-full-control.
+	// This is needed in cross-account setups where the bucket owner must be able to read
+	// objects written by identities from another account, unless the bucket's Object Ownership is
+	// BucketOwnerEnforced, which NewProvisioner sets up.
+	// Note that with BucketOwnerEnforced only bucket-owner-full-control is accepted, and that
+	// storing objects with an ACL requires s3:PutObjectAcl, which the policies created by NewProvisioner
+	// grant alongside s3:PutObject.
+	// Not used if BlobStore is set, see NewS3BlobStoreWithACL.
+	ObjectACL string
+
+	// TransferConcurrency is the number of parts uploaded in parallel in a multipart upload.
+	// Defaults to 5.
+	//
+	// An upload of a body that is not an io.ReaderAt and io.Seeker buffers up to
+	// (TransferConcurrency + 1) × PartSize bytes, so N such uploads in parallel
+	// use up to N × (TransferConcurrency + 1) × PartSize bytes.
+	// The buffers are pooled and reused across the concurrent uploads of a client or server.
+	// Files and in-memory content, which is what s3rpc uploads, are read in place without these buffers,
+	// and downloads are streamed, so this mainly matters for custom uploads, and on Windows,
+	// where files are read through a 1 MiB buffer per part in flight.
+	// Not used if BlobStore is set.
+	TransferConcurrency int
+
+	// PartSize is the size in bytes of the parts of a multipart upload; larger objects are uploaded
+	// in parts. It must be at least 5 MiB, which is the default. See TransferConcurrency.
+	// Not used if BlobStore is set.
+	PartSize int64
 }
 
 type common struct {
 	tempDir string
 
 	bucket string
-	queue  string
+	keys   *keyLayout
+
+	blobs    BlobStore
+	notifier Notifier
 
-	s3Client  *s3.Client
-	sqsClient *sqs.Client
+	// receivers are the notifiers to receive from, highest priority first.
+	// If not set, notifier is used.
+	receivers []Notifier
 
 	closeOnce sync.Once
 
+	// releaseVisibility is how long a released message stays invisible, see ClientOptions.ReleaseVisibility.
+	releaseVisibility time.Duration
+
+	// hmacKey is the key responses are signed with, see ClientOptions.ResponseHMACKey.
+	hmacKey []byte
+
+	// resolveOp, if set, resolves the op of requests, see ServerOptions.ResolveOp.
+	resolveOp func(m Message) (string, bool)
+
 	infof func(format string, args ...interface{})
 }
 
-func (c *common) Receive(ctx context.Context) ([]message, error) {
-	result, err := c.sqsClient.ReceiveMessage(ctx,
-		&sqs.ReceiveMessageInput{
-			QueueUrl:            aws.String(c.queue),
-			MaxNumberOfMessages: 5,
-			VisibilityTimeout:   visibilitySeconds,
-			// Wait for 20 seconds for a message to arrive.
-			WaitTimeSeconds: 20,
-		},
-	)
+func (c *common) deleteObject(ctx context.Context, key string) error {
+	//c.infof("Delete %s/%s", c.bucket, key)
+	return c.blobs.Delete(ctx, key)
+}
 
+// getObject downloads key into f and returns its user and s3rpc metadata.
+// The metadata is also returned if the object header is not supported, see ErrUnsupportedProtocol.
+func (c *common) getObject(ctx context.Context, f *os.File, key string) (map[string]string, map[string]string, error) {
+	body, metaData, err := c.openObject(ctx, key)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	defer body.Close()
+	user, internal := splitMetadata(metaData)
+	h, err := readHeader(internal)
+	if err != nil {
+		return user, internal, err
+	}
+	if err := copyVerified(ctx, f, body, h.Checksum); err != nil {
+		return nil, nil, noSpaceErr(err)
 	}
+	return user, internal, nil
+}
 
-	var messages []message
-	for _, m := range result.Messages {
-		var messageBody messageBody
-		err := json.Unmarshal([]byte(*m.Body), &messageBody)
-		if err != nil {
-			return nil, err
-		}
-		if len(messageBody.Records) == 0 {
-			continue
-		}
-		if len(messageBody.Records) > 1 {
-			return nil, fmt.Errorf("expected only one record, got %d", len(messageBody.Records))
-		}
+func (c *common) openObject(ctx context.Context, key string) (io.ReadCloser, map[string]string, error) {
+	c.infof("Downloading %s/%s", c.bucket, key)
+	return c.blobs.Get(ctx, key)
+}
 
-		s3 := messageBody.Records[0].S3
-		messages = append(messages, message{Bucket: s3.Bucket.Name, Key: s3.Object.Key, ReceiptHandle: *m.ReceiptHandle})
+// statObject returns the metadata of the object stored below key, see Stater.
+func (c *common) statObject(ctx context.Context, key string) (map[string]string, error) {
+	if s, ok := c.blobs.(Stater); ok {
+		return s.Stat(ctx, key)
+	}
+	body, metaData, err := c.blobs.Get(ctx, key)
+	if err != nil {
+		return nil, err
 	}
+	body.Close()
+	return metaData, nil
+}
 
-	return messages, nil
+// downloadTemp downloads body into a new temporary file and returns its name.
+// The download goes to a .part file which is renamed (in the same directory) once
+// the download is complete and verified against checksum (if set),
+// so a file with the returned name is never partially written.
+// The .part file is removed if the download fails, e.g. because ctx is cancelled.
+// If set, onPath is called with the name before the download starts.
+func (c *common) downloadTemp(ctx context.Context, body io.Reader, pattern, checksum string, onPath func(filename string)) (string, error) {
+	f, err := os.CreateTemp(c.tempDir, pattern+partSuffix)
+	if err != nil {
+		return "", noSpaceErr(fmt.Errorf("tempfile: %w", err))
+	}
+	filename := strings.TrimSuffix(f.Name(), partSuffix)
+	if onPath != nil {
+		onPath(filename)
+	}
+	err = copyVerified(ctx, f, body, checksum)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", noSpaceErr(err)
+	}
+	return filename, nil
 }
 
-func (c *common) deleteMessage(ctx context.Context, receiptHandle string) error {
-	//c.infof("Delete message from %q", c.queue)
-	_, err := c.sqsClient.DeleteMessage(
-		ctx,
-		&sqs.DeleteMessageInput{
-			QueueUrl:      aws.String(c.queue),
-			ReceiptHandle: aws.String(receiptHandle),
-		},
-	)
-	return err
+// partSuffix is the suffix of files being downloaded.
+const partSuffix = ".part"
 
+// tempPattern returns the os.CreateTemp pattern for a file downloaded for m,
+// i.e. <id>_<random>_<name>, so files on disk can be mapped to requests.
+func tempPattern(m Message) string {
+	name := m.parts.name
+	if name == "" {
+		name = path.Base(m.Key)
+	}
+	return m.ID + "_*_" + name
 }
 
-func (c *common) deleteObject(ctx context.Context, key string) error {
-	//c.infof("Delete %s/%s", c.bucket, key)
-	_, err := c.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
-		Bucket: aws.String(c.bucket),
-		Key:    aws.String(key),
-	})
-	return err
+// copyVerified copies body to w and verifies the content against the hex encoded SHA-256 checksum,
+// if set.
+func copyVerified(ctx context.Context, w io.Writer, body io.Reader, checksum string) error {
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, h), &contextReader{ctx: ctx, r: body}); err != nil {
+		return err
+	}
+	if checksum == "" {
+		return nil
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != checksum {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", checksum, got)
+	}
+	return nil
 }
 
-func (c *common) getObject(ctx context.Context, f *os.File, key string) (map[string]string, error) {
-	c.infof("Downloading %s/%s", c.bucket, key)
-	o, err := c.s3Client.GetObject(
-		ctx,
-		&s3.GetObjectInput{
-			Bucket: aws.String(c.bucket),
-			Key:    aws.String(key),
-		},
-	)
+// fileChecksum returns the hex encoded SHA-256 checksum and the size of the file.
+func fileChecksum(filename string) (string, int64, error) {
+	f, err := os.Open(filename)
 	if err != nil {
-		return nil, err
+		return "", 0, err
 	}
-	defer o.Body.Close()
-	_, err = io.Copy(f, o.Body)
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
 	if err != nil {
-		return nil, err
+		return "", 0, err
 	}
-	return o.Metadata, nil
-
+	return hex.EncodeToString(h.Sum(nil)), size, nil
 }
 
-func (c *common) releaseMessage(ctx context.Context, receiptHandle string) error {
-	//c.infof("Release message from %q", c.queue)
-	_, err := c.sqsClient.ChangeMessageVisibility(
-		ctx,
-		&sqs.ChangeMessageVisibilityInput{
-			QueueUrl:          aws.String(c.queue),
-			ReceiptHandle:     aws.String(receiptHandle),
-			VisibilityTimeout: 0,
-		},
-	)
-	return err
-}
+// upload uploads filename to key with the given user and s3rpc metadata.
+// The object header is created from the file unless set in internal.
+func (c *common) upload(ctx context.Context, filename, key string, user, internal map[string]string) error {
+	user, keys, err := encodeMetadata(user)
+	if err != nil {
+		return err
+	}
+	internal = mergeMetadata(internal, keys)
+	if internal[metaHeader] == "" {
+		h, err := fileHeader(filename)
+		if err != nil {
+			return err
+		}
+		internal = mergeMetadata(internal, h.metadata())
+	}
+	metaData := mergeMetadata(user, internal)
 
-func (c *common) upload(filename, key string, metaData map[string]string) error {
 	file, err := os.Open(filename)
 	if err != nil {
 		return err
@@ -149,28 +356,100 @@ func (c *common) upload(filename, key string, metaData map[string]string) error
 
 	c.infof("Uploading %s to %s/%s", filename, c.bucket, key)
 
-	metaDatap := make(map[string]*string)
-	for k, v := range metaData {
-		metaDatap[k] = aws.String(v)
+	if err := c.blobs.Put(ctx, key, &contextFile{ctx: ctx, File: file}, metaData); err != nil {
+		return fmt.Errorf("upload: %w", err)
 	}
+	return nil
+}
 
-	_, err = manager.NewUploader(c.s3Client).Upload(context.TODO(), &s3.PutObjectInput{
-		Bucket:   aws.String(c.bucket),
-		Key:      aws.String(key),
-		Body:     file,
-		Metadata: metaData,
-	})
+// contextReader is an io.Reader that stops reading when ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
 
-	if err != nil {
-		return fmt.Errorf("upload: %v", err)
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
 	}
-	return nil
+	return r.r.Read(p)
+}
+
+// contextFile is a file that stops reading when ctx is done.
+// It implements io.ReaderAt and io.Seeker, which allows the S3 upload manager
+// to read the parts concurrently.
+type contextFile struct {
+	ctx context.Context
+	*os.File
 }
 
-type message struct {
-	Bucket        string
-	Key           string
-	ReceiptHandle string
+func (f *contextFile) Read(p []byte) (int, error) {
+	if err := f.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func (f *contextFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+// isFatalError reports whether err is an error that will not go away by retrying.
+func isFatalError(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "AccessDenied", "AccessDeniedException", "AWS.SimpleQueueService.NonExistentQueue", "QueueDoesNotExist", "NoSuchBucket":
+		return true
+	}
+	return false
+}
+
+// backoff is a capped exponential backoff.
+type backoff struct {
+	min, max time.Duration
+	attempt  int
+}
+
+// next returns the duration to wait before the next attempt.
+func (b *backoff) next() time.Duration {
+	d := b.min << b.attempt
+	if d > b.max || d <= 0 {
+		d = b.max
+	} else {
+		b.attempt++
+	}
+	return d
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// jitter returns a random duration between d/2 and 3d/2, d on average.
+func jitter(rnd *rand.Rand, d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	half := d / 2
+	return half + time.Duration(rnd.Int63n(int64(d)+1))
+}
+
+// sleep sleeps for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
 }
 
 type messageBody struct {
@@ -0,0 +1,68 @@
+package s3rpc
+
+import (
+	"context"
+	"os"
+)
+
+// requestInfo is the request scoped information stored in a handler context.
+type requestInfo struct {
+	op       string
+	id       string
+	metadata map[string]string
+
+	// tempFiles are removed once the request is done, see removeTempFiles.
+	tempFiles []string
+}
+
+// removeTempFiles removes the temporary files created for the request.
+func (info *requestInfo) removeTempFiles() {
+	for _, filename := range info.tempFiles {
+		_ = os.Remove(filename)
+	}
+}
+
+type requestInfoKey struct{}
+
+func withRequestInfo(ctx context.Context, info *requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// OpFromContext returns the op of the request handled with ctx.
+// It returns an empty string if ctx is not a handler context.
+func OpFromContext(ctx context.Context) string {
+	if info := requestInfoFromContext(ctx); info != nil {
+		return info.op
+	}
+	return ""
+}
+
+// RequestIDFromContext returns the ID of the request handled with ctx.
+// This is the same ID as in the object keys and in Progress.ID.
+// It returns an empty string if ctx is not a handler context.
+func RequestIDFromContext(ctx context.Context) string {
+	if info := requestInfoFromContext(ctx); info != nil {
+		return info.id
+	}
+	return ""
+}
+
+// MetadataFromContext returns a copy of the user metadata of the request handled with ctx,
+// i.e. the same as Input.Metadata.
+// It returns nil if ctx is not a handler context.
+func MetadataFromContext(ctx context.Context) map[string]string {
+	info := requestInfoFromContext(ctx)
+	if info == nil || info.metadata == nil {
+		return nil
+	}
+	m := make(map[string]string, len(info.metadata))
+	for k, v := range info.metadata {
+		m[k] = v
+	}
+	return m
+}
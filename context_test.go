@@ -0,0 +1,58 @@
+package s3rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestHandlerContext(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	var (
+		op, id      string
+		metadata    map[string]string
+		deadline    time.Time
+		hasDeadline bool
+	)
+
+	client := newTestClient(c, bus, blobs, ClientOptions{})
+	handlers := Handlers{
+		"upper": func(ctx context.Context, input Input) (Output, error) {
+			op = OpFromContext(ctx)
+			id = RequestIDFromContext(ctx)
+			metadata = MetadataFromContext(ctx)
+			deadline, hasDeadline = ctx.Deadline()
+			return upperHandler(ctx, input)
+		},
+	}
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: handlers, HandlerTimeout: time.Minute})
+
+	start := time.Now()
+	_, err := client.Execute(context.Background(), "upper", Input{
+		Filename: writeTestFile(c, "in.txt", "foo"),
+		Metadata: map[string]string{"tenant": "acme"},
+	})
+	c.Assert(err, qt.IsNil)
+
+	c.Assert(op, qt.Equals, "upper")
+	c.Assert(id, qt.HasLen, 26)
+	c.Assert(metadata, qt.DeepEquals, map[string]string{"tenant": "acme"})
+	c.Assert(hasDeadline, qt.IsTrue)
+	c.Assert(deadline.After(start.Add(50*time.Second)), qt.IsTrue)
+	c.Assert(deadline.Before(start.Add(2*time.Minute)), qt.IsTrue)
+}
+
+func TestHandlerContextNotHandler(t *testing.T) {
+	c := qt.New(t)
+
+	ctx := context.Background()
+	c.Assert(OpFromContext(ctx), qt.Equals, "")
+	c.Assert(RequestIDFromContext(ctx), qt.Equals, "")
+	c.Assert(MetadataFromContext(ctx), qt.IsNil)
+}
@@ -0,0 +1,262 @@
+package s3rpc
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// dispatcher owns the single poller of a client and routes the received
+// messages to the Execute calls waiting for them, keyed by request ID.
+type dispatcher struct {
+	c *Client
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	running bool
+	done    chan struct{}
+	waiters map[string]*waiter
+
+	// consumed maps the IDs of the responses consumed to when they are forgotten,
+	// see markConsumed. consumedOrder holds the same IDs, oldest first.
+	consumed      map[string]time.Time
+	consumedOrder []string
+}
+
+// waiter is a registration for a request ID.
+type waiter struct {
+	messages chan Message
+
+	// failed is closed when the poller gave up, err is then set.
+	failed chan struct{}
+	err    error
+}
+
+func newDispatcher(c *Client) *dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &dispatcher{
+		c:        c,
+		ctx:      ctx,
+		cancel:   cancel,
+		waiters:  make(map[string]*waiter),
+		consumed: make(map[string]time.Time),
+	}
+}
+
+// register registers id and starts the poller if needed.
+// The returned func must be called to remove the registration.
+func (d *dispatcher) register(id string) (*waiter, func()) {
+	w := &waiter{
+		messages: make(chan Message, 16),
+		failed:   make(chan struct{}),
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.waiters[id] = w
+	if !d.running && d.ctx.Err() == nil {
+		d.running = true
+		d.done = make(chan struct{})
+		go d.poll()
+	}
+
+	return w, func() {
+		d.mu.Lock()
+		if d.waiters[id] == w {
+			delete(d.waiters, id)
+		}
+		d.mu.Unlock()
+
+		// Release anything routed to us that we didn't consume.
+		for {
+			select {
+			case m := <-w.messages:
+				if d.isConsumed(id) {
+					d.discard(d.ctx, m)
+				} else {
+					_ = d.c.ReleaseMessage(d.ctx, m)
+				}
+			default:
+				return
+			}
+		}
+	}
+}
+
+// waiting reports whether id is registered.
+func (d *dispatcher) waiting(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.waiters[id] != nil
+}
+
+// numWaiters returns the number of registered request IDs.
+func (d *dispatcher) numWaiters() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.waiters)
+}
+
+// stop stops the poller and waits for it to exit.
+func (d *dispatcher) stop() {
+	d.cancel()
+	d.mu.Lock()
+	running, done := d.running, d.done
+	d.mu.Unlock()
+	if running {
+		<-done
+	}
+}
+
+func (d *dispatcher) poll() {
+	var err error
+	defer func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if err != nil && d.ctx.Err() == nil {
+			// Fail everyone currently waiting.
+			// The next registration will start a new poller.
+			for id, w := range d.waiters {
+				w.err = err
+				close(w.failed)
+				delete(d.waiters, id)
+			}
+		}
+		d.running = false
+		close(d.done)
+	}()
+
+	var (
+		ctx      = d.ctx
+		c        = d.c
+		failures int
+		// failovers is the number of reply endpoints failed over from in a row.
+		failovers int
+		bo        = backoff{min: 100 * time.Millisecond, max: 5 * time.Second}
+	)
+
+	for ctx.Err() == nil {
+		var ms []Message
+		ms, err = c.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			failures++
+			if isFatalError(err) || failures > c.maxReceiveRetries {
+				// Give up once every reply endpoint has failed in a row.
+				if failovers == len(c.endpoints)-1 || !c.failover(err) {
+					return
+				}
+				failovers++
+				failures = 0
+				bo.reset()
+				continue
+			}
+			dur := bo.next()
+			c.infof("Receive failed (%d/%d), retrying in %s: %s", failures, c.maxReceiveRetries, dur, err)
+			if sleep(ctx, dur) != nil {
+				err = nil
+				return
+			}
+			continue
+		}
+		failures = 0
+		failovers = 0
+		bo.reset()
+
+		for _, m := range ms {
+			d.route(ctx, m)
+		}
+	}
+	err = nil
+}
+
+// route passes m on to its waiter, if any, or releases it.
+func (d *dispatcher) route(ctx context.Context, m Message) {
+	c := d.c
+	if err := m.Err(); err != nil {
+		c.infof("Releasing message: %s", err)
+		_ = c.ReleaseMessage(ctx, m)
+		return
+	}
+
+	d.mu.Lock()
+	w := d.waiters[m.ID]
+	delivered := false
+	if w != nil {
+		select {
+		case w.messages <- m:
+			delivered = true
+		default:
+			// The waiter is busy; try again later.
+		}
+	}
+	duplicate := w == nil && d.isConsumedLocked(m.ID, time.Now())
+	d.mu.Unlock()
+	if delivered {
+		return
+	}
+	if duplicate {
+		d.discard(ctx, m)
+		return
+	}
+
+	// Not ours (may belong to another client sharing the queue).
+	_ = c.ReleaseMessage(ctx, m)
+}
+
+// markConsumed records that the response to the request with the given id is consumed,
+// so any duplicates of it are discarded for DuplicateResponseTTL, see ClientOptions.DuplicateResponseTTL.
+func (d *dispatcher) markConsumed(id string) {
+	if d.c.duplicateTTL <= 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	d.pruneConsumedLocked(now)
+	if _, found := d.consumed[id]; !found {
+		d.consumedOrder = append(d.consumedOrder, id)
+	}
+	d.consumed[id] = now.Add(d.c.duplicateTTL)
+}
+
+func (d *dispatcher) isConsumed(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.isConsumedLocked(id, time.Now())
+}
+
+// isConsumedLocked reports whether the response to the request with the given id is consumed.
+// d.mu must be held.
+func (d *dispatcher) isConsumedLocked(id string, now time.Time) bool {
+	forget, found := d.consumed[id]
+	return found && now.Before(forget)
+}
+
+// pruneConsumedLocked forgets the consumed IDs past their TTL.
+// They expire in the order they were consumed, as the TTL is fixed.
+// d.mu must be held.
+func (d *dispatcher) pruneConsumedLocked(now time.Time) {
+	for len(d.consumedOrder) > 0 {
+		id := d.consumedOrder[0]
+		if now.Before(d.consumed[id]) {
+			return
+		}
+		delete(d.consumed, id)
+		d.consumedOrder = d.consumedOrder[1:]
+	}
+}
+
+// discard deletes m, a duplicate of a consumed response, and cleans up its object.
+func (d *dispatcher) discard(ctx context.Context, m Message) {
+	d.c.infof("Discarding duplicate response %q", m.Key)
+	if err := d.c.DeleteMessage(ctx, m); err != nil {
+		d.c.infof("Failed to delete duplicate response %q: %s", m.Key, err)
+		return
+	}
+	d.c.cleanup(ctx, m.Key)
+}
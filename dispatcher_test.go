@@ -0,0 +1,140 @@
+package s3rpc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestDispatcherSinglePoller(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+	notifier := &countingNotifier{Notifier: bus.notifier(toClient)}
+
+	client := newTestClient(c, bus, blobs, ClientOptions{Notifier: notifier})
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}})
+
+	c.Assert(executeConcurrently(c, client, 100), qt.IsNil)
+	c.Assert(notifier.maxReceivers(), qt.Equals, 1)
+	c.Assert(client.dispatcher.numWaiters(), qt.Equals, 0)
+}
+
+func TestDispatcherUnregisterOnTimeout(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	client := newTestClient(c, bus, blobs, ClientOptions{Timeout: 50 * time.Millisecond})
+
+	_, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.ErrorMatches, ".*deadline exceeded")
+	c.Assert(client.dispatcher.numWaiters(), qt.Equals, 0)
+}
+
+func TestDispatcherDuplicateResponse(t *testing.T) {
+	c := qt.New(t)
+
+	execute := func(c *qt.C, opts ClientOptions) (*memBus, *memBlobStore, *duplicatingNotifier) {
+		bus := newMemBus()
+		blobs := newMemBlobStore()
+		notifier := &duplicatingNotifier{Notifier: bus.notifier(toServer)}
+		client := newTestClient(c, bus, blobs, opts)
+		newTestServer(c, bus, blobs, ServerOptions{Notifier: notifier, Handlers: Handlers{"upper": upperHandler}})
+
+		output, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+		c.Assert(err, qt.IsNil)
+		c.Assert(output.ID, qt.Not(qt.Equals), "")
+		return bus, blobs, notifier
+	}
+
+	c.Run("Discard", func(c *qt.C) {
+		bus, blobs, notifier := execute(c, ClientOptions{})
+
+		// The response was sent twice.
+		waitFor(c, func() bool { return bus.queue(toClient).len() == 0 })
+
+		// A server retry uploads the response again.
+		note := notifier.last()
+		c.Assert(blobs.Put(context.Background(), note.Key, strings.NewReader("FOO"), nil), qt.IsNil)
+		bus.queue(toClient).push(note)
+		waitFor(c, func() bool { return bus.queue(toClient).len() == 0 && !blobs.has(note.Key) })
+	})
+
+	c.Run("Release", func(c *qt.C) {
+		bus, _, _ := execute(c, ClientOptions{DuplicateResponseTTL: -1})
+
+		// Released over and over.
+		time.Sleep(100 * time.Millisecond)
+		c.Assert(bus.queue(toClient).len(), qt.Equals, 1)
+	})
+}
+
+// duplicatingNotifier sends every response twice.
+type duplicatingNotifier struct {
+	Notifier
+
+	mu   sync.Mutex
+	note Note
+}
+
+func (n *duplicatingNotifier) Send(ctx context.Context, note Note) error {
+	if !strings.HasPrefix(note.Key, toClient+"/") {
+		return n.Notifier.Send(ctx, note)
+	}
+	n.mu.Lock()
+	n.note = note
+	n.mu.Unlock()
+	for i := 0; i < 2; i++ {
+		if err := n.Notifier.Send(ctx, note); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *duplicatingNotifier) last() Note {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.note
+}
+
+func BenchmarkExecuteConcurrent(b *testing.B) {
+	c := qt.New(b)
+
+	for i := 0; i < b.N; i++ {
+		bus := newMemBus()
+		blobs := newMemBlobStore()
+		notifier := &countingNotifier{Notifier: bus.notifier(toClient)}
+
+		client := newTestClient(c, bus, blobs, ClientOptions{Notifier: notifier, Timeout: time.Minute})
+		newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}})
+
+		if err := executeConcurrently(c, client, 1000); err != nil {
+			b.Fatal(err)
+		}
+		b.ReportMetric(float64(notifier.maxReceivers()), "pollers")
+	}
+}
+
+func executeConcurrently(c *qt.C, client *Client, n int) error {
+	dir := c.TempDir()
+	var g errgroup.Group
+	for i := 0; i < n; i++ {
+		i := i
+		g.Go(func() error {
+			filename := writeTestFileIn(c, dir, fmt.Sprintf("in%d.txt", i), "foo")
+			_, err := client.Execute(context.Background(), "upper", Input{Filename: filename})
+			return err
+		})
+	}
+	return g.Wait()
+}
@@ -0,0 +1,82 @@
+package s3rpc
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestExecuteEmpty(t *testing.T) {
+	emptyHandler := func(ctx context.Context, input Input) (Output, error) {
+		filename := input.Filename + ".empty"
+		return Output{Filename: filename}, os.WriteFile(filename, nil, 0644)
+	}
+
+	for _, test := range []struct {
+		name   string
+		copts  ClientOptions
+		sopts  ServerOptions
+		op     string
+		input  string
+		expect string
+	}{
+		{"EmptyInput", ClientOptions{}, ServerOptions{}, "upper", "", ""},
+		{"EmptyOutput", ClientOptions{}, ServerOptions{}, "empty", "foo", ""},
+		{"EmptyInputSigned", ClientOptions{ResponseHMACKey: []byte("secret")}, ServerOptions{ResponseHMACKey: []byte("secret")}, "upper", "", ""},
+		{"EmptyOutputSigned", ClientOptions{ResponseHMACKey: []byte("secret")}, ServerOptions{ResponseHMACKey: []byte("secret")}, "empty", "foo", ""},
+		{"EmptyOutputMaxTempBytes", ClientOptions{MaxTempBytes: 1}, ServerOptions{}, "empty", "foo", ""},
+		{"EmptyInputCached", ClientOptions{}, ServerOptions{ResultCacheTTL: time.Hour}, "upper", "", ""},
+		{"EmptyOutputCached", ClientOptions{}, ServerOptions{ResultCacheTTL: time.Hour}, "empty", "foo", ""},
+		{"EmptyUnchanged", ClientOptions{}, ServerOptions{}, "noop", "", ""},
+		{"NoOutput", ClientOptions{}, ServerOptions{}, "none", "foo", ""},
+		{"NoOutputCached", ClientOptions{}, ServerOptions{ResultCacheTTL: time.Hour}, "none", "foo", ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			bus := newMemBus()
+			blobs := newMemBlobStore()
+
+			sopts := test.sopts
+			sopts.Handlers = Handlers{
+				"upper": upperHandler,
+				"empty": emptyHandler,
+				"noop": func(ctx context.Context, input Input) (Output, error) {
+					return Output{Unchanged: true}, nil
+				},
+				"none": func(ctx context.Context, input Input) (Output, error) {
+					return Output{Metadata: map[string]string{"a": "b"}}, nil
+				},
+			}
+			client := newTestClient(c, bus, blobs, test.copts)
+			newTestServer(c, bus, blobs, sopts)
+
+			// Twice to hit the result cache, if enabled.
+			for i := 0; i < 2; i++ {
+				output, err := client.Execute(context.Background(), test.op, Input{Filename: writeTestFile(c, "in.txt", test.input)})
+				c.Assert(err, qt.IsNil)
+				b, err := os.ReadFile(output.Filename)
+				c.Assert(err, qt.IsNil)
+				c.Assert(string(b), qt.Equals, test.expect)
+			}
+		})
+	}
+}
+
+func TestHeaderEmpty(t *testing.T) {
+	c := qt.New(t)
+
+	h, err := fileHeader(writeTestFile(c, "empty.txt", ""))
+	c.Assert(err, qt.IsNil)
+	c.Assert(h.Size, qt.Equals, int64(0))
+	// The SHA-256 of no content.
+	c.Assert(h.Checksum, qt.Equals, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+	c.Assert(bytesHeader(nil, "").Checksum, qt.Equals, h.Checksum)
+
+	got, err := readHeader(h.metadata())
+	c.Assert(err, qt.IsNil)
+	c.Assert(got, qt.Equals, h)
+}
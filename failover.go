@@ -0,0 +1,136 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// ReplyEndpoint is a queue to receive responses from, see ClientOptions.ReplyEndpoints.
+type ReplyEndpoint struct {
+	// Region is the queue's region.
+	// Defaults to the region in the queue's URL, then to AWSConfig.Region.
+	Region string
+
+	// Queue is the SQS queue, as a URL or ARN.
+	Queue string
+
+	// Notifier, if set, is used to receive from the queue instead of an SQS notifier.
+	Notifier Notifier
+}
+
+// initReplyEndpoints validates the reply endpoints and sets up their notifiers.
+func (c *Client) initReplyEndpoints(endpoints []ReplyEndpoint, cfg AWSConfig, awsCfg aws.Config) error {
+	for _, e := range endpoints {
+		queue, err := normalizeReplyTo(e.Queue)
+		if err != nil {
+			return err
+		}
+		e.Queue = queue
+		if e.Region == "" {
+			e.Region = queueRegion(queue)
+		}
+		if e.Region == "" {
+			e.Region = cfg.Region
+		}
+		if e.Notifier == nil {
+			cfg, awsCfg := cfg, awsCfg
+			cfg.Region, awsCfg.Region = e.Region, e.Region
+			sqsClient, err := newSQSClient(cfg, awsCfg, queue, c.infof)
+			if err != nil {
+				return err
+			}
+			e.Notifier = NewSQSNotifier(sqsClient, queue)
+		}
+		c.endpoints = append(c.endpoints, e)
+	}
+	return nil
+}
+
+// Receive receives the next batch of messages from the active reply endpoint,
+// see ClientOptions.ReplyEndpoints, or else from the Notifier.
+func (c *Client) Receive(ctx context.Context) ([]Message, error) {
+	if len(c.endpoints) == 0 {
+		return c.common.Receive(ctx)
+	}
+	return c.receiveFrom(ctx, []Notifier{c.activeEndpoint().Notifier})
+}
+
+func (c *Client) activeEndpoint() ReplyEndpoint {
+	c.endpointMu.Lock()
+	defer c.endpointMu.Unlock()
+	return c.endpoints[c.endpoint]
+}
+
+// failover makes the next reply endpoint the active one.
+// It reports false if there is no other endpoint to fail over to.
+func (c *Client) failover(cause error) bool {
+	if len(c.endpoints) < 2 {
+		return false
+	}
+	c.endpointMu.Lock()
+	from := c.endpoints[c.endpoint]
+	c.endpoint = (c.endpoint + 1) % len(c.endpoints)
+	to := c.endpoints[c.endpoint]
+	c.endpointMu.Unlock()
+	c.infof("Failing over from queue %q in region %q to queue %q in region %q: %s", from.Queue, from.Region, to.Queue, to.Region, cause)
+	return true
+}
+
+// replyQueues returns the queue the server should send the responses to, if any,
+// and the queues to fall back to if it cannot, in order.
+// With ReplyEndpoints, this is the active endpoint followed by the others.
+func (c *Client) replyQueues() (string, []string) {
+	if len(c.endpoints) == 0 {
+		return c.replyTo, nil
+	}
+	c.endpointMu.Lock()
+	defer c.endpointMu.Unlock()
+	var fallbacks []string
+	for i := 1; i < len(c.endpoints); i++ {
+		fallbacks = append(fallbacks, c.endpoints[(c.endpoint+i)%len(c.endpoints)].Queue)
+	}
+	return c.endpoints[c.endpoint].Queue, fallbacks
+}
+
+// replyToFallbacks returns the queues to fall back to if sending to the reply-to queue fails,
+// see ClientOptions.ReplyEndpoints.
+func (s *Server) replyToFallbacks(internal map[string]string) []string {
+	var queues []string
+	for _, queue := range strings.Split(internal[metaReplyToFallback], ",") {
+		if queue == "" {
+			continue
+		}
+		queue, err := normalizeReplyTo(queue)
+		if err != nil {
+			s.infof("Skipping reply-to fallback: %s", err)
+			continue
+		}
+		queues = append(queues, queue)
+	}
+	return queues
+}
+
+// sendToReplyTo notifies the first of the reply-to queues accepting note.
+func (s *Server) sendToReplyTo(ctx context.Context, queues []string, note Note) error {
+	sender := s.notifier.(ReplyToSender)
+	var failures []string
+	for i, queue := range queues {
+		err := sender.SendTo(ctx, queue, note)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil || i == len(queues)-1 {
+			if len(failures) == 0 {
+				return err
+			}
+			return fmt.Errorf("%s; %s: %w", strings.Join(failures, "; "), queue, err)
+		}
+		s.infof("Failed to notify reply-to queue %q, falling back to %q: %s", queue, queues[i+1], err)
+		failures = append(failures, fmt.Sprintf("%s: %s", queue, err))
+	}
+	return errors.New("no reply-to queue")
+}
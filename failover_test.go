@@ -0,0 +1,163 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestReplyEndpointsFailover(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	primary := "https://sqs.eu-north-1.amazonaws.com/656975317043/primary"
+	secondary := "arn:aws:sqs:us-east-1:656975317043:secondary"
+	secondaryURL := "https://sqs.us-east-1.amazonaws.com/656975317043/secondary"
+
+	// The primary region is down: receiving from and sending to its queue fails.
+	errDown := errors.New("region down")
+	primaryNotifier := &failingNotifier{Notifier: bus.notifier(primary), err: errDown, failures: 1 << 20}
+	client := newTestClient(c, bus, blobs, ClientOptions{
+		MaxReceiveRetries: 1,
+		ReplyEndpoints: []ReplyEndpoint{
+			{Queue: primary, Notifier: primaryNotifier},
+			{Queue: secondary, Notifier: bus.notifier(secondaryURL)},
+		},
+	})
+	c.Assert(client.endpoints[0].Region, qt.Equals, "eu-north-1")
+	c.Assert(client.endpoints[1].Region, qt.Equals, "us-east-1")
+	c.Assert(client.endpoints[1].Queue, qt.Equals, secondaryURL)
+
+	newTestServer(c, bus, blobs, ServerOptions{
+		Notifier: &downQueueNotifier{memNotifier: bus.notifier(toServer), queue: primary, err: errDown},
+		Handlers: Handlers{"upper": upperHandler},
+	})
+
+	execute := func() {
+		output, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+		c.Assert(err, qt.IsNil)
+		b, err := os.ReadFile(output.Filename)
+		c.Assert(err, qt.IsNil)
+		c.Assert(string(b), qt.Equals, "FOO")
+	}
+
+	// Submitted with the primary active, the response falls back to the secondary,
+	// where the client finds it once failed over.
+	execute()
+	c.Assert(client.activeEndpoint().Queue, qt.Equals, secondaryURL)
+	replyTo, fallbacks := client.replyQueues()
+	c.Assert(replyTo, qt.Equals, secondaryURL)
+	c.Assert(fallbacks, qt.DeepEquals, []string{primary})
+
+	// Now sent to the secondary right away.
+	execute()
+	c.Assert(bus.queue(primary).len(), qt.Equals, 0)
+	c.Assert(bus.queue(toClient).len(), qt.Equals, 0)
+
+	_, err := NewClient(ClientOptions{Queue: primary, ReplyEndpoints: []ReplyEndpoint{{Queue: primary, Notifier: primaryNotifier}}, BlobStore: blobs})
+	c.Assert(err, qt.ErrorMatches, "ReplyEndpoints cannot be combined with Queue, ReplyTo or Notifier")
+}
+
+func TestReplyEndpointsInvalid(t *testing.T) {
+	c := qt.New(t)
+
+	tempDir := t.TempDir()
+	t.Setenv("TMPDIR", tempDir)
+
+	_, err := NewClient(ClientOptions{
+		ReplyEndpoints: []ReplyEndpoint{{Queue: "arn:aws:sqs:eu-north-1", Notifier: newMemBus().notifier(toClient)}},
+		BlobStore:      newMemBlobStore(),
+	})
+	c.Assert(err, qt.ErrorMatches, `invalid reply-to queue ARN .*`)
+
+	// No temporary directory is left behind.
+	entries, err := os.ReadDir(tempDir)
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 0)
+}
+
+func TestReplyEndpointsAllFailed(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+	errDown := errors.New("region down")
+	client := newTestClient(c, bus, blobs, ClientOptions{
+		MaxReceiveRetries: -1,
+		ReplyEndpoints: []ReplyEndpoint{
+			{Queue: "https://sqs.eu-north-1.amazonaws.com/656975317043/a", Notifier: &failingNotifier{Notifier: bus.notifier("a"), err: errDown, failures: 1 << 20}},
+			{Queue: "https://sqs.us-east-1.amazonaws.com/656975317043/b", Notifier: &failingNotifier{Notifier: bus.notifier("b"), err: errDown, failures: 1 << 20}},
+		},
+	})
+
+	_, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.ErrorMatches, "apply: region down")
+}
+
+// downQueueNotifier fails to send to queue.
+type downQueueNotifier struct {
+	*memNotifier
+	queue string
+	err   error
+}
+
+func (n *downQueueNotifier) SendTo(ctx context.Context, queue string, note Note) error {
+	if queue == n.queue {
+		return n.err
+	}
+	return n.memNotifier.SendTo(ctx, queue, note)
+}
+
+func TestSendToReplyToFallbackRegion(t *testing.T) {
+	c := qt.New(t)
+
+	httpClient := &regionDownHTTPClient{host: "sqs.eu-north-1.amazonaws.com"}
+	client := sqs.New(sqs.Options{
+		Region:           "eu-west-1",
+		Credentials:      credentials.NewStaticCredentialsProvider("id", "secret", ""),
+		HTTPClient:       httpClient,
+		RetryMaxAttempts: 1,
+	})
+	s := &Server{
+		common: &common{
+			notifier: NewSQSNotifier(client, "https://sqs.eu-west-1.amazonaws.com/656975317043/server"),
+			infof:    func(format string, args ...interface{}) {},
+		},
+	}
+
+	queues := []string{
+		"https://sqs.eu-north-1.amazonaws.com/656975317043/primary",
+		"https://sqs.us-east-1.amazonaws.com/656975317043/secondary",
+	}
+	c.Assert(s.sendToReplyTo(context.Background(), queues, Note{Bucket: testBucket, Key: "to_client_direct/upper/foo"}), qt.IsNil)
+
+	// Each endpoint is sent to in its own region, not in the server queue's.
+	c.Assert(httpClient.requests, qt.HasLen, 2)
+	for i, region := range []string{"eu-north-1", "us-east-1"} {
+		r := httpClient.requests[i]
+		c.Assert(r.URL.Host, qt.Equals, "sqs."+region+".amazonaws.com")
+		c.Assert(r.Header.Get("Authorization"), qt.Contains, "/"+region+"/sqs/aws4_request")
+	}
+}
+
+// regionDownHTTPClient records the requests and fails those to host.
+type regionDownHTTPClient struct {
+	recordingHTTPClient
+	host string
+}
+
+func (c *regionDownHTTPClient) Do(r *http.Request) (*http.Response, error) {
+	resp, _ := c.recordingHTTPClient.Do(r)
+	if r.URL.Host == c.host {
+		return nil, errors.New("region down")
+	}
+	return resp, nil
+}
@@ -0,0 +1,332 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/bep/awscreate"
+)
+
+// NewFanOutProvisioner returns a new Provisioner that converts an environment created with
+// NewProvisioner to fan out requests to multiple server fleets.
+//
+// Create creates an SNS topic, one SQS queue per subscriber (named <name>_server_<subscriber>)
+// subscribed to the topic, and routes the to_server notifications from the bucket to the topic.
+// Each server fleet then reads from its own subscriber queue, see ServerOptions.Queue,
+// and exactly one of them must respond to the clients, see ServerOptions.Shadow.
+// The server user is allowed to read from all subscriber queues.
+//
+// Destroy removes the topic and the subscriber queues, routes the to_server notifications
+// back to the server queue and restricts the server user to the server queue again.
+func NewFanOutProvisioner(name, region string, subscribers ...string) (awscreate.Provisioner[FanOutResult], error) {
+	return NewFanOutProvisionerWithOptions(ProvisionerOptions{Name: name, Region: region}, subscribers...)
+}
+
+// NewFanOutProvisionerWithOptions is like NewFanOutProvisioner, but allows configuring the subscriber queues,
+// which should match the options the environment was created with, see NewProvisionerWithOptions.
+func NewFanOutProvisionerWithOptions(opts ProvisionerOptions, subscribers ...string) (awscreate.Provisioner[FanOutResult], error) {
+	name, region := opts.Name, opts.Region
+
+	queueAttributes, err := opts.queueAttributes()
+	if err != nil {
+		return nil, err
+	}
+
+	keyID := os.Getenv("S3RPC_ADMIN_ACCESS_KEY_ID")
+	keySecret := os.Getenv("S3RPC_ADMIN_ACCESS_KEY_SECRET")
+
+	if keyID == "" || keySecret == "" {
+		return nil, errors.New("S3RPC_ADMIN_ACCESS_KEY_ID and S3RPC_ADMIN_ACCESS_KEY_SECRET must be set")
+	}
+
+	if len(subscribers) == 0 {
+		return nil, errors.New("at least one subscriber is required")
+	}
+
+	awsCfg := aws.Config{
+		Region:      region,
+		Credentials: credentials.NewStaticCredentialsProvider(keyID, keySecret, ""),
+	}
+
+	f := &fanOut{
+		name:            name,
+		region:          region,
+		subscribers:     subscribers,
+		queueAttributes: queueAttributes,
+		s3:              s3.NewFromConfig(awsCfg),
+		sns:             sns.NewFromConfig(awsCfg),
+		sqs:             sqs.NewFromConfig(awsCfg),
+		iam:             iam.NewFromConfig(awsCfg),
+	}
+
+	return awscreate.NewProvisioner(f.create, f.destroy), nil
+}
+
+// FanOutResult is the result of a fan-out Provisioner's Create.
+type FanOutResult struct {
+	// TopicArn is the ARN of the SNS topic the bucket publishes requests to.
+	TopicArn string
+
+	// QueueURLs maps each subscriber to the URL of its queue.
+	QueueURLs map[string]string
+
+	// ServerPolicy is the IAM policy document (JSON) attached to the server user.
+	ServerPolicy string
+}
+
+type fanOut struct {
+	name            string
+	region          string
+	subscribers     []string
+	queueAttributes map[string]string
+
+	s3  *s3.Client
+	sns *sns.Client
+	sqs *sqs.Client
+	iam *iam.Client
+}
+
+func (f *fanOut) topicName() string {
+	return f.name + "_requests"
+}
+
+func (f *fanOut) queueName(subscriber string) string {
+	return f.name + "_server_" + subscriber
+}
+
+func (f *fanOut) create(ctx context.Context) (FanOutResult, error) {
+	result := FanOutResult{QueueURLs: make(map[string]string)}
+
+	clientQueue, err := f.queueARN(ctx, f.name+"_client")
+	if err != nil {
+		return result, err
+	}
+	accountID := strings.Split(clientQueue, ":")[4]
+
+	topicArn := fmt.Sprintf("arn:aws:sns:%s:%s:%s", f.region, accountID, f.topicName())
+	topicPolicy, err := json.Marshal(resourcePolicy(
+		"s3.amazonaws.com", "sns:Publish", topicArn, "arn:aws:s3:::"+f.name,
+	))
+	if err != nil {
+		return result, err
+	}
+	topic, err := f.sns.CreateTopic(ctx, &sns.CreateTopicInput{
+		Name:       aws.String(f.topicName()),
+		Attributes: map[string]string{"Policy": string(topicPolicy)},
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to create topic: %w", err)
+	}
+	result.TopicArn = *topic.TopicArn
+
+	var serverQueues []string
+	for _, subscriber := range f.subscribers {
+		queueName := f.queueName(subscriber)
+		queueArn := fmt.Sprintf("arn:aws:sqs:%s:%s:%s", f.region, accountID, queueName)
+		queuePolicy, err := json.Marshal(resourcePolicy(
+			"sns.amazonaws.com", "sqs:SendMessage", queueArn, result.TopicArn,
+		))
+		if err != nil {
+			return result, err
+		}
+		attributes := newQueueAttributes(f.queueAttributes)
+		attributes["Policy"] = string(queuePolicy)
+		q, err := f.sqs.CreateQueue(ctx, &sqs.CreateQueueInput{
+			QueueName:  aws.String(queueName),
+			Attributes: attributes,
+		})
+		if err != nil {
+			return result, fmt.Errorf("failed to create queue: %w", err)
+		}
+		result.QueueURLs[subscriber] = *q.QueueUrl
+		serverQueues = append(serverQueues, queueArn)
+
+		_, err = f.sns.Subscribe(ctx, &sns.SubscribeInput{
+			TopicArn: topic.TopicArn,
+			Protocol: aws.String("sqs"),
+			Endpoint: aws.String(queueArn),
+			// Deliver the S3 event as is.
+			Attributes: map[string]string{"RawMessageDelivery": "true"},
+		})
+		if err != nil {
+			return result, fmt.Errorf("failed to subscribe queue: %w", err)
+		}
+	}
+
+	result.ServerPolicy, err = f.putServerPolicy(ctx, clientQueue, serverQueues...)
+	if err != nil {
+		return result, err
+	}
+
+	toServerCfg := &types.TopicConfiguration{TopicArn: topic.TopicArn}
+	if err := f.putBucketNotification(ctx, clientQueue, nil, toServerCfg); err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+func (f *fanOut) destroy(ctx context.Context) error {
+	clientQueue, err := f.queueARN(ctx, f.name+"_client")
+	if err == nil {
+		var serverQueue string
+		serverQueue, err = f.queueARN(ctx, f.name+"_server")
+		if err == nil {
+			err = f.putBucketNotification(ctx, clientQueue, &serverQueue, nil)
+		}
+		if err == nil {
+			_, err = f.putServerPolicy(ctx, clientQueue, serverQueue)
+		}
+	}
+	if err != nil && !isNoSuchEntityErr(err) {
+		return err
+	}
+
+	for _, subscriber := range f.subscribers {
+		q, err := f.sqs.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{QueueName: aws.String(f.queueName(subscriber))})
+		if err == nil {
+			_, err = f.sqs.DeleteQueue(ctx, &sqs.DeleteQueueInput{QueueUrl: q.QueueUrl})
+		}
+		if err != nil && !isNoSuchEntityErr(err) {
+			return fmt.Errorf("failed to delete queue: %w", err)
+		}
+	}
+
+	topics, err := f.sns.ListTopics(ctx, &sns.ListTopicsInput{})
+	if err != nil {
+		return fmt.Errorf("failed to list topics: %w", err)
+	}
+	for _, topic := range topics.Topics {
+		if !strings.HasSuffix(*topic.TopicArn, ":"+f.topicName()) {
+			continue
+		}
+		// This also removes the subscriptions.
+		if _, err := f.sns.DeleteTopic(ctx, &sns.DeleteTopicInput{TopicArn: topic.TopicArn}); err != nil {
+			return fmt.Errorf("failed to delete topic: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// putServerPolicy replaces the server user's policy with one allowing it to read from serverQueues,
+// and returns it.
+func (f *fanOut) putServerPolicy(ctx context.Context, clientQueue string, serverQueues ...string) (string, error) {
+	_, policy, err := userPolicies(f.name, clientQueue, serverQueues...)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.iam.PutUserPolicy(ctx, &iam.PutUserPolicyInput{
+		UserName:       aws.String(f.name + "_server"),
+		PolicyName:     aws.String(userPolicyName),
+		PolicyDocument: aws.String(policy),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to attach user policy: %w", err)
+	}
+	return policy, nil
+}
+
+func (f *fanOut) putBucketNotification(ctx context.Context, clientQueue string, serverQueue *string, serverTopic *types.TopicConfiguration) error {
+	return putBucketNotification(ctx, f.s3, f.name, clientQueue, serverQueue, serverTopic)
+}
+
+// putBucketNotification routes the to_client notifications from bucket to clientQueue and the to_server
+// notifications to either serverQueue or serverTopic.
+func putBucketNotification(ctx context.Context, client *s3.Client, bucket, clientQueue string, serverQueue *string, serverTopic *types.TopicConfiguration) error {
+	filter := func(prefix string) *types.NotificationConfigurationFilter {
+		return &types.NotificationConfigurationFilter{
+			Key: &types.S3KeyFilter{
+				FilterRules: []types.FilterRule{
+					{Name: "prefix", Value: aws.String(prefix + "/")},
+				},
+			},
+		}
+	}
+
+	cfg := &types.NotificationConfiguration{
+		QueueConfigurations: []types.QueueConfiguration{
+			{
+				Id:       aws.String("To Client"),
+				Events:   []types.Event{"s3:ObjectCreated:*"},
+				Filter:   filter(toClient),
+				QueueArn: aws.String(clientQueue),
+			},
+		},
+	}
+	if serverQueue != nil {
+		cfg.QueueConfigurations = append(cfg.QueueConfigurations, types.QueueConfiguration{
+			Id:       aws.String("To Server"),
+			Events:   []types.Event{"s3:ObjectCreated:*"},
+			Filter:   filter(toServer),
+			QueueArn: serverQueue,
+		})
+	}
+	if serverTopic != nil {
+		serverTopic.Id = aws.String("To Server")
+		serverTopic.Events = []types.Event{"s3:ObjectCreated:*"}
+		serverTopic.Filter = filter(toServer)
+		cfg.TopicConfigurations = []types.TopicConfiguration{*serverTopic}
+	}
+
+	_, err := client.PutBucketNotificationConfiguration(ctx, &s3.PutBucketNotificationConfigurationInput{
+		Bucket:                    aws.String(bucket),
+		NotificationConfiguration: cfg,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put bucket notification: %w", err)
+	}
+	return nil
+}
+
+// queueARN looks up the ARN of the queue with the given name.
+func (f *fanOut) queueARN(ctx context.Context, name string) (string, error) {
+	q, err := f.sqs.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{QueueName: aws.String(name)})
+	if err != nil {
+		return "", err
+	}
+	return queueARN(f.region, *q.QueueUrl)
+}
+
+type resourcePolicyDocument struct {
+	Version   string
+	Statement []resourcePolicyStatement
+}
+
+type resourcePolicyStatement struct {
+	Effect    string
+	Principal map[string]string
+	Action    string
+	Resource  string
+	Condition map[string]map[string]string
+}
+
+// resourcePolicy returns a policy allowing service to perform action on resource
+// on behalf of sourceArn.
+func resourcePolicy(service, action, resource, sourceArn string) resourcePolicyDocument {
+	return resourcePolicyDocument{
+		Version: "2012-10-17",
+		Statement: []resourcePolicyStatement{
+			{
+				Effect:    "Allow",
+				Principal: map[string]string{"Service": service},
+				Action:    action,
+				Resource:  resource,
+				Condition: map[string]map[string]string{
+					"ArnLike": {"aws:SourceArn": sourceArn},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,337 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestNewFanOutProvisioner(t *testing.T) {
+	c := qt.New(t)
+
+	t.Setenv("S3RPC_ADMIN_ACCESS_KEY_ID", "")
+	_, err := NewFanOutProvisioner("s3fptest", "eu-north-1", "a")
+	c.Assert(err, qt.ErrorMatches, "S3RPC_ADMIN_ACCESS_KEY_ID and S3RPC_ADMIN_ACCESS_KEY_SECRET must be set")
+
+	t.Setenv("S3RPC_ADMIN_ACCESS_KEY_ID", "id")
+	t.Setenv("S3RPC_ADMIN_ACCESS_KEY_SECRET", "secret")
+	_, err = NewFanOutProvisioner("s3fptest", "eu-north-1")
+	c.Assert(err, qt.ErrorMatches, "at least one subscriber is required")
+	p, err := NewFanOutProvisioner("s3fptest", "eu-north-1", "a", "b")
+	c.Assert(err, qt.IsNil)
+	c.Assert(p, qt.Not(qt.IsNil))
+}
+
+func TestFanOutCreate(t *testing.T) {
+	c := qt.New(t)
+
+	httpClient := &fakeAWSHTTPClient{}
+	result, err := newTestFanOut(httpClient, "a", "b").create(context.Background())
+	c.Assert(err, qt.IsNil)
+
+	const (
+		topicArn    = "arn:aws:sns:eu-north-1:656975317043:s3fptest_requests"
+		clientQueue = "arn:aws:sqs:eu-north-1:656975317043:s3fptest_client"
+	)
+	c.Assert(result.TopicArn, qt.Equals, topicArn)
+	c.Assert(result.QueueURLs, qt.DeepEquals, map[string]string{
+		"a": "https://sqs.eu-north-1.amazonaws.com/656975317043/s3fptest_server_a",
+		"b": "https://sqs.eu-north-1.amazonaws.com/656975317043/s3fptest_server_b",
+	})
+	c.Assert(result.ServerPolicy, qt.Contains, `"arn:aws:sqs:eu-north-1:656975317043:s3fptest_server_a"`)
+	c.Assert(result.ServerPolicy, qt.Contains, `"arn:aws:sqs:eu-north-1:656975317043:s3fptest_server_b"`)
+
+	// Only S3 events from the bucket may be published to the topic.
+	topics := httpClient.find("CreateTopic")
+	c.Assert(topics, qt.HasLen, 1)
+	c.Assert(topics[0].form.Get("Name"), qt.Equals, "s3fptest_requests")
+	c.Assert(decodeResourcePolicy(c, formMap(topics[0].form, "Attributes.entry", "key", "value")["Policy"]), qt.DeepEquals, resourcePolicyStatement{
+		Effect:    "Allow",
+		Principal: map[string]string{"Service": "s3.amazonaws.com"},
+		Action:    "sns:Publish",
+		Resource:  topicArn,
+		Condition: map[string]map[string]string{"ArnLike": {"aws:SourceArn": "arn:aws:s3:::s3fptest"}},
+	})
+
+	// Only the topic may send to the subscriber queues.
+	queues := httpClient.find("CreateQueue")
+	c.Assert(queues, qt.HasLen, 2)
+	for i, subscriber := range []string{"a", "b"} {
+		q := queues[i]
+		c.Assert(q.form.Get("QueueName"), qt.Equals, "s3fptest_server_"+subscriber)
+		attrs := formMap(q.form, "Attribute", "Name", "Value")
+		c.Assert(attrs["MessageRetentionPeriod"], qt.Equals, "7200")
+		c.Assert(decodeResourcePolicy(c, attrs["Policy"]), qt.DeepEquals, resourcePolicyStatement{
+			Effect:    "Allow",
+			Principal: map[string]string{"Service": "sns.amazonaws.com"},
+			Action:    "sqs:SendMessage",
+			Resource:  "arn:aws:sqs:eu-north-1:656975317043:s3fptest_server_" + subscriber,
+			Condition: map[string]map[string]string{"ArnLike": {"aws:SourceArn": topicArn}},
+		})
+	}
+
+	subscriptions := httpClient.find("Subscribe")
+	c.Assert(subscriptions, qt.HasLen, 2)
+	for i, subscriber := range []string{"a", "b"} {
+		s := subscriptions[i]
+		c.Assert(s.form.Get("TopicArn"), qt.Equals, topicArn)
+		c.Assert(s.form.Get("Protocol"), qt.Equals, "sqs")
+		c.Assert(s.form.Get("Endpoint"), qt.Equals, "arn:aws:sqs:eu-north-1:656975317043:s3fptest_server_"+subscriber)
+		c.Assert(formMap(s.form, "Attributes.entry", "key", "value")["RawMessageDelivery"], qt.Equals, "true")
+	}
+
+	policies := httpClient.find("PutUserPolicy")
+	c.Assert(policies, qt.HasLen, 1)
+	c.Assert(policies[0].form.Get("UserName"), qt.Equals, "s3fptest_server")
+	c.Assert(policies[0].form.Get("PolicyDocument"), qt.Equals, result.ServerPolicy)
+
+	// The to_server notifications go to the topic.
+	notifications := httpClient.find("PUT notification=")
+	c.Assert(notifications, qt.HasLen, 1)
+	c.Assert(decodeBucketNotification(c, notifications[0].body), qt.DeepEquals, bucketNotification{
+		Queues: []bucketNotificationTarget{{ID: "To Client", Arn: clientQueue, Events: []string{"s3:ObjectCreated:*"}, Prefix: "to_client/"}},
+		Topics: []bucketNotificationTarget{{ID: "To Server", Arn: topicArn, Events: []string{"s3:ObjectCreated:*"}, Prefix: "to_server/"}},
+	})
+}
+
+func TestFanOutCreateQueueAttributes(t *testing.T) {
+	c := qt.New(t)
+
+	opts := ProvisionerOptions{Name: "s3fptest", Region: "eu-north-1", MessageRetentionPeriod: 24 * time.Hour, Delay: 90 * time.Second}
+	queueAttributes, err := opts.queueAttributes()
+	c.Assert(err, qt.IsNil)
+
+	httpClient := &fakeAWSHTTPClient{}
+	f := newTestFanOut(httpClient, "a")
+	f.queueAttributes = queueAttributes
+	_, err = f.create(context.Background())
+	c.Assert(err, qt.IsNil)
+
+	queues := httpClient.find("CreateQueue")
+	c.Assert(queues, qt.HasLen, 1)
+	attrs := formMap(queues[0].form, "Attribute", "Name", "Value")
+	c.Assert(attrs["MessageRetentionPeriod"], qt.Equals, "86400")
+	c.Assert(attrs["DelaySeconds"], qt.Equals, "90")
+	c.Assert(attrs["ReceiveMessageWaitTimeSeconds"], qt.Equals, "10")
+	c.Assert(attrs["Policy"], qt.Not(qt.Equals), "")
+
+	_, err = NewFanOutProvisionerWithOptions(ProvisionerOptions{Name: "s3fptest", Region: "eu-north-1", Delay: time.Hour}, "a")
+	c.Assert(err, qt.ErrorMatches, `delay must be .*`)
+}
+
+func TestFanOutDestroy(t *testing.T) {
+	c := qt.New(t)
+
+	httpClient := &fakeAWSHTTPClient{}
+	c.Assert(newTestFanOut(httpClient, "a", "b").destroy(context.Background()), qt.IsNil)
+
+	// The server user may only read from the server queue again.
+	policies := httpClient.find("PutUserPolicy")
+	c.Assert(policies, qt.HasLen, 1)
+	c.Assert(policies[0].form.Get("UserName"), qt.Equals, "s3fptest_server")
+	policy := policies[0].form.Get("PolicyDocument")
+	c.Assert(policy, qt.Contains, `"arn:aws:sqs:eu-north-1:656975317043:s3fptest_server"`)
+	c.Assert(policy, qt.Not(qt.Contains), "s3fptest_server_")
+
+	// The to_server notifications go back to the server queue.
+	notifications := httpClient.find("PUT notification=")
+	c.Assert(notifications, qt.HasLen, 1)
+	c.Assert(decodeBucketNotification(c, notifications[0].body), qt.DeepEquals, bucketNotification{
+		Queues: []bucketNotificationTarget{
+			{ID: "To Client", Arn: "arn:aws:sqs:eu-north-1:656975317043:s3fptest_client", Events: []string{"s3:ObjectCreated:*"}, Prefix: "to_client/"},
+			{ID: "To Server", Arn: "arn:aws:sqs:eu-north-1:656975317043:s3fptest_server", Events: []string{"s3:ObjectCreated:*"}, Prefix: "to_server/"},
+		},
+	})
+
+	var deleted []string
+	for _, r := range httpClient.find("DeleteQueue") {
+		deleted = append(deleted, r.form.Get("QueueUrl"))
+	}
+	c.Assert(deleted, qt.DeepEquals, []string{
+		"https://sqs.eu-north-1.amazonaws.com/656975317043/s3fptest_server_a",
+		"https://sqs.eu-north-1.amazonaws.com/656975317043/s3fptest_server_b",
+	})
+
+	// Only our topic is deleted.
+	topics := httpClient.find("DeleteTopic")
+	c.Assert(topics, qt.HasLen, 1)
+	c.Assert(topics[0].form.Get("TopicArn"), qt.Equals, "arn:aws:sns:eu-north-1:656975317043:s3fptest_requests")
+}
+
+// formMap returns the map serialized below prefix in an AWS query request.
+func formMap(form url.Values, prefix, key, value string) map[string]string {
+	m := make(map[string]string)
+	for i := 1; ; i++ {
+		k := form.Get(fmt.Sprintf("%s.%d.%s", prefix, i, key))
+		if k == "" {
+			return m
+		}
+		m[k] = form.Get(fmt.Sprintf("%s.%d.%s", prefix, i, value))
+	}
+}
+
+func decodeResourcePolicy(c *qt.C, policy string) resourcePolicyStatement {
+	var doc resourcePolicyDocument
+	c.Assert(json.Unmarshal([]byte(policy), &doc), qt.IsNil)
+	c.Assert(doc.Version, qt.Equals, "2012-10-17")
+	c.Assert(doc.Statement, qt.HasLen, 1)
+	return doc.Statement[0]
+}
+
+type bucketNotification struct {
+	Queues []bucketNotificationTarget
+	Topics []bucketNotificationTarget
+}
+
+type bucketNotificationTarget struct {
+	ID     string
+	Arn    string
+	Events []string
+	Prefix string
+}
+
+// decodeBucketNotification decodes a PutBucketNotificationConfiguration request body.
+func decodeBucketNotification(c *qt.C, body []byte) bucketNotification {
+	type target struct {
+		ID          string   `xml:"Id"`
+		Queue       string   `xml:"Queue"`
+		Topic       string   `xml:"Topic"`
+		Events      []string `xml:"Event"`
+		FilterRules []struct {
+			Name  string `xml:"Name"`
+			Value string `xml:"Value"`
+		} `xml:"Filter>S3Key>FilterRule"`
+	}
+	var cfg struct {
+		Queues []target `xml:"QueueConfiguration"`
+		Topics []target `xml:"TopicConfiguration"`
+	}
+	c.Assert(xml.Unmarshal(body, &cfg), qt.IsNil)
+
+	convert := func(targets []target) []bucketNotificationTarget {
+		var converted []bucketNotificationTarget
+		for _, t := range targets {
+			c.Assert(t.FilterRules, qt.HasLen, 1)
+			c.Assert(t.FilterRules[0].Name, qt.Equals, "prefix")
+			converted = append(converted, bucketNotificationTarget{ID: t.ID, Arn: t.Queue + t.Topic, Events: t.Events, Prefix: t.FilterRules[0].Value})
+		}
+		return converted
+	}
+	return bucketNotification{Queues: convert(cfg.Queues), Topics: convert(cfg.Topics)}
+}
+
+func newTestFanOut(httpClient *fakeAWSHTTPClient, subscribers ...string) *fanOut {
+	awsCfg := aws.Config{
+		Region:      "eu-north-1",
+		Credentials: credentials.NewStaticCredentialsProvider("id", "secret", ""),
+		HTTPClient:  httpClient,
+	}
+	return &fanOut{
+		name:        "s3fptest",
+		region:      "eu-north-1",
+		subscribers: subscribers,
+		s3:          s3.NewFromConfig(awsCfg),
+		sns:         sns.NewFromConfig(awsCfg),
+		sqs:         sqs.NewFromConfig(awsCfg),
+		iam:         iam.NewFromConfig(awsCfg),
+	}
+}
+
+// fakeAWSHTTPClient records the requests to the AWS APIs and responds
+// with just enough for the provisioners to proceed.
+type fakeAWSHTTPClient struct {
+	// notFound are the actions responded to with 404 Not Found.
+	notFound map[string]bool
+
+	mu       sync.Mutex
+	requests []fakeAWSRequest
+}
+
+type fakeAWSRequest struct {
+	service string
+	action  string
+	form    url.Values
+	body    []byte
+}
+
+// find returns the requests for action, in order.
+// For S3, action is the method and the query, e.g. "PUT notification=".
+func (c *fakeAWSHTTPClient) find(action string) []fakeAWSRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var requests []fakeAWSRequest
+	for _, r := range c.requests {
+		if r.action == action {
+			requests = append(requests, r)
+		}
+	}
+	return requests
+}
+
+func (c *fakeAWSHTTPClient) Do(r *http.Request) (*http.Response, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = io.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+	}
+	req := fakeAWSRequest{service: strings.Split(r.URL.Host, ".")[0], body: body}
+	if req.service == "sqs" || req.service == "sns" || req.service == "iam" {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+		req.form, req.action = form, form.Get("Action")
+	} else {
+		// S3, with the bucket in the host.
+		req.service, req.action = "s3", r.Method+" "+r.URL.RawQuery
+	}
+	c.mu.Lock()
+	c.requests = append(c.requests, req)
+	c.mu.Unlock()
+
+	var result string
+	switch req.action {
+	case "GetQueueUrl", "CreateQueue":
+		name := req.form.Get("QueueName")
+		result = fmt.Sprintf("<QueueUrl>https://sqs.eu-north-1.amazonaws.com/656975317043/%s</QueueUrl>", name)
+	case "CreateTopic":
+		result = fmt.Sprintf("<TopicArn>arn:aws:sns:eu-north-1:656975317043:%s</TopicArn>", req.form.Get("Name"))
+	case "GetUser", "CreateUser":
+		name := req.form.Get("UserName")
+		if name == "" {
+			name = "admin"
+		}
+		result = fmt.Sprintf("<User><UserName>%[1]s</UserName><Arn>arn:aws:iam::656975317043:user/%[1]s</Arn></User>", name)
+	case "CreateAccessKey":
+		result = fmt.Sprintf("<AccessKey><UserName>%s</UserName><AccessKeyId>id</AccessKeyId><SecretAccessKey>secret</SecretAccessKey></AccessKey>", req.form.Get("UserName"))
+	case "ListTopics":
+		result = "<Topics><member><TopicArn>arn:aws:sns:eu-north-1:656975317043:other_requests</TopicArn></member>" +
+			"<member><TopicArn>arn:aws:sns:eu-north-1:656975317043:s3fptest_requests</TopicArn></member></Topics>"
+	}
+	var respBody string
+	if req.service != "s3" {
+		respBody = fmt.Sprintf("<%[1]sResponse><%[1]sResult>%s</%[1]sResult></%[1]sResponse>", req.action, result)
+	}
+	if c.notFound[req.action] {
+		return &http.Response{StatusCode: 404, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("")), Request: r}, nil
+	}
+	return &http.Response{StatusCode: 200, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(respBody)), Request: r}, nil
+}
@@ -0,0 +1,136 @@
+package s3rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+	"strconv"
+)
+
+// protocolVersion is the version of the object header written by this version of s3rpc.
+//
+// Readers accept headers of any version as long as they can read the content,
+// i.e. unknown fields are ignored and only an unsupported content encoding is an error.
+// Writers must therefore only use a new content encoding if the reader has told it supports it.
+const protocolVersion = 1
+
+const (
+	// checksumSHA256 is the only checksum algorithm supported.
+	// Content with a checksum of another algorithm is read unverified.
+	checksumSHA256 = "sha256"
+
+	// encodingIdentity is the only content encoding supported, i.e. no encoding.
+	encodingIdentity = "identity"
+)
+
+// ErrUnsupportedProtocol is returned (wrapped) when reading an object written by
+// a newer version of s3rpc using features this version does not support.
+var ErrUnsupportedProtocol = errors.New("unsupported protocol")
+
+// objectHeader describes the content of an object.
+// It is stored JSON encoded below the metaHeader metadata key.
+type objectHeader struct {
+	// Version is the protocol version of the writer, 0 if written before the header was introduced.
+	Version int `json:"version"`
+
+	// Encoding is the content encoding, empty or encodingIdentity.
+	Encoding string `json:"encoding,omitempty"`
+
+	ChecksumAlgorithm string `json:"checksumAlgorithm,omitempty"`
+	Checksum          string `json:"checksum,omitempty"`
+
+	// Size is the size of the (decoded) content in bytes, -1 if unknown.
+	Size int64 `json:"size"`
+
+	ContentType string `json:"contentType,omitempty"`
+}
+
+// fileHeader returns the header for the content in filename.
+func fileHeader(filename string) (objectHeader, error) {
+	checksum, size, err := fileChecksum(filename)
+	if err != nil {
+		return objectHeader{}, err
+	}
+	return newHeader(checksum, size, mime.TypeByExtension(filepath.Ext(filename))), nil
+}
+
+// bytesHeader returns the header for the content b.
+func bytesHeader(b []byte, contentType string) objectHeader {
+	sum := sha256.Sum256(b)
+	return newHeader(hex.EncodeToString(sum[:]), int64(len(b)), contentType)
+}
+
+func newHeader(checksum string, size int64, contentType string) objectHeader {
+	return objectHeader{
+		Version:           protocolVersion,
+		ChecksumAlgorithm: checksumSHA256,
+		Checksum:          checksum,
+		Size:              size,
+		ContentType:       contentType,
+	}
+}
+
+// metadata returns the s3rpc metadata storing h.
+func (h objectHeader) metadata() map[string]string {
+	b, err := json.Marshal(h)
+	if err != nil {
+		// Only strings and ints.
+		panic(err)
+	}
+	return map[string]string{metaHeader: encodeMetadataValue(string(b))}
+}
+
+// readHeader reads the object header from the s3rpc metadata internal.
+// Objects written before the header was introduced are described by the legacy metadata keys.
+// The checksum is cleared if its algorithm is not supported,
+// and the content is then read unverified.
+func readHeader(internal map[string]string) (objectHeader, error) {
+	v, found := internal[metaHeader]
+	if !found {
+		h := objectHeader{Size: -1}
+		if checksum := internal[metaSHA256]; checksum != "" {
+			h.ChecksumAlgorithm, h.Checksum = checksumSHA256, checksum
+		}
+		if size, err := strconv.ParseInt(internal[metaSize], 10, 64); err == nil {
+			h.Size = size
+		}
+		return h, nil
+	}
+
+	h := objectHeader{Size: -1}
+	if err := json.Unmarshal([]byte(decodeMetadataValue(v)), &h); err != nil {
+		return objectHeader{}, fmt.Errorf("%w: invalid object header: %s", ErrUnsupportedProtocol, err)
+	}
+	if h.Encoding != "" && h.Encoding != encodingIdentity {
+		return objectHeader{}, fmt.Errorf("%w: content encoding %q in version %d header, this is version %d", ErrUnsupportedProtocol, h.Encoding, h.Version, protocolVersion)
+	}
+	if h.ChecksumAlgorithm != checksumSHA256 {
+		h.ChecksumAlgorithm, h.Checksum = "", ""
+	}
+	return h, nil
+}
+
+// putBytes stores b below key with a header and the given s3rpc metadata.
+func (c *common) putBytes(ctx context.Context, key string, b []byte, contentType string, internal map[string]string) error {
+	return c.blobs.Put(ctx, key, bytes.NewReader(b), mergeMetadata(bytesHeader(b, contentType).metadata(), internal))
+}
+
+// readBytes reads body, verified against the header in the s3rpc metadata internal.
+func readBytes(ctx context.Context, body io.Reader, internal map[string]string) ([]byte, error) {
+	h, err := readHeader(internal)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := copyVerified(ctx, &b, body, h.Checksum); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
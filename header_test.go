@@ -0,0 +1,149 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestReadHeader(t *testing.T) {
+	c := qt.New(t)
+
+	header := func(v string) map[string]string {
+		return map[string]string{metaHeader: v}
+	}
+
+	for _, test := range []struct {
+		name     string
+		internal map[string]string
+		expect   objectHeader
+		err      string
+	}{
+		{"Current", bytesHeader([]byte("foo"), "text/plain").metadata(), bytesHeader([]byte("foo"), "text/plain"), ""},
+		{"Legacy", map[string]string{metaSHA256: "abc", metaSize: "3"}, objectHeader{ChecksumAlgorithm: checksumSHA256, Checksum: "abc", Size: 3}, ""},
+		{"LegacyNoChecksum", nil, objectHeader{Size: -1}, ""},
+		{"NewerVersion", header(`{"version":2,"checksumAlgorithm":"sha256","checksum":"abc","size":3,"trailer":"x"}`), objectHeader{Version: 2, ChecksumAlgorithm: checksumSHA256, Checksum: "abc", Size: 3}, ""},
+		{"NewerVersionNoSize", header(`{"version":2}`), objectHeader{Version: 2, Size: -1}, ""},
+		{"Identity", header(`{"version":2,"encoding":"identity","size":3}`), objectHeader{Version: 2, Encoding: encodingIdentity, Size: 3}, ""},
+		{"UnsupportedChecksum", header(`{"version":2,"checksumAlgorithm":"blake3","checksum":"abc","size":3}`), objectHeader{Version: 2, Size: 3}, ""},
+		{"UnsupportedEncoding", header(`{"version":2,"encoding":"zstd","size":3}`), objectHeader{}, `unsupported protocol: content encoding "zstd" in version 2 header, this is version 1`},
+		{"Invalid", header(`{`), objectHeader{}, `unsupported protocol: invalid object header: .*`},
+	} {
+		c.Run(test.name, func(c *qt.C) {
+			h, err := readHeader(test.internal)
+			if test.err != "" {
+				c.Assert(err, qt.ErrorMatches, test.err)
+				c.Assert(errors.Is(err, ErrUnsupportedProtocol), qt.IsTrue)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(h, qt.Equals, test.expect)
+		})
+	}
+}
+
+func TestProtocolVersionMismatch(t *testing.T) {
+	newer := func(h map[string]interface{}) {
+		h["version"] = 2
+		h["trailer"] = "sha256"
+	}
+	newerEncoded := func(h map[string]interface{}) {
+		h["version"] = 2
+		h["encoding"] = "zstd"
+	}
+	legacy := func(h map[string]interface{}) {
+		// Remove the header, writing the legacy keys instead.
+		for k := range h {
+			delete(h, k)
+		}
+	}
+
+	for _, test := range []struct {
+		name string
+		// The side with the newer (or older) version of s3rpc.
+		prefix  string
+		rewrite func(h map[string]interface{})
+		err     string
+	}{
+		{"ServerNewer", toClient, newer, ""},
+		{"ServerNewerUnsupportedEncoding", toClient, newerEncoded, `apply: unsupported protocol: content encoding "zstd".*`},
+		{"ServerOlder", toClient, legacy, ""},
+		{"ClientNewer", toServer, newer, ""},
+		{"ClientNewerUnsupportedEncoding", toServer, newerEncoded, `apply: unsupported protocol: content encoding "zstd".*`},
+		{"ClientOlder", toServer, legacy, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			bus := newMemBus()
+			blobs := newMemBlobStore()
+			rewriting := &headerRewritingBlobStore{BlobStore: blobs, prefix: test.prefix + "/", rewrite: test.rewrite}
+
+			clientBlobs, serverBlobs := BlobStore(blobs), BlobStore(blobs)
+			if test.prefix == toServer {
+				clientBlobs = rewriting
+			} else {
+				serverBlobs = rewriting
+			}
+			client := newTestClient(c, bus, clientBlobs, ClientOptions{})
+			newTestServer(c, bus, serverBlobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}})
+
+			output, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+			if test.err != "" {
+				c.Assert(err, qt.ErrorMatches, test.err)
+				c.Assert(errors.Is(err, ErrUnsupportedProtocol), qt.IsTrue)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			b, err := os.ReadFile(output.Filename)
+			c.Assert(err, qt.IsNil)
+			c.Assert(string(b), qt.Equals, "FOO")
+		})
+	}
+}
+
+// headerRewritingBlobStore rewrites the object headers of the objects stored below prefix,
+// simulating another version of s3rpc.
+// If rewrite removes all fields, the header is replaced with the legacy metadata.
+type headerRewritingBlobStore struct {
+	BlobStore
+	prefix  string
+	rewrite func(h map[string]interface{})
+}
+
+func (b *headerRewritingBlobStore) Put(ctx context.Context, key string, body io.Reader, metadata map[string]string) error {
+	v, found := metadata[metaHeader]
+	if !strings.HasPrefix(key, b.prefix) || !found {
+		return b.BlobStore.Put(ctx, key, body, metadata)
+	}
+	metadata = copyMap(metadata)
+	var h map[string]interface{}
+	if err := json.Unmarshal([]byte(decodeMetadataValue(v)), &h); err != nil {
+		return err
+	}
+	checksum, size := h["checksum"], h["size"]
+	b.rewrite(h)
+	if len(h) == 0 {
+		delete(metadata, metaHeader)
+		metadata[metaSHA256] = checksum.(string)
+		metadata[metaSize] = strconv.FormatInt(int64(size.(float64)), 10)
+		return b.BlobStore.Put(ctx, key, body, metadata)
+	}
+	metadata[metaHeader] = jsonString(h)
+	return b.BlobStore.Put(ctx, key, body, metadata)
+}
+
+func jsonString(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
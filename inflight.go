@@ -0,0 +1,46 @@
+package s3rpc
+
+import (
+	"sort"
+	"time"
+)
+
+// InFlightRequest is a request being handled by a server, see Server.InFlight.
+type InFlightRequest struct {
+	Op string
+	ID string
+
+	// Bucket and Key locate the request's input.
+	Bucket string
+	Key    string
+
+	// Started is when the server started handling the request.
+	Started time.Time
+}
+
+// InFlight returns the requests currently being handled, oldest first,
+// e.g. for a dashboard of the server's activity.
+// It is a snapshot, safe to call concurrently with ListenAndServe.
+func (s *Server) InFlight() []InFlightRequest {
+	s.inflightMu.Lock()
+	requests := make([]InFlightRequest, 0, len(s.inflight))
+	for r := range s.inflight {
+		requests = append(requests, *r)
+	}
+	s.inflightMu.Unlock()
+	sort.Slice(requests, func(i, j int) bool { return requests[i].Started.Before(requests[j].Started) })
+	return requests
+}
+
+// track registers m as in flight until the returned func is called, see InFlight.
+func (s *Server) track(m Message) func() {
+	r := &InFlightRequest{Op: m.Op, ID: m.ID, Bucket: m.Bucket, Key: m.Key, Started: time.Now()}
+	s.inflightMu.Lock()
+	s.inflight[r] = struct{}{}
+	s.inflightMu.Unlock()
+	return func() {
+		s.inflightMu.Lock()
+		delete(s.inflight, r)
+		s.inflightMu.Unlock()
+	}
+}
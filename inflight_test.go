@@ -0,0 +1,51 @@
+package s3rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestServerInFlight(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	started := make(chan struct{})
+	proceed := make(chan struct{})
+	slowHandler := func(ctx context.Context, input Input) (Output, error) {
+		close(started)
+		<-proceed
+		return upperHandler(ctx, input)
+	}
+
+	client := newTestClient(c, bus, blobs, ClientOptions{})
+	server := newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{"slow": slowHandler}})
+	c.Assert(server.InFlight(), qt.HasLen, 0)
+
+	before := time.Now()
+	done := make(chan Output, 1)
+	go func() {
+		output, err := client.Execute(context.Background(), "slow", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+		c.Check(err, qt.IsNil)
+		done <- output
+	}()
+
+	<-started
+	inflight := server.InFlight()
+	c.Assert(inflight, qt.HasLen, 1)
+	r := inflight[0]
+	c.Assert(r.Op, qt.Equals, "slow")
+	c.Assert(r.ID, qt.Not(qt.Equals), "")
+	c.Assert(r.Bucket, qt.Equals, testBucket)
+	c.Assert(r.Key, qt.Equals, "to_server/slow/"+r.ID+"_in.txt")
+	c.Assert(r.Started.Before(before), qt.IsFalse)
+
+	close(proceed)
+	output := <-done
+	c.Assert(output.ID, qt.Equals, r.ID)
+	waitFor(c, func() bool { return len(server.InFlight()) == 0 })
+}
@@ -0,0 +1,123 @@
+package s3rpc
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultKeyTemplate is the default object key layout below the to_server/to_client prefixes.
+const DefaultKeyTemplate = "{op}/{id}_{name}"
+
+var keyPlaceholderRe = regexp.MustCompile(`\{[^}]*\}`)
+
+// keyPlaceholders maps the supported key template placeholders to the pattern used to
+// match them in an object key.
+var keyPlaceholders = map[string]string{
+	"{op}":   `(?P<op>[^/]+)`,
+	"{id}":   `(?P<id>[0-9a-z]{26})`,
+	"{name}": `(?P<name>[^/]+?)`,
+	"{date}": `(?P<date>\d{4}-\d{2}-\d{2})`,
+}
+
+// keyParts are the values used to build an object key.
+type keyParts struct {
+	op   string
+	id   string
+	name string
+
+	// suffix is appended to the key to separate side objects (e.g. progress notifications)
+	// from the main object of a request.
+	// It must start with keySuffixSep.
+	suffix string
+}
+
+// keySuffixSep separates a key suffix from the rest of the key.
+const keySuffixSep = "~"
+
+// keyLayout builds and matches object keys using a key template.
+type keyLayout struct {
+	template string
+	re       *regexp.Regexp
+}
+
+func newKeyLayout(template string) (*keyLayout, error) {
+	if template == "" {
+		template = DefaultKeyTemplate
+	}
+	if !strings.Contains(template, "{id}") {
+		return nil, fmt.Errorf("key template %q must contain {id}", template)
+	}
+	if strings.HasPrefix(template, "/") {
+		return nil, fmt.Errorf("key template %q must not start with a slash", template)
+	}
+
+	var (
+		pattern strings.Builder
+		seen    = make(map[string]bool)
+		last    int
+	)
+	pattern.WriteString(`^(?P<prefix>` + toServer + `|` + toClient + `|` + toClientDirect + `)/`)
+	for _, loc := range keyPlaceholderRe.FindAllStringIndex(template, -1) {
+		placeholder := template[loc[0]:loc[1]]
+		p, found := keyPlaceholders[placeholder]
+		if !found {
+			return nil, fmt.Errorf("key template %q: unknown placeholder %s", template, placeholder)
+		}
+		if seen[placeholder] {
+			return nil, fmt.Errorf("key template %q: placeholder %s used more than once", template, placeholder)
+		}
+		seen[placeholder] = true
+		pattern.WriteString(regexp.QuoteMeta(template[last:loc[0]]))
+		pattern.WriteString(p)
+		last = loc[1]
+	}
+	pattern.WriteString(regexp.QuoteMeta(template[last:]))
+	pattern.WriteString(`(?P<suffix>` + keySuffixSep + `[0-9a-z-]+)?$`)
+
+	re, err := regexp.Compile(pattern.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return &keyLayout{template: template, re: re}, nil
+}
+
+// key builds the object key below prefix (toServer, toClient or toClientDirect).
+func (l *keyLayout) key(prefix string, parts keyParts, now time.Time) string {
+	r := strings.NewReplacer(
+		"{op}", parts.op,
+		"{id}", parts.id,
+		"{name}", parts.name,
+		"{date}", now.UTC().Format("2006-01-02"),
+	)
+	return prefix + "/" + r.Replace(l.template) + parts.suffix
+}
+
+// parse parses key into its prefix (toServer, toClient or toClientDirect) and parts.
+func (l *keyLayout) parse(key string) (string, keyParts, error) {
+	m := l.re.FindStringSubmatch(key)
+	if m == nil {
+		return "", keyParts{}, fmt.Errorf("key %q does not match key template %q", key, l.template)
+	}
+	var (
+		prefix string
+		parts  keyParts
+	)
+	for i, name := range l.re.SubexpNames() {
+		switch name {
+		case "prefix":
+			prefix = m[i]
+		case "op":
+			parts.op = m[i]
+		case "id":
+			parts.id = m[i]
+		case "name":
+			parts.name = m[i]
+		case "suffix":
+			parts.suffix = m[i]
+		}
+	}
+	return prefix, parts, nil
+}
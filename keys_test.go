@@ -0,0 +1,102 @@
+package s3rpc
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+const testID = "01gd0m5k5kh5vm3kfr3qmdq4zs"
+
+func TestKeyLayout(t *testing.T) {
+	c := qt.New(t)
+
+	now := time.Date(2022, 9, 14, 23, 30, 0, 0, time.UTC)
+	parts := keyParts{op: "upper", id: testID, name: "in_1.txt"}
+
+	l, err := newKeyLayout("")
+	c.Assert(err, qt.IsNil)
+	key := l.key(toServer, parts, now)
+	c.Assert(key, qt.Equals, "to_server/upper/"+testID+"_in_1.txt")
+	prefix, parsed, err := l.parse(key)
+	c.Assert(err, qt.IsNil)
+	c.Assert(prefix, qt.Equals, toServer)
+	c.Assert(parsed, qt.Equals, parts)
+
+	l, err = newKeyLayout("{date}/{op}/{id}/{name}")
+	c.Assert(err, qt.IsNil)
+	key = l.key(toClient, parts, now)
+	c.Assert(key, qt.Equals, "to_client/2022-09-14/upper/"+testID+"/in_1.txt")
+	prefix, parsed, err = l.parse(key)
+	c.Assert(err, qt.IsNil)
+	c.Assert(prefix, qt.Equals, toClient)
+	c.Assert(parsed, qt.Equals, parts)
+
+	parts.suffix = "~progress-1"
+	key = l.key(toClient, parts, now)
+	c.Assert(key, qt.Equals, "to_client/2022-09-14/upper/"+testID+"/in_1.txt~progress-1")
+	_, parsed, err = l.parse(key)
+	c.Assert(err, qt.IsNil)
+	c.Assert(parsed, qt.Equals, parts)
+
+	l, err = newKeyLayout("{op}/{id}")
+	c.Assert(err, qt.IsNil)
+	key = l.key(toClient, parts, now)
+	c.Assert(key, qt.Equals, "to_client/upper/"+testID+"~progress-1")
+	_, parsed, err = l.parse(key)
+	c.Assert(err, qt.IsNil)
+	c.Assert(parsed.id, qt.Equals, testID)
+	c.Assert(parsed.suffix, qt.Equals, "~progress-1")
+
+	_, _, err = l.parse("to_client/upper/" + testID + "_in.txt")
+	c.Assert(err, qt.ErrorMatches, "key .* does not match key template .*")
+}
+
+func TestKeyLayoutValidation(t *testing.T) {
+	c := qt.New(t)
+
+	_, err := newKeyLayout("{op}/{name}")
+	c.Assert(err, qt.ErrorMatches, `key template .* must contain {id}`)
+	_, err = newKeyLayout("{op}/{id}/{foo}")
+	c.Assert(err, qt.ErrorMatches, `key template .* unknown placeholder {foo}`)
+	_, err = newKeyLayout("{id}/{id}")
+	c.Assert(err, qt.ErrorMatches, `key template .* used more than once`)
+
+	_, err = NewServer(ServerOptions{
+		Notifier:  newMemBus().notifier(toServer),
+		BlobStore: newMemBlobStore(),
+		AWSConfig: AWSConfig{KeyTemplate: "{id}_{name}"},
+	})
+	c.Assert(err, qt.ErrorMatches, `key template .* must contain {op}`)
+}
+
+func TestExecuteDatePartitionedKeyTemplate(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+	serverBlobs := &hookBlobStore{BlobStore: blobs}
+	template := "{date}/{op}/{id}_{name}"
+	today := time.Now().UTC().Format("2006-01-02")
+
+	var inputKey string
+	serverBlobs.onGet = func(key string) {
+		if strings.HasPrefix(key, toServer) {
+			inputKey = key
+		}
+	}
+
+	client := newTestClient(c, bus, blobs, ClientOptions{AWSConfig: AWSConfig{KeyTemplate: template}})
+	newTestServer(c, bus, serverBlobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}, AWSConfig: AWSConfig{KeyTemplate: template}})
+
+	output, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.IsNil)
+	b, err := os.ReadFile(output.Filename)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "FOO")
+	c.Assert(strings.HasPrefix(inputKey, toServer+"/"+today+"/upper/"), qt.IsTrue, qt.Commentf("key %q", inputKey))
+}
@@ -0,0 +1,71 @@
+package s3rpc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// logPrefix is the key prefix of the captured handler logs, see ServerOptions.CaptureHandlerLogs.
+const logPrefix = "logs"
+
+// logKey returns the key of the captured handler log of the request with the given ID.
+// It does not depend on the key template, so the client only needs the request ID to find it.
+func logKey(id string) string {
+	return logPrefix + "/" + id + ".log"
+}
+
+type handlerLogKey struct{}
+
+// HandlerLog returns a writer for log output of the request handled with ctx.
+// If ServerOptions.CaptureHandlerLogs is set, the output is stored in the bucket
+// once the handler returns, see Client.FetchLog.
+// Otherwise, or if ctx is not a handler context, the output is discarded.
+func HandlerLog(ctx context.Context) io.Writer {
+	if l, ok := ctx.Value(handlerLogKey{}).(*handlerLog); ok {
+		return l
+	}
+	return io.Discard
+}
+
+// handlerLog is the captured log output of a handler invocation.
+// Handlers may write to it from multiple goroutines.
+type handlerLog struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *handlerLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *handlerLog) bytes() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]byte(nil), l.buf.Bytes()...)
+}
+
+// storeLog stores the captured log of the request with the given ID.
+// This is best effort; a failure is logged, but does not fail the request.
+func (s *Server) storeLog(ctx context.Context, id string, l *handlerLog) {
+	if err := s.putBytes(ctx, logKey(id), l.bytes(), "text/plain; charset=utf-8", nil); err != nil {
+		s.infof("Failed to store handler log for %q: %s", id, err)
+	}
+}
+
+// FetchLog fetches the handler log of the request with the given ID, see Output.ID.
+// It requires a server with ServerOptions.CaptureHandlerLogs set.
+// The log is stored once the handler returns, also if it fails.
+func (c *Client) FetchLog(ctx context.Context, id string) ([]byte, error) {
+	body, metadata, err := c.blobs.Get(ctx, logKey(id))
+	if err != nil {
+		return nil, fmt.Errorf("fetch log: %w", err)
+	}
+	defer body.Close()
+	_, internal := splitMetadata(metadata)
+	return readBytes(ctx, body, internal)
+}
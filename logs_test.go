@@ -0,0 +1,45 @@
+package s3rpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestCaptureHandlerLogs(t *testing.T) {
+	c := qt.New(t)
+
+	handlers := Handlers{
+		"upper": func(ctx context.Context, input Input) (Output, error) {
+			fmt.Fprintf(HandlerLog(ctx), "handling %s\n", RequestIDFromContext(ctx))
+			return upperHandler(ctx, input)
+		},
+	}
+
+	for _, capture := range []bool{false, true} {
+		c.Run(fmt.Sprintf("capture=%t", capture), func(c *qt.C) {
+			bus := newMemBus()
+			blobs := newMemBlobStore()
+
+			client := newTestClient(c, bus, blobs, ClientOptions{})
+			newTestServer(c, bus, blobs, ServerOptions{Handlers: handlers, CaptureHandlerLogs: capture})
+
+			output, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+			c.Assert(err, qt.IsNil)
+			c.Assert(output.ID, qt.Not(qt.Equals), "")
+
+			b, err := client.FetchLog(context.Background(), output.ID)
+			if !capture {
+				c.Assert(err, qt.ErrorMatches, "fetch log: logs/.*: not found")
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(string(b), qt.Equals, fmt.Sprintf("handling %s\n", output.ID))
+		})
+	}
+
+	c.Assert(HandlerLog(context.Background()), qt.Equals, io.Discard)
+}
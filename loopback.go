@@ -0,0 +1,129 @@
+package s3rpc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// loopbackBucket is the bucket name used in loopback mode.
+	loopbackBucket = "loopback"
+
+	// loopbackRequeueDelay is how long a response released by the client
+	// waits before it is delivered again in loopback mode.
+	loopbackRequeueDelay = 10 * time.Millisecond
+)
+
+// NewLoopback creates a client and a server wired together in-process, without any AWS,
+// e.g. to exercise real handler code in unit tests or during local development.
+//
+// Inputs and outputs are stored in memory and downloaded to temporary files as usual,
+// so the handlers see the same Input (metadata and filenames) as behind S3 and SQS.
+// Execute calls the handler synchronously and, unlike with a real server,
+// fails with the handler's error if it fails, and fails right away for an op without a handler.
+// ClientOptions.Timeout does not apply, use the context passed to Execute.
+//
+// Close both the client and the server when done.
+func NewLoopback(handlers Handlers) (*Client, *Server, error) {
+	// Like S3, the metadata keys are stored in lower case.
+	l := &loopback{blobs: &memBlobStore{lowerCaseKeys: true, objects: make(map[string]memObject)}, responses: make(chan Note, 1000)}
+	infof := func(format string, args ...interface{}) {}
+
+	server, err := NewServer(ServerOptions{
+		Handlers:  handlers,
+		Notifier:  l,
+		BlobStore: l.blobs,
+		Infof:     infof,
+		AWSConfig: AWSConfig{Bucket: loopbackBucket},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	l.server = server
+
+	client, err := NewClient(ClientOptions{
+		Notifier:  l,
+		BlobStore: l.blobs,
+		Infof:     infof,
+		AWSConfig: AWSConfig{Bucket: loopbackBucket},
+	})
+	if err != nil {
+		server.Close()
+		return nil, nil, err
+	}
+	l.client = client
+
+	return client, server, nil
+}
+
+// loopback is the Notifier of both the client and the server in loopback mode.
+// Requests are handled synchronously when sent, and responses are queued for the client.
+type loopback struct {
+	server    *Server
+	client    *Client
+	blobs     *memBlobStore
+	responses chan Note
+}
+
+func (l *loopback) Send(ctx context.Context, note Note) error {
+	if strings.HasPrefix(note.Key, toServer+"/") {
+		err := l.server.handleMessage(ctx, l.server.newMessage(l, note))
+		if err != nil {
+			// The request is not delivered again, so it is done.
+			_ = l.blobs.Delete(ctx, note.Key)
+		}
+		return err
+	}
+	select {
+	case l.responses <- note:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *loopback) Receive(ctx context.Context) ([]Note, error) {
+	select {
+	case note := <-l.responses:
+		return []Note{note}, nil
+	case <-time.After(time.Second):
+		return nil, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *loopback) Ack(ctx context.Context, note Note) error {
+	return nil
+}
+
+func (l *loopback) Nack(ctx context.Context, note Note) error {
+	if strings.HasPrefix(note.Key, toServer+"/") {
+		// There is no other server to deliver the request to.
+		return fmt.Errorf("request %q not handled, is there a handler for the op?", note.Key)
+	}
+	m := l.client.newMessage(l, note)
+	if m.Err() != nil || !l.client.dispatcher.waiting(m.ID) {
+		// There is no other client to deliver the response to, e.g. the caller gave up.
+		_ = l.blobs.Delete(ctx, note.Key)
+		return nil
+	}
+	// The waiter is busy. Nack is called by the client's poller,
+	// so queue the response again later without blocking it.
+	l.requeue(note)
+	return nil
+}
+
+// requeue queues the response note again after loopbackRequeueDelay.
+func (l *loopback) requeue(note Note) {
+	time.AfterFunc(loopbackRequeueDelay, func() {
+		select {
+		case l.responses <- note:
+		default:
+			// Full; try again later.
+			l.requeue(note)
+		}
+	})
+}
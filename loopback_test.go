@@ -0,0 +1,90 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestLoopback(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	var got Input
+	client, server, err := NewLoopback(Handlers{
+		"upper": func(ctx context.Context, input Input) (Output, error) {
+			got = input
+			output, err := upperHandler(ctx, input)
+			output.Metadata = map[string]string{"Lang": input.Metadata["Lang"]}
+			return output, err
+		},
+		"fail": func(ctx context.Context, input Input) (Output, error) {
+			return Output{}, errors.New("boom")
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	defer server.Close()
+	defer client.Close()
+
+	output, err := client.Execute(ctx, "upper", Input{Filename: writeTestFile(c, "in.txt", "foo"), Metadata: map[string]string{"Lang": "en"}})
+	c.Assert(err, qt.IsNil)
+	b, err := os.ReadFile(output.Filename)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "FOO")
+	c.Assert(output.Metadata, qt.DeepEquals, map[string]string{"Lang": "en"})
+
+	// Same as behind S3 and SQS.
+	c.Assert(got.Metadata, qt.DeepEquals, map[string]string{"Lang": "en"})
+	c.Assert(strings.HasSuffix(got.Filename, "_in.txt"), qt.IsTrue)
+	c.Assert(strings.HasPrefix(filepath.Base(output.Filename), output.ID+"_"), qt.IsTrue)
+	c.Assert(strings.HasSuffix(output.Filename, "_in.txt"), qt.IsTrue)
+
+	_, err = client.Execute(ctx, "fail", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.ErrorMatches, "apply: handle: boom")
+	_, err = client.Execute(ctx, "unknown", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.ErrorMatches, `apply: request "to_server/unknown/.*_in.txt" not handled, is there a handler for the op\?`)
+
+	// Nothing left behind.
+	c.Assert(client.blobs.(*memBlobStore).keys(), qt.HasLen, 0)
+}
+
+func TestLoopbackNack(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	client, server, err := NewLoopback(Handlers{"upper": upperHandler})
+	c.Assert(err, qt.IsNil)
+	defer server.Close()
+	defer client.Close()
+
+	l := client.notifier.(*loopback)
+	blobs := client.blobs.(*memBlobStore)
+	note := func(id string) Note {
+		key := "to_client/upper/" + id + "_in.txt"
+		c.Assert(blobs.Put(ctx, key, strings.NewReader("FOO"), nil), qt.IsNil)
+		return Note{Bucket: loopbackBucket, Key: key}
+	}
+
+	// Nobody waits for the response, so it is dropped.
+	orphan := note("01gd0m5k5kh5vm3kfr3qmdq4zs")
+	c.Assert(l.Nack(ctx, orphan), qt.IsNil)
+	c.Assert(blobs.has(orphan.Key), qt.IsFalse)
+	c.Assert(l.responses, qt.HasLen, 0)
+
+	// Released while its waiter is busy, the response is queued again later,
+	// without blocking the poller even if the queue is full.
+	const id = "01gd0m5k5kh5vm3kfr3qmdq4zt"
+	_, unregister := client.dispatcher.register(id)
+	defer unregister()
+	for i := 0; i < cap(l.responses); i++ {
+		l.responses <- Note{}
+	}
+	busy := note(id)
+	c.Assert(l.Nack(ctx, busy), qt.IsNil)
+	c.Assert(blobs.has(busy.Key), qt.IsTrue)
+}
@@ -0,0 +1,113 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// manifestKey is the key of the manifest published by the servers, see Server.PublishManifest.
+// It does not depend on the key template, so the client finds it without knowing the server's options.
+const manifestKey = "manifest.json"
+
+// ErrUnsupportedOp is returned (wrapped) by Manifest.CheckOp if the op is not supported.
+var ErrUnsupportedOp = errors.New("unsupported op")
+
+// Manifest describes what a server supports, see Server.PublishManifest and Client.Capabilities.
+type Manifest struct {
+	// ProtocolVersion is the s3rpc protocol version of the server.
+	ProtocolVersion int `json:"protocolVersion"`
+
+	// Ops maps the ops the server has a handler for to their metadata, see OpConfig.Metadata.
+	Ops map[string]OpManifest `json:"ops"`
+
+	// PublishedAt is when the manifest was published.
+	PublishedAt time.Time `json:"publishedAt"`
+}
+
+// OpManifest describes an op in a Manifest.
+type OpManifest struct {
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Supports reports whether op has a handler.
+func (m Manifest) Supports(op string) bool {
+	_, found := m.Ops[op]
+	return found
+}
+
+// CheckOp returns an error wrapping ErrUnsupportedOp if op has no handler,
+// e.g. to fail fast before uploading the input.
+func (m Manifest) CheckOp(op string) error {
+	if !m.Supports(op) {
+		return fmt.Errorf("%w %q, manifest published at %s", ErrUnsupportedOp, op, m.PublishedAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// manifest returns the server's current manifest.
+func (s *Server) manifest() Manifest {
+	s.handlersMu.RLock()
+	defer s.handlersMu.RUnlock()
+	m := Manifest{ProtocolVersion: protocolVersion, Ops: make(map[string]OpManifest, len(s.handlers)), PublishedAt: time.Now().UTC()}
+	for op := range s.handlers {
+		m.Ops[op] = OpManifest{Metadata: s.opConfigs[op].Metadata}
+	}
+	return m
+}
+
+// PublishManifest stores the server's manifest in the bucket, to be fetched with Client.Capabilities.
+// It lists the ops the server currently has a handler for, so call it again after Handle or Remove,
+// or set ServerOptions.ManifestInterval.
+// The servers sharing a bucket share the manifest, so the last one to publish wins;
+// during a rollout of a new op, the manifest may list it before all servers have it.
+func (s *Server) PublishManifest(ctx context.Context) error {
+	b, err := json.Marshal(s.manifest())
+	if err != nil {
+		return err
+	}
+	if err := s.putBytes(ctx, manifestKey, b, "application/json", nil); err != nil {
+		return fmt.Errorf("publish manifest: %w", err)
+	}
+	return nil
+}
+
+// publishManifests publishes the manifest every ManifestInterval until ctx is done or the server is closed.
+// This is best effort; failures are logged.
+func (s *Server) publishManifests(ctx context.Context) {
+	ticker := time.NewTicker(s.manifestInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.PublishManifest(ctx); err != nil && ctx.Err() == nil {
+			s.infof("Failed to publish manifest: %s", err)
+		}
+		select {
+		case <-s.quit:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Capabilities fetches the manifest published by the servers, see Server.PublishManifest.
+func (c *Client) Capabilities(ctx context.Context) (Manifest, error) {
+	body, metadata, err := c.blobs.Get(ctx, manifestKey)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("capabilities: %w", err)
+	}
+	defer body.Close()
+	_, internal := splitMetadata(metadata)
+	b, err := readBytes(ctx, body, internal)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("capabilities: %w", err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return Manifest{}, fmt.Errorf("capabilities: %w", err)
+	}
+	return m, nil
+}
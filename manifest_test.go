@@ -0,0 +1,76 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestCapabilities(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+	client := newTestClient(c, bus, blobs, ClientOptions{})
+
+	_, err := client.Capabilities(ctx)
+	c.Assert(err, qt.ErrorMatches, "capabilities: manifest.json: not found")
+
+	server := newTestServer(c, bus, blobs, ServerOptions{
+		Handlers: Handlers{"upper": upperHandler},
+		Ops:      map[string]OpConfig{"upper": {Metadata: map[string]string{"version": "v2"}}},
+	})
+
+	// No ManifestInterval, so only published on demand.
+	c.Assert(blobs.has(manifestKey), qt.IsFalse)
+	c.Assert(server.PublishManifest(ctx), qt.IsNil)
+
+	m, err := client.Capabilities(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(m.ProtocolVersion, qt.Equals, protocolVersion)
+	c.Assert(m.Ops, qt.DeepEquals, map[string]OpManifest{"upper": {Metadata: map[string]string{"version": "v2"}}})
+	c.Assert(m.PublishedAt.IsZero(), qt.IsFalse)
+	c.Assert(m.Supports("upper"), qt.IsTrue)
+	c.Assert(m.CheckOp("upper"), qt.IsNil)
+	err = m.CheckOp("lower")
+	c.Assert(errors.Is(err, ErrUnsupportedOp), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, `unsupported op "lower", manifest published at .*`)
+}
+
+func TestServerManifestInterval(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+	client := newTestClient(c, bus, blobs, ClientOptions{})
+	server := newTestServer(c, bus, blobs, ServerOptions{
+		Handlers:         Handlers{"upper": upperHandler},
+		ManifestInterval: 10 * time.Millisecond,
+	})
+
+	supports := func(op string) func() bool {
+		return func() bool {
+			m, err := client.Capabilities(ctx)
+			return err == nil && m.Supports(op)
+		}
+	}
+
+	waitFor(c, supports("upper"))
+	server.Handle("lower", upperHandler)
+	waitFor(c, supports("lower"))
+
+	// Shadow servers do not publish.
+	shadowBlobs := newMemBlobStore()
+	newTestServer(c, newMemBus(), shadowBlobs, ServerOptions{
+		Handlers:         Handlers{"upper": upperHandler},
+		ManifestInterval: time.Millisecond,
+		Shadow:           true,
+	})
+	time.Sleep(20 * time.Millisecond)
+	c.Assert(shadowBlobs.has(manifestKey), qt.IsFalse)
+}
@@ -0,0 +1,127 @@
+package s3rpc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memBlobStore is an in-memory BlobStore, used in loopback mode and in tests.
+type memBlobStore struct {
+	// lowerCaseKeys, if set, stores the metadata keys in lower case, like S3.
+	lowerCaseKeys bool
+
+	mu      sync.Mutex
+	objects map[string]memObject
+}
+
+type memObject struct {
+	data     []byte
+	metadata map[string]string
+	modified time.Time
+}
+
+func newMemBlobStore() *memBlobStore {
+	return &memBlobStore{objects: make(map[string]memObject)}
+}
+
+func (b *memBlobStore) Put(ctx context.Context, key string, body io.Reader, metadata map[string]string) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	metadata = copyMap(metadata)
+	if b.lowerCaseKeys {
+		m := make(map[string]string, len(metadata))
+		for k, v := range metadata {
+			m[strings.ToLower(k)] = v
+		}
+		metadata = m
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[key] = memObject{data: data, metadata: metadata, modified: time.Now()}
+	return nil
+}
+
+func (b *memBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, map[string]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o, found := b.objects[key]
+	if !found {
+		return nil, nil, fmt.Errorf("%s: not found", key)
+	}
+	return io.NopCloser(bytes.NewReader(o.data)), copyMap(o.metadata), nil
+}
+
+func (b *memBlobStore) Stat(ctx context.Context, key string) (map[string]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o, found := b.objects[key]
+	if !found {
+		return nil, fmt.Errorf("%s: not found", key)
+	}
+	return copyMap(o.metadata), nil
+}
+
+func (b *memBlobStore) Delete(ctx context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.objects, key)
+	return nil
+}
+
+func (b *memBlobStore) ListObjects(ctx context.Context, prefix string, fn func(key string, lastModified time.Time) error) error {
+	for _, key := range b.keys() {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		b.mu.Lock()
+		o, found := b.objects[key]
+		b.mu.Unlock()
+		if !found {
+			continue
+		}
+		if err := fn(key, o.modified); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *memBlobStore) DeleteObjects(ctx context.Context, keys []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, key := range keys {
+		delete(b.objects, key)
+	}
+	return nil
+}
+
+// keys returns the keys of the objects stored, sorted.
+func (b *memBlobStore) keys() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var keys []string
+	for k := range b.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func copyMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,399 @@
+package s3rpc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+const testBucket = "s3rpctest"
+
+// age sets the last modified time of the object stored below key to d ago.
+func (b *memBlobStore) age(key string, d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o := b.objects[key]
+	o.modified = time.Now().Add(-d)
+	b.objects[key] = o
+}
+
+func (b *memBlobStore) has(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, found := b.objects[key]
+	return found
+}
+
+// hookBlobStore wraps a BlobStore, records deletes and allows injecting behavior.
+type hookBlobStore struct {
+	BlobStore
+
+	onGet func(key string)
+
+	mu      sync.Mutex
+	deleted []string
+}
+
+func (b *hookBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, map[string]string, error) {
+	if b.onGet != nil {
+		b.onGet(key)
+	}
+	return b.BlobStore.Get(ctx, key)
+}
+
+func (b *hookBlobStore) Delete(ctx context.Context, key string) error {
+	b.mu.Lock()
+	b.deleted = append(b.deleted, key)
+	b.mu.Unlock()
+	return b.BlobStore.Delete(ctx, key)
+}
+
+func (b *hookBlobStore) deletedKeys() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.deleted...)
+}
+
+// slowBlobStore wraps a BlobStore and transfers data slowly, ignoring the context,
+// to simulate a large transfer.
+type slowBlobStore struct {
+	BlobStore
+}
+
+func (b *slowBlobStore) Put(ctx context.Context, key string, body io.Reader, metadata map[string]string) error {
+	data, err := io.ReadAll(&slowReader{r: body})
+	if err != nil {
+		return err
+	}
+	return b.BlobStore.Put(ctx, key, bytes.NewReader(data), metadata)
+}
+
+func (b *slowBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, map[string]string, error) {
+	body, metadata, err := b.BlobStore.Get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return io.NopCloser(&slowReader{r: body}), metadata, nil
+}
+
+// slowReader reads one small chunk at a time with a delay.
+type slowReader struct {
+	r io.Reader
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	if len(p) > 1024 {
+		p = p[:1024]
+	}
+	return r.r.Read(p)
+}
+
+// memBus routes notes to a queue named by the first path segment of the key,
+// which mirrors how the bucket event notifications are set up.
+type memBus struct {
+	mu     sync.Mutex
+	queues map[string]*memQueue
+}
+
+func newMemBus() *memBus {
+	return &memBus{queues: make(map[string]*memQueue)}
+}
+
+func (b *memBus) queue(name string) *memQueue {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, found := b.queues[name]
+	if !found {
+		q = &memQueue{inflight: make(map[string]Note)}
+		b.queues[name] = q
+	}
+	return q
+}
+
+// notifier returns a Notifier receiving from the queue with the given name.
+func (b *memBus) notifier(name string) *memNotifier {
+	return &memNotifier{bus: b, queue: name}
+}
+
+type memQueue struct {
+	mu       sync.Mutex
+	counter  int
+	pending  []Note
+	inflight map[string]Note
+}
+
+func (q *memQueue) push(note Note) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = append(q.pending, note)
+}
+
+func (q *memQueue) pop(max int) []Note {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var notes []Note
+	for len(q.pending) > 0 && len(notes) < max {
+		note := q.pending[0]
+		q.pending = q.pending[1:]
+		q.counter++
+		note.ReceiptHandle = strconv.Itoa(q.counter)
+		q.inflight[note.ReceiptHandle] = note
+		notes = append(notes, note)
+	}
+	return notes
+}
+
+func (q *memQueue) ack(receiptHandle string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, found := q.inflight[receiptHandle]; !found {
+		return fmt.Errorf("receipt handle %q not found", receiptHandle)
+	}
+	delete(q.inflight, receiptHandle)
+	return nil
+}
+
+func (q *memQueue) nack(receiptHandle string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	note, found := q.inflight[receiptHandle]
+	if !found {
+		return fmt.Errorf("receipt handle %q not found", receiptHandle)
+	}
+	delete(q.inflight, receiptHandle)
+	note.ReceiptHandle = ""
+	q.pending = append(q.pending, note)
+	return nil
+}
+
+// expire makes all in-flight notes visible again, as if their visibility timeout expired.
+func (q *memQueue) expire() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for receiptHandle, note := range q.inflight {
+		delete(q.inflight, receiptHandle)
+		note.ReceiptHandle = ""
+		q.pending = append(q.pending, note)
+	}
+}
+
+func (q *memQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending) + len(q.inflight)
+}
+
+type memNotifier struct {
+	bus   *memBus
+	queue string
+}
+
+func (n *memNotifier) Send(ctx context.Context, note Note) error {
+	name, _, _ := strings.Cut(note.Key, "/")
+	n.bus.queue(name).push(note)
+	return nil
+}
+
+func (n *memNotifier) SendTo(ctx context.Context, queue string, note Note) error {
+	n.bus.queue(queue).push(note)
+	return nil
+}
+
+func (n *memNotifier) Receive(ctx context.Context) ([]Note, error) {
+	q := n.bus.queue(n.queue)
+	deadline := time.Now().Add(50 * time.Millisecond)
+	for {
+		if notes := q.pop(5); len(notes) > 0 {
+			return notes, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(2 * time.Millisecond):
+		}
+	}
+}
+
+func (n *memNotifier) Ack(ctx context.Context, note Note) error {
+	return n.bus.queue(n.queue).ack(note.ReceiptHandle)
+}
+
+func (n *memNotifier) Nack(ctx context.Context, note Note) error {
+	return n.bus.queue(n.queue).nack(note.ReceiptHandle)
+}
+
+func (n *memNotifier) Extend(ctx context.Context, note Note, d time.Duration) error {
+	q := n.bus.queue(n.queue)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, found := q.inflight[note.ReceiptHandle]; !found {
+		return fmt.Errorf("receipt handle %q not found", note.ReceiptHandle)
+	}
+	return nil
+}
+
+// failingNotifier wraps a Notifier and makes the first failures calls to Receive fail with err.
+type failingNotifier struct {
+	Notifier
+	err error
+
+	mu       sync.Mutex
+	failures int
+	calls    int
+}
+
+func (n *failingNotifier) Receive(ctx context.Context) ([]Note, error) {
+	n.mu.Lock()
+	n.calls++
+	fail := n.calls <= n.failures
+	n.mu.Unlock()
+	if fail {
+		return nil, n.err
+	}
+	return n.Notifier.Receive(ctx)
+}
+
+func (n *failingNotifier) receiveCalls() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.calls
+}
+
+// countingNotifier wraps a Notifier and tracks the number of concurrent Receive calls.
+type countingNotifier struct {
+	Notifier
+
+	mu          sync.Mutex
+	active, max int
+}
+
+func (n *countingNotifier) Receive(ctx context.Context) ([]Note, error) {
+	n.mu.Lock()
+	n.active++
+	if n.active > n.max {
+		n.max = n.active
+	}
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		n.active--
+		n.mu.Unlock()
+	}()
+	return n.Notifier.Receive(ctx)
+}
+
+func (n *countingNotifier) maxReceivers() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.max
+}
+
+func noopInfof(format string, args ...interface{}) {}
+
+// newTestClient creates a new client using in-memory transports.
+// Zero values in opts are replaced with test defaults.
+func newTestClient(c *qt.C, bus *memBus, blobs BlobStore, opts ClientOptions) *Client {
+	if opts.Bucket == "" {
+		opts.Bucket = testBucket
+	}
+	if opts.Notifier == nil && len(opts.ReplyEndpoints) == 0 {
+		opts.Notifier = bus.notifier(toClient)
+	}
+	if opts.BlobStore == nil {
+		opts.BlobStore = blobs
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.Infof == nil {
+		opts.Infof = noopInfof
+	}
+	client, err := NewClient(opts)
+	c.Assert(err, qt.IsNil)
+	c.Cleanup(func() { client.Close() })
+	return client
+}
+
+// newTestServer creates and starts a new server using in-memory transports.
+// Zero values in opts are replaced with test defaults.
+func newTestServer(c *qt.C, bus *memBus, blobs BlobStore, opts ServerOptions) *Server {
+	if opts.Bucket == "" {
+		opts.Bucket = testBucket
+	}
+	if opts.Notifier == nil {
+		opts.Notifier = bus.notifier(toServer)
+	}
+	if opts.BlobStore == nil {
+		opts.BlobStore = blobs
+	}
+	if opts.PollInterval == 0 {
+		opts.PollInterval = time.Millisecond
+	}
+	if opts.Infof == nil {
+		opts.Infof = noopInfof
+	}
+	server, err := NewServer(opts)
+	c.Assert(err, qt.IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ListenAndServe(ctx)
+	}()
+	c.Cleanup(func() {
+		cancel()
+		server.Close()
+		<-done
+	})
+	return server
+}
+
+// writeTestFile writes content to a new file in a temporary directory and returns its filename.
+func writeTestFile(c *qt.C, name, content string) string {
+	return writeTestFileIn(c, c.TempDir(), name, content)
+}
+
+// writeTestFileIn writes content to a new file in dir and returns its filename.
+func writeTestFileIn(c *qt.C, dir, name, content string) string {
+	filename := filepath.Join(dir, name)
+	c.Assert(os.WriteFile(filename, []byte(content), 0644), qt.IsNil)
+	return filename
+}
+
+// upperHandler returns the input upper cased.
+func upperHandler(ctx context.Context, input Input) (Output, error) {
+	b, err := os.ReadFile(input.Filename)
+	if err != nil {
+		return Output{}, err
+	}
+	filename := input.Filename + ".upper"
+	if err := os.WriteFile(filename, bytes.ToUpper(b), 0644); err != nil {
+		return Output{}, err
+	}
+	return Output{Filename: filename, Metadata: input.Metadata}, nil
+}
+
+// waitFor waits for cond to become true, failing the test after a few seconds.
+func waitFor(c *qt.C, cond func() bool) {
+	c.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			c.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,121 @@
+package s3rpc
+
+import (
+	"context"
+	"fmt"
+)
+
+// Message is a notification received by a Client or a Server, see Receive.
+//
+// Receive, DeleteMessage and ReleaseMessage are the primitives the Client and Server dispatch
+// loops are built on, and they can be used to build custom dispatch loops.
+type Message struct {
+	Note
+
+	// Op and ID are the op and request ID encoded in Key.
+	// They are empty if Key does not match the key template, see Err.
+	// For requests received by a server, Op is the op resolved by ServerOptions.ResolveOp, if set.
+	Op string
+	ID string
+
+	// Request reports whether this is a request to a server (as opposed to a response to a client).
+	Request bool
+
+	parts keyParts
+	err   error
+
+	// unresolved is set for requests ServerOptions.ResolveOp resolved no op for.
+	unresolved bool
+
+	// The notifier the message was received from.
+	notifier Notifier
+}
+
+// Err returns a non-nil error if the message's key does not match the key template.
+// Such messages are typically not meant for s3rpc and should be released.
+func (m Message) Err() error {
+	return m.err
+}
+
+// Receive receives the next batch of messages from the Notifier.
+// It may block for some time waiting for messages to arrive, and it is not an error to return none.
+// A server with multiple notifiers returns the messages from the highest priority notifier
+// with any messages available, see ServerOptions.Queues.
+//
+// Every message received must either be deleted with DeleteMessage once processed,
+// or released with ReleaseMessage so it can be delivered again, possibly to another receiver.
+func (c *common) Receive(ctx context.Context) ([]Message, error) {
+	receivers := c.receivers
+	if len(receivers) == 0 {
+		receivers = []Notifier{c.notifier}
+	}
+	return c.receiveFrom(ctx, receivers)
+}
+
+// receiveFrom receives the next batch of messages from the first of receivers with any available.
+func (c *common) receiveFrom(ctx context.Context, receivers []Notifier) ([]Message, error) {
+	for _, n := range receivers {
+		notes, err := n.Receive(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(notes) == 0 {
+			continue
+		}
+		ms := make([]Message, len(notes))
+		for i, note := range notes {
+			ms[i] = c.newMessage(n, note)
+		}
+		return ms, nil
+	}
+	return nil, nil
+}
+
+// DeleteMessage deletes m from the queue so it is not delivered again.
+// Note that this does not delete the object m refers to.
+func (c *common) DeleteMessage(ctx context.Context, m Message) error {
+	return m.source(c).Ack(ctx, m.Note)
+}
+
+// ReleaseMessage releases m so it can be delivered again, possibly to another receiver.
+// See ClientOptions.ReleaseVisibility for how soon.
+func (c *common) ReleaseMessage(ctx context.Context, m Message) error {
+	n := m.source(c)
+	if c.releaseVisibility > 0 {
+		if e, ok := n.(VisibilityExtender); ok {
+			return e.Extend(ctx, m.Note, c.releaseVisibility)
+		}
+	}
+	return n.Nack(ctx, m.Note)
+}
+
+// source returns the notifier m was received from.
+func (m Message) source(c *common) Notifier {
+	if m.notifier != nil {
+		return m.notifier
+	}
+	return c.notifier
+}
+
+func (c *common) newMessage(n Notifier, note Note) Message {
+	m := Message{Note: note, notifier: n}
+	if note.Bucket != c.bucket {
+		m.err = fmt.Errorf("expected bucket %q, got %q", c.bucket, note.Bucket)
+		return m
+	}
+	prefix, parts, err := c.keys.parse(note.Key)
+	if err != nil {
+		m.err = err
+		return m
+	}
+	m.Op, m.ID, m.Request = parts.op, parts.id, prefix == toServer
+	m.parts = parts
+	if c.resolveOp != nil && m.Request && !isProbeKey(m.Key) {
+		op, ok := c.resolveOp(m)
+		if !ok {
+			op = ""
+		}
+		m.Op, m.unresolved = op, !ok
+	}
+	return m
+}
@@ -0,0 +1,91 @@
+package s3rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestReceive(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+	ctx := context.Background()
+
+	// A custom dispatch loop reading requests.
+	client := newTestClient(c, bus, blobs, ClientOptions{Notifier: bus.notifier(toServer)})
+
+	key := client.keys.key(toServer, keyParts{op: "upper", id: testID, name: "in.txt"}, time.Now())
+	requests := bus.queue(toServer)
+	requests.push(Note{Bucket: testBucket, Key: key})
+	requests.push(Note{Bucket: testBucket, Key: "foo/bar.txt"})
+
+	ms, err := client.Receive(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ms, qt.HasLen, 2)
+
+	c.Assert(ms[0].Err(), qt.IsNil)
+	c.Assert(ms[0].Key, qt.Equals, key)
+	c.Assert(ms[0].Op, qt.Equals, "upper")
+	c.Assert(ms[0].ID, qt.Equals, testID)
+	c.Assert(ms[0].Request, qt.IsTrue)
+	c.Assert(ms[0].ReceiptHandle, qt.Not(qt.Equals), "")
+
+	c.Assert(ms[1].Err(), qt.ErrorMatches, ".*does not match key template.*")
+	c.Assert(ms[1].Op, qt.Equals, "")
+
+	c.Assert(client.DeleteMessage(ctx, ms[0]), qt.IsNil)
+	c.Assert(client.ReleaseMessage(ctx, ms[1]), qt.IsNil)
+	c.Assert(requests.len(), qt.Equals, 1)
+
+	ms, err = client.Receive(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ms, qt.HasLen, 1)
+	c.Assert(ms[0].Key, qt.Equals, "foo/bar.txt")
+}
+
+func TestReleaseVisibility(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		visibility time.Duration
+		expect     string
+	}{
+		{"Default", 0, "nack"},
+		{"Delayed", time.Second, "extend 1s"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			bus := newMemBus()
+			ctx := context.Background()
+			notifier := &releaseRecordingNotifier{memNotifier: bus.notifier(toServer)}
+			client := newTestClient(c, bus, newMemBlobStore(), ClientOptions{Notifier: notifier, ReleaseVisibility: test.visibility})
+
+			bus.queue(toServer).push(Note{Bucket: testBucket, Key: "foo/bar.txt"})
+			ms, err := client.Receive(ctx)
+			c.Assert(err, qt.IsNil)
+			c.Assert(ms, qt.HasLen, 1)
+			c.Assert(client.ReleaseMessage(ctx, ms[0]), qt.IsNil)
+			c.Assert(notifier.calls, qt.DeepEquals, []string{test.expect})
+		})
+	}
+}
+
+// releaseRecordingNotifier records how messages are released.
+type releaseRecordingNotifier struct {
+	*memNotifier
+	calls []string
+}
+
+func (n *releaseRecordingNotifier) Nack(ctx context.Context, note Note) error {
+	n.calls = append(n.calls, "nack")
+	return n.memNotifier.Nack(ctx, note)
+}
+
+func (n *releaseRecordingNotifier) Extend(ctx context.Context, note Note, d time.Duration) error {
+	n.calls = append(n.calls, "extend "+d.String())
+	return n.memNotifier.Extend(ctx, note, d)
+}
@@ -0,0 +1,138 @@
+package s3rpc
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// metaKeys is the comma separated list of the user metadata keys with upper case letters,
+// used to restore their case on the receiving side.
+const metaKeys = metaPrefix + "keys"
+
+const (
+	encodedValuePrefix = "=?UTF-8?B?"
+	encodedValueSuffix = "?="
+)
+
+// encodeMetadata validates and encodes the user metadata m for storage as object metadata.
+//
+// S3 stores metadata keys in lower case, so keys that only differ in case are rejected,
+// and the original keys are preserved in internal metadata.
+// Keys must be valid HTTP header field names, and the s3rpc- prefix is reserved.
+// Values that would not survive the trip as HTTP header values, e.g. non-ASCII text,
+// are base64 encoded as RFC 2047 encoded-words.
+func encodeMetadata(m map[string]string) (user, internal map[string]string, err error) {
+	if len(m) == 0 {
+		return nil, nil, nil
+	}
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	user = make(map[string]string, len(m))
+	seen := make(map[string]string, len(m))
+	var cased []string
+	for _, k := range keys {
+		if err := validateMetadataKey(k); err != nil {
+			return nil, nil, err
+		}
+		lower := strings.ToLower(k)
+		if other, found := seen[lower]; found {
+			return nil, nil, fmt.Errorf("metadata keys %q and %q collide, keys are stored in lower case", other, k)
+		}
+		seen[lower] = k
+		if lower != k {
+			cased = append(cased, k)
+		}
+		user[lower] = encodeMetadataValue(m[k])
+	}
+
+	if len(cased) > 0 {
+		internal = map[string]string{metaKeys: strings.Join(cased, ",")}
+	}
+
+	return user, internal, nil
+}
+
+// decodeMetadata reverses encodeMetadata.
+func decodeMetadata(user, internal map[string]string) map[string]string {
+	if len(user) == 0 {
+		return user
+	}
+	cased := make(map[string]string)
+	if keys := internal[metaKeys]; keys != "" {
+		for _, k := range strings.Split(keys, ",") {
+			cased[strings.ToLower(k)] = k
+		}
+	}
+	m := make(map[string]string, len(user))
+	for k, v := range user {
+		if original, found := cased[strings.ToLower(k)]; found {
+			k = original
+		}
+		m[k] = decodeMetadataValue(v)
+	}
+	return m
+}
+
+func validateMetadataKey(k string) error {
+	if k == "" {
+		return fmt.Errorf("metadata key must not be empty")
+	}
+	if strings.HasPrefix(strings.ToLower(k), metaPrefix) {
+		return fmt.Errorf("metadata key %q: the %s prefix is reserved", k, metaPrefix)
+	}
+	for i := 0; i < len(k); i++ {
+		if !isTokenChar(k[i]) {
+			return fmt.Errorf("metadata key %q: invalid character %q", k, k[i])
+		}
+	}
+	return nil
+}
+
+// isTokenChar reports whether c is valid in a HTTP header field name, see RFC 7230.
+func isTokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) != -1
+}
+
+func encodeMetadataValue(v string) string {
+	if !needsEncoding(v) {
+		return v
+	}
+	return encodedValuePrefix + base64.StdEncoding.EncodeToString([]byte(v)) + encodedValueSuffix
+}
+
+func decodeMetadataValue(v string) string {
+	if !strings.HasPrefix(v, encodedValuePrefix) || !strings.HasSuffix(v, encodedValueSuffix) {
+		return v
+	}
+	b, err := base64.StdEncoding.DecodeString(v[len(encodedValuePrefix) : len(v)-len(encodedValueSuffix)])
+	if err != nil {
+		// Not encoded by us.
+		return v
+	}
+	return string(b)
+}
+
+// needsEncoding reports whether v may not survive as a HTTP header value
+// or may be mistaken for an encoded value.
+func needsEncoding(v string) bool {
+	if strings.HasPrefix(v, "=?") || strings.TrimSpace(v) != v {
+		return true
+	}
+	for i := 0; i < len(v); i++ {
+		if v[i] < ' ' || v[i] > '~' {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package s3rpc
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestEncodeMetadata(t *testing.T) {
+	c := qt.New(t)
+
+	roundTrip := func(m map[string]string) map[string]string {
+		user, internal, err := encodeMetadata(m)
+		c.Assert(err, qt.IsNil)
+		for k, v := range user {
+			c.Assert(k, qt.Equals, strings.ToLower(k))
+			c.Assert(strings.TrimFunc(v, func(r rune) bool { return r >= ' ' && r <= '~' }), qt.Equals, "")
+		}
+		user, internal = splitMetadata(mergeMetadata(user, internal))
+		c.Assert(internal[metaKeys] != "", qt.Equals, m["Foo"] != "")
+		return user
+	}
+
+	for _, m := range []map[string]string{
+		{"foo": "bar"},
+		{"Foo": "bar", "Content-Type-X": "text/plain"},
+		{"unicode": "blåbærsyltetøy 😀", "Foo": "日本語"},
+		{"spaces": " padded ", "tab": "a\tb", "newline": "a\nb"},
+		{"looks-encoded": "=?UTF-8?B?Zm9v?=", "empty": ""},
+	} {
+		c.Assert(roundTrip(m), qt.DeepEquals, m)
+	}
+
+	_, _, err := encodeMetadata(map[string]string{"Foo": "a", "foo": "b"})
+	c.Assert(err, qt.ErrorMatches, `metadata keys "Foo" and "foo" collide, keys are stored in lower case`)
+	_, _, err = encodeMetadata(map[string]string{"foo bar": "a"})
+	c.Assert(err, qt.ErrorMatches, `metadata key "foo bar": invalid character ' '`)
+	_, _, err = encodeMetadata(map[string]string{"blåbær": "a"})
+	c.Assert(err, qt.ErrorMatches, `metadata key "blåbær": invalid character .*`)
+	_, _, err = encodeMetadata(map[string]string{"S3RPC-Kind": "a"})
+	c.Assert(err, qt.ErrorMatches, `metadata key "S3RPC-Kind": the s3rpc- prefix is reserved`)
+	_, _, err = encodeMetadata(map[string]string{"": "a"})
+	c.Assert(err, qt.ErrorMatches, `metadata key must not be empty`)
+
+	// Not encoded by us.
+	c.Assert(decodeMetadataValue("=?UTF-8?B?not base64?="), qt.Equals, "=?UTF-8?B?not base64?=")
+}
+
+// lowerCaseBlobStore wraps a BlobStore and lower cases the metadata keys like S3.
+type lowerCaseBlobStore struct {
+	BlobStore
+}
+
+func (b *lowerCaseBlobStore) Put(ctx context.Context, key string, body io.Reader, metadata map[string]string) error {
+	m := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		m[strings.ToLower(k)] = v
+	}
+	return b.BlobStore.Put(ctx, key, body, m)
+}
+
+func TestExecuteMetadata(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := &lowerCaseBlobStore{BlobStore: newMemBlobStore()}
+
+	var got map[string]string
+	handlers := Handlers{
+		"echo": func(ctx context.Context, input Input) (Output, error) {
+			got = input.Metadata
+			return Output{Filename: input.Filename, Metadata: map[string]string{"Result": "ok ✓"}}, nil
+		},
+	}
+	client := newTestClient(c, bus, blobs, ClientOptions{})
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: handlers})
+
+	metadata := map[string]string{"Author": "Bjørn", "lower": "plain"}
+	output, err := client.Execute(context.Background(), "echo", Input{Filename: writeTestFile(c, "in.txt", "foo"), Metadata: metadata})
+	c.Assert(err, qt.IsNil)
+	c.Assert(got, qt.DeepEquals, metadata)
+	c.Assert(output.Metadata, qt.DeepEquals, map[string]string{"Result": "ok ✓"})
+
+	_, err = client.Execute(context.Background(), "echo", Input{Filename: writeTestFile(c, "in.txt", "foo"), Metadata: map[string]string{"A": "1", "a": "2"}})
+	c.Assert(err, qt.ErrorMatches, `apply: metadata keys "A" and "a" collide.*`)
+}
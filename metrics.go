@@ -0,0 +1,76 @@
+package s3rpc
+
+import (
+	"time"
+)
+
+// Metrics are the timings of a request,
+// see ServerOptions.OnMetrics and ClientOptions.OnMetrics.
+type Metrics struct {
+	// The op and request ID these metrics belong to.
+	Op string
+	ID string
+
+	// QueueWaitDuration is the time from the client submitting the request
+	// to the server picking it up, i.e. the time spent in the queue (and uploading).
+	// It is computed from the client's and the server's clocks, so it is only as accurate
+	// as they are in sync. It is never negative: a client clock ahead of the server's
+	// gives zero, and if ahead by more than ServerOptions.ClockSkewTolerance, the server also
+	// logs that the clocks are out of sync.
+	// Set by the server only, zero if the submission time is unknown.
+	QueueWaitDuration time.Duration
+
+	// ProcessingDuration is the time from the server picking up the request to it being done,
+	// which includes the download of the input, the handler and the upload of the output.
+	// Set by the server only.
+	ProcessingDuration time.Duration
+
+	// EndToEndDuration is the time from the client starting to submit the request to
+	// it having downloaded the output.
+	// Set by the client only.
+	EndToEndDuration time.Duration
+
+	// Err is the error the request failed with, if any.
+	Err error
+}
+
+// queueWait returns the time from the submission time in the s3rpc metadata internal to pickedUp.
+// A submission time in the future means the client's clock is ahead, and the wait is reported as zero,
+// which is logged if beyond ClockSkewTolerance.
+func (s *Server) queueWait(internal map[string]string, pickedUp time.Time) time.Duration {
+	submittedAt, err := time.Parse(time.RFC3339Nano, internal[metaSubmittedAt])
+	if err != nil {
+		return 0
+	}
+	wait := pickedUp.Sub(submittedAt)
+	if wait < 0 {
+		if -wait > s.clockSkewTolerance {
+			s.infof("Request submitted %s in the future, the client's clock is ahead by more than the clock skew tolerance (%s)", -wait, s.clockSkewTolerance)
+		}
+		return 0
+	}
+	return wait
+}
+
+// reportMetrics reports the metrics of the request m picked up at pickedUp, see ServerOptions.OnMetrics.
+func (s *Server) reportMetrics(m Message, internal map[string]string, pickedUp time.Time, err error) {
+	if s.onMetrics == nil {
+		return
+	}
+	s.onMetrics(Metrics{
+		Op:                 m.Op,
+		ID:                 m.ID,
+		QueueWaitDuration:  s.queueWait(internal, pickedUp),
+		ProcessingDuration: time.Since(pickedUp),
+		Err:                err,
+	})
+}
+
+// reportMetrics reports the metrics of the request with the given id started at start,
+// see ClientOptions.OnMetrics.
+func (c *Client) reportMetrics(op, id string, start time.Time, err error) {
+	if c.onMetrics == nil {
+		return
+	}
+	c.onMetrics(Metrics{Op: op, ID: id, EndToEndDuration: time.Since(start), Err: err})
+}
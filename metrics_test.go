@@ -0,0 +1,90 @@
+package s3rpc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestMetrics(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	var (
+		mu            sync.Mutex
+		clientMetrics []Metrics
+		serverMetrics []Metrics
+	)
+	client := newTestClient(c, bus, blobs, ClientOptions{
+		OnMetrics: func(m Metrics) {
+			mu.Lock()
+			clientMetrics = append(clientMetrics, m)
+			mu.Unlock()
+		},
+	})
+	newTestServer(c, bus, blobs, ServerOptions{
+		Handlers: Handlers{
+			"upper": func(ctx context.Context, input Input) (Output, error) {
+				time.Sleep(20 * time.Millisecond)
+				return upperHandler(ctx, input)
+			},
+		},
+		OnMetrics: func(m Metrics) {
+			mu.Lock()
+			serverMetrics = append(serverMetrics, m)
+			mu.Unlock()
+		},
+	})
+
+	output, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.IsNil)
+
+	waitFor(c, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(serverMetrics) == 1
+	})
+	mu.Lock()
+	defer mu.Unlock()
+
+	c.Assert(clientMetrics, qt.HasLen, 1)
+	cm, sm := clientMetrics[0], serverMetrics[0]
+	c.Assert(cm.Op, qt.Equals, "upper")
+	c.Assert(cm.ID, qt.Equals, output.ID)
+	c.Assert(cm.Err, qt.IsNil)
+	c.Assert(cm.QueueWaitDuration, qt.Equals, time.Duration(0))
+	c.Assert(sm.Op, qt.Equals, "upper")
+	c.Assert(sm.ID, qt.Equals, output.ID)
+	c.Assert(sm.Err, qt.IsNil)
+	c.Assert(sm.EndToEndDuration, qt.Equals, time.Duration(0))
+	c.Assert(sm.ProcessingDuration >= 20*time.Millisecond, qt.IsTrue)
+	c.Assert(cm.EndToEndDuration >= sm.QueueWaitDuration+20*time.Millisecond, qt.IsTrue)
+}
+
+func TestServerQueueWait(t *testing.T) {
+	c := qt.New(t)
+
+	now := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	submitted := func(d time.Duration) map[string]string {
+		return map[string]string{metaSubmittedAt: now.Add(-d).Format(time.RFC3339Nano)}
+	}
+
+	var logged []string
+	s := &Server{clockSkewTolerance: 2 * time.Second, common: &common{infof: func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}}}
+	c.Assert(s.queueWait(submitted(time.Minute), now), qt.Equals, time.Minute)
+	// Submitted "in the future" by a client with its clock ahead, within the tolerance.
+	c.Assert(s.queueWait(submitted(-time.Second), now), qt.Equals, time.Duration(0))
+	c.Assert(logged, qt.HasLen, 0)
+	// Beyond the tolerance.
+	c.Assert(s.queueWait(submitted(-time.Minute), now), qt.Equals, time.Duration(0))
+	c.Assert(logged, qt.DeepEquals, []string{"Request submitted 1m0s in the future, the client's clock is ahead by more than the clock skew tolerance (2s)"})
+	c.Assert(s.queueWait(nil, now), qt.Equals, time.Duration(0))
+}
@@ -0,0 +1,211 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// Notifier abstracts the notification hop between client and server.
+//
+// A client or server only ever receives from its own end of the hop, while Send notifies
+// the other end that a new object has been stored in the bucket.
+//
+// The default implementation is backed by SQS, see NewSQSNotifier.
+// Other implementations could be built on e.g.:
+//
+//   - SNS+SQS: Send publishes to a topic, Receive/Ack/Nack operate on a subscribed queue.
+//   - Redis: Send does an LPUSH, Receive a BLMOVE into a processing list, Ack an LREM
+//     from that list and Nack moves the entry back.
+//   - Postgres: Send inserts a row, Receive selects rows FOR UPDATE SKIP LOCKED and marks them
+//     as taken with a deadline, Ack deletes the row and Nack clears the deadline.
+type Notifier interface {
+	// Send notifies the other end that note.Key is ready for processing.
+	Send(ctx context.Context, note Note) error
+
+	// Receive receives the next batch of notes.
+	// It may block for some time waiting for notes to arrive, and it is not an error to return none.
+	Receive(ctx context.Context) ([]Note, error)
+
+	// Ack acknowledges that note has been processed so it is not delivered again.
+	Ack(ctx context.Context, note Note) error
+
+	// Nack releases note so it can be delivered again, possibly to another receiver.
+	Nack(ctx context.Context, note Note) error
+}
+
+// VisibilityExtender is an optional interface a Notifier may implement to keep a received
+// note from being delivered again while it is being processed.
+type VisibilityExtender interface {
+	// Extend makes note invisible to other receivers for d from now.
+	Extend(ctx context.Context, note Note, d time.Duration) error
+}
+
+// Note is a notification about a new object in the bucket.
+type Note struct {
+	Bucket string
+	Key    string
+
+	// Attributes are the message attributes, if supported by the Notifier,
+	// see Input.Attributes.
+	Attributes map[string]string
+
+	// ReceiptHandle is an implementation specific handle used in Ack and Nack.
+	ReceiptHandle string
+}
+
+// NewSQSNotifier creates a new Notifier that receives from the SQS queue with the given URL.
+//
+// Notes are expected to arrive as S3 event notifications, which is how the provisioner sets up
+// the bucket, so Send is a no-op, and the notes carry no message attributes.
+// SendTo sends an S3 event notification directly to the given queue, see ClientOptions.ReplyTo,
+// using the queue's region, which may differ from the client's.
+func NewSQSNotifier(client *sqs.Client, queue string) Notifier {
+	return &sqsNotifier{client: client, queue: queue}
+}
+
+type sqsNotifier struct {
+	client *sqs.Client
+	queue  string
+}
+
+func (n *sqsNotifier) Send(ctx context.Context, note Note) error {
+	// S3 sends the event notification.
+	return nil
+}
+
+func (n *sqsNotifier) SendTo(ctx context.Context, queue string, note Note) error {
+	body, err := s3EventBody(note.Bucket, note.Key)
+	if err != nil {
+		return err
+	}
+	_, err = n.client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:          aws.String(queue),
+		MessageBody:       aws.String(body),
+		MessageAttributes: sqsMessageAttributes(note.Attributes),
+	}, withQueueRegion(queue))
+	return newAWSError(err)
+}
+
+// withQueueRegion sends a request to the regional endpoint of queue, if known,
+// as the SQS client picks the endpoint from its region, not from the queue URL,
+// so sending to a queue in another region would fail.
+func withQueueRegion(queue string) func(*sqs.Options) {
+	return func(o *sqs.Options) {
+		if region := queueRegion(queue); region != "" {
+			o.Region = region
+		}
+	}
+}
+
+func (n *sqsNotifier) Receive(ctx context.Context) ([]Note, error) {
+	result, err := n.client.ReceiveMessage(ctx,
+		&sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(n.queue),
+			MaxNumberOfMessages:   5,
+			VisibilityTimeout:     visibilitySeconds,
+			MessageAttributeNames: []string{"All"},
+			// Wait for 20 seconds for a message to arrive.
+			WaitTimeSeconds: 20,
+		},
+	)
+
+	if err != nil {
+		return nil, newAWSError(err)
+	}
+
+	var notes []Note
+	for _, m := range result.Messages {
+		note, ok, err := parseS3Event(*m.Body)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		note.Attributes = fromSQSMessageAttributes(m.MessageAttributes)
+		note.ReceiptHandle = *m.ReceiptHandle
+		notes = append(notes, note)
+	}
+
+	return notes, nil
+}
+
+// snsEnvelope is the envelope used when a message is delivered from an SNS topic to SQS
+// without raw message delivery.
+type snsEnvelope struct {
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+}
+
+// parseS3Event parses an S3 event notification, possibly wrapped in an SNS envelope.
+// It returns false if body contains no records, e.g. the test event S3 sends
+// when the notification is set up.
+func parseS3Event(body string) (Note, bool, error) {
+	var envelope snsEnvelope
+	if err := json.Unmarshal([]byte(body), &envelope); err == nil && envelope.Type == "Notification" {
+		body = envelope.Message
+	}
+
+	var messageBody messageBody
+	if err := json.Unmarshal([]byte(body), &messageBody); err != nil {
+		return Note{}, false, err
+	}
+	if len(messageBody.Records) == 0 {
+		return Note{}, false, nil
+	}
+	if len(messageBody.Records) > 1 {
+		return Note{}, false, fmt.Errorf("expected only one record, got %d", len(messageBody.Records))
+	}
+
+	s3 := messageBody.Records[0].S3
+	return Note{Bucket: s3.Bucket.Name, Key: s3.Object.Key}, true, nil
+}
+
+func (n *sqsNotifier) Ack(ctx context.Context, note Note) error {
+	_, err := n.client.DeleteMessage(
+		ctx,
+		&sqs.DeleteMessageInput{
+			QueueUrl:      aws.String(n.queue),
+			ReceiptHandle: aws.String(note.ReceiptHandle),
+		},
+	)
+	return newAWSError(err)
+}
+
+func (n *sqsNotifier) Nack(ctx context.Context, note Note) error {
+	_, err := n.client.ChangeMessageVisibility(
+		ctx,
+		&sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          aws.String(n.queue),
+			ReceiptHandle:     aws.String(note.ReceiptHandle),
+			VisibilityTimeout: 0,
+		},
+	)
+	return newAWSError(err)
+}
+
+func (n *sqsNotifier) Extend(ctx context.Context, note Note, d time.Duration) error {
+	_, err := n.client.ChangeMessageVisibility(
+		ctx,
+		&sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          aws.String(n.queue),
+			ReceiptHandle:     aws.String(note.ReceiptHandle),
+			VisibilityTimeout: int32(d / time.Second),
+		},
+	)
+	return newAWSError(err)
+}
+
+func (n *sqsNotifier) Validate(ctx context.Context) error {
+	_, err := n.client.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(n.queue),
+		AttributeNames: []types.QueueAttributeName{types.QueueAttributeNameQueueArn},
+	})
+	return newAWSError(err)
+}
@@ -0,0 +1,32 @@
+package s3rpc
+
+import (
+	"strconv"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestParseS3Event(t *testing.T) {
+	c := qt.New(t)
+
+	event := `{"Records":[{"eventSource":"aws:s3","s3":{"bucket":{"name":"s3fptest"},"object":{"key":"to_server/upper/01gd0m5k5kh5vm3kfr3qmdq4zs_in.txt"}}}]}`
+	expect := Note{Bucket: "s3fptest", Key: "to_server/upper/01gd0m5k5kh5vm3kfr3qmdq4zs_in.txt"}
+
+	note, ok, err := parseS3Event(event)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(note, qt.DeepEquals, expect)
+
+	// Delivered from an SNS topic without raw message delivery.
+	envelope := `{"Type":"Notification","MessageId":"abc","TopicArn":"arn:aws:sns:eu-north-1:656975317043:s3fptest_requests","Message":` + strconv.Quote(event) + `}`
+	note, ok, err = parseS3Event(envelope)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(note, qt.DeepEquals, expect)
+
+	// Test event sent by S3 when setting up the notification.
+	_, ok, err = parseS3Event(`{"Service":"Amazon S3","Event":"s3:TestEvent","Bucket":"s3fptest"}`)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsFalse)
+}
@@ -0,0 +1,124 @@
+package s3rpc
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
+)
+
+// OpConfig configures how a server runs the handler of an op, see ServerOptions.Ops.
+type OpConfig struct {
+	// Concurrency is the maximum number of requests for the op handled at the same time.
+	// Defaults to 1.
+	Concurrency int
+
+	// Timeout, if set, overrides ServerOptions.HandlerTimeout for the op.
+	Timeout time.Duration
+
+	// RateLimit, if set, is the maximum number of handler invocations per second for the op.
+	RateLimit rate.Limit
+
+	// Metadata, if set, is published with the op in the server's manifest,
+	// e.g. the handler's version, see Server.PublishManifest.
+	Metadata map[string]string
+}
+
+// opPool limits the requests being handled for an op.
+type opPool struct {
+	timeout time.Duration
+	sem     chan struct{}
+	limiter *rate.Limiter
+}
+
+func newOpPool(cfg OpConfig, defaultTimeout time.Duration) *opPool {
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 1
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	p := &opPool{timeout: cfg.Timeout, sem: make(chan struct{}, cfg.Concurrency)}
+	if cfg.RateLimit > 0 {
+		p.limiter = rate.NewLimiter(cfg.RateLimit, cfg.Concurrency)
+	}
+	return p
+}
+
+// tryAcquire reserves a worker for a request without blocking.
+// It returns false if all workers are busy or the rate limit is exceeded.
+func (p *opPool) tryAcquire() bool {
+	select {
+	case p.sem <- struct{}{}:
+	default:
+		return false
+	}
+	if p.limiter != nil && !p.limiter.Allow() {
+		p.release()
+		return false
+	}
+	return true
+}
+
+func (p *opPool) release() {
+	<-p.sem
+}
+
+// pool returns the worker pool for op.
+func (s *Server) pool(op string) *opPool {
+	s.poolsMu.Lock()
+	defer s.poolsMu.Unlock()
+	p, found := s.pools[op]
+	if !found {
+		cfg, found := s.opConfigs[op]
+		if !found {
+			cfg = s.defaultOpConfig
+		}
+		p = newOpPool(cfg, s.handlerTimeout)
+		s.pools[op] = p
+	}
+	return p
+}
+
+// dispatchResult is what dispatch did with a message.
+type dispatchResult int
+
+const (
+	// dispatchSkipped means there was nothing to do for the handlers.
+	dispatchSkipped dispatchResult = iota
+
+	// dispatchHandled means the message was handed to a handler.
+	dispatchHandled
+
+	// dispatchBusy means the message was released, as the pool of its op was busy.
+	dispatchBusy
+)
+
+// dispatch handles m in the worker pool of its op, so slow ops do not hold up the others.
+// If the pool is busy, m is released to be delivered again later, possibly to another server.
+// Errors handling m in the pool are logged, not returned.
+func (s *Server) dispatch(ctx context.Context, g *errgroup.Group, m Message) (dispatchResult, error) {
+	if m.Err() != nil || !m.Request || isProbeKey(m.Key) || s.handler(m.Op) == nil {
+		// Nothing to do for the handlers.
+		return dispatchSkipped, s.handleMessage(ctx, m)
+	}
+
+	p := s.pool(m.Op)
+	if !p.tryAcquire() {
+		s.infof("Releasing %q, op %q is busy", m.Key, m.Op)
+		return dispatchBusy, s.ReleaseMessage(ctx, m)
+	}
+
+	g.Go(func() error {
+		defer p.release()
+		if err := s.handleMessage(ctx, m); err != nil {
+			// Not fatal to the server, and returning it would stop the handlers of the other ops.
+			// Unless deleted, the message is delivered again once its visibility timeout expires.
+			s.infof("Failed to handle %q: %s", m.Key, err)
+		}
+		return nil
+	})
+
+	return dispatchHandled, nil
+}
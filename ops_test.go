@@ -0,0 +1,193 @@
+package s3rpc
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestServerOpsNotStarved(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	var (
+		mu      sync.Mutex
+		running int
+		maxRun  int
+	)
+	started := make(chan struct{}, 10)
+	unblock := make(chan struct{})
+	handlers := Handlers{
+		"slow": func(ctx context.Context, input Input) (Output, error) {
+			mu.Lock()
+			running++
+			if running > maxRun {
+				maxRun = running
+			}
+			mu.Unlock()
+			started <- struct{}{}
+			<-unblock
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return upperHandler(ctx, input)
+		},
+		"fast": upperHandler,
+	}
+
+	client := newTestClient(c, bus, blobs, ClientOptions{})
+	newTestServer(c, bus, blobs, ServerOptions{
+		Handlers: handlers,
+		Ops:      map[string]OpConfig{"slow": {Concurrency: 2}},
+	})
+
+	const numSlow = 3
+	var wg sync.WaitGroup
+	for i := 0; i < numSlow; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.Execute(context.Background(), "slow", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+			c.Check(err, qt.IsNil)
+		}()
+	}
+
+	// Both slow workers are busy.
+	<-started
+	<-started
+
+	// The fast op is not held up by the slow one.
+	for i := 0; i < 3; i++ {
+		_, err := client.Execute(context.Background(), "fast", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+		c.Assert(err, qt.IsNil)
+	}
+
+	// The third slow request waits for a free worker.
+	select {
+	case <-started:
+		c.Fatal("expected the third slow request to wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(unblock)
+	wg.Wait()
+	c.Assert(maxRun, qt.Equals, 2)
+}
+
+func TestServerOpsTimeout(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	deadlines := make(map[string]time.Duration)
+	var mu sync.Mutex
+	recordDeadline := func(ctx context.Context, input Input) (Output, error) {
+		mu.Lock()
+		if deadline, ok := ctx.Deadline(); ok {
+			deadlines[OpFromContext(ctx)] = time.Until(deadline)
+		}
+		mu.Unlock()
+		return upperHandler(ctx, input)
+	}
+
+	client := newTestClient(c, bus, blobs, ClientOptions{})
+	newTestServer(c, bus, blobs, ServerOptions{
+		Handlers:        Handlers{"a": recordDeadline, "b": recordDeadline, "c": recordDeadline},
+		HandlerTimeout:  time.Minute,
+		Ops:             map[string]OpConfig{"a": {Timeout: time.Hour}},
+		DefaultOpConfig: OpConfig{Concurrency: 2},
+	})
+
+	for _, op := range []string{"a", "b", "c"} {
+		_, err := client.Execute(context.Background(), op, Input{Filename: writeTestFile(c, "in.txt", "foo")})
+		c.Assert(err, qt.IsNil)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(deadlines["a"] > 59*time.Minute, qt.IsTrue)
+	c.Assert(deadlines["b"] > 59*time.Second && deadlines["b"] <= time.Minute, qt.IsTrue)
+	c.Assert(deadlines["c"] > 59*time.Second && deadlines["c"] <= time.Minute, qt.IsTrue)
+}
+
+func TestOpPool(t *testing.T) {
+	c := qt.New(t)
+
+	p := newOpPool(OpConfig{}, time.Second)
+	c.Assert(p.timeout, qt.Equals, time.Second)
+	c.Assert(p.tryAcquire(), qt.IsTrue)
+	c.Assert(p.tryAcquire(), qt.IsFalse)
+	p.release()
+	c.Assert(p.tryAcquire(), qt.IsTrue)
+	p.release()
+
+	// One per hour, with a burst of 2.
+	p = newOpPool(OpConfig{Concurrency: 2, RateLimit: 1.0 / 3600}, 0)
+	for i := 0; i < 2; i++ {
+		c.Assert(p.tryAcquire(), qt.IsTrue)
+		p.release()
+	}
+	c.Assert(p.tryAcquire(), qt.IsFalse)
+	// The worker is released when rate limited.
+	c.Assert(len(p.sem), qt.Equals, 0)
+}
+
+func TestServerOpsHandleError(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	var slowErr error
+	handlers := Handlers{
+		"slow": func(ctx context.Context, input Input) (Output, error) {
+			close(started)
+			<-unblock
+			slowErr = ctx.Err()
+			return upperHandler(ctx, input)
+		},
+		"broken": upperHandler,
+	}
+
+	failed := make(chan string, 10)
+	client := newTestClient(c, bus, blobs, ClientOptions{})
+	newTestServer(c, bus, blobs, ServerOptions{
+		Handlers: handlers,
+		Infof: func(format string, args ...interface{}) {
+			if strings.HasPrefix(format, "Failed to handle") {
+				select {
+				case failed <- args[0].(string):
+				default:
+				}
+			}
+		},
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Execute(context.Background(), "slow", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+		done <- err
+	}()
+	<-started
+
+	// The input is missing, so handling the request fails.
+	broken := "to_server/broken/01gd0m5k5kh5vm3kfr3qmdq4zs_in.txt"
+	bus.queue(toServer).push(Note{Bucket: testBucket, Key: broken})
+	c.Assert(<-failed, qt.Equals, broken)
+
+	// The slow op keeps running, and the server keeps serving.
+	close(unblock)
+	c.Assert(<-done, qt.IsNil)
+	c.Assert(slowErr, qt.IsNil)
+	_, err := client.Execute(context.Background(), "broken", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.IsNil)
+}
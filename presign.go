@@ -0,0 +1,116 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/oklog/ulid/v2"
+)
+
+// Presigner is an optional interface a BlobStore may implement
+// to support Client.PrepareUpload.
+type Presigner interface {
+	// PresignPut returns a URL that allows anyone holding it to PUT an object below key
+	// until it expires.
+	PresignPut(ctx context.Context, key string, expires time.Duration) (string, error)
+}
+
+// uploadName is the name part of the key of inputs uploaded to a URL from PrepareUpload.
+const uploadName = "upload"
+
+// PrepareUpload prepares a request for op with an input uploaded by someone else,
+// e.g. directly from a browser, and returns a pre-signed URL to PUT the input to
+// and the request ID to pass to Trigger once the upload is done.
+//
+// Security considerations:
+//
+//   - The URL allows anyone holding it to upload one object to the request's key, and nothing else,
+//     so hand it to the uploader only, over HTTPS.
+//   - The URL is valid for ClientOptions.UploadURLExpiry and can be used more than once
+//     within that time, overwriting the input; keep the expiry short.
+//   - The server processes whatever was uploaded, so handlers must validate the input.
+//     The uploader cannot set s3rpc's own metadata, so the input is not verified
+//     against a checksum, and the client's ReplyTo, KeepObjects and progress options do not apply.
+//
+// With the default SQS setup, the bucket notifies the server as soon as the upload is done,
+// and Trigger then only waits for the response.
+// Call Trigger right away, as a response with no client waiting for it is released
+// and only delivered again once its visibility timeout expires.
+//
+// PrepareUpload requires a BlobStore implementing Presigner, which the default does.
+func (c *Client) PrepareUpload(ctx context.Context, op string) (putURL, id string, err error) {
+	presigner, ok := c.blobs.(Presigner)
+	if !ok {
+		return "", "", errors.New("prepare upload: BlobStore does not implement Presigner")
+	}
+	if op == "" || strings.Contains(op, "/") {
+		return "", "", fmt.Errorf("prepare upload: invalid op %q", op)
+	}
+	// ULID is case insensitive, and lower case works better for filenames.
+	id = strings.ToLower(ulid.Make().String())
+	key, err := c.uploadKey(op, id)
+	if err != nil {
+		return "", "", fmt.Errorf("prepare upload: %w", err)
+	}
+	putURL, err = presigner.PresignPut(ctx, key, c.uploadURLExpiry)
+	if err != nil {
+		return "", "", fmt.Errorf("prepare upload: %w", err)
+	}
+	c.trackInput(id, key, time.Now().Add(c.uploadURLExpiry))
+	return putURL, id, nil
+}
+
+// Trigger notifies the server of the input uploaded for the request with the given id,
+// see PrepareUpload, and waits for the response as Execute does.
+func (c *Client) Trigger(ctx context.Context, op, id string) (Output, error) {
+	id = strings.ToLower(id)
+	return c.do(ctx, "trigger", func(ctx context.Context) (_ Output, err error) {
+		start := time.Now()
+		defer func() { c.reportMetrics(op, id, start, err) }()
+
+		key, err := c.uploadKey(op, id)
+		if err != nil {
+			return Output{}, fmt.Errorf("trigger: %w", err)
+		}
+
+		w, unregister := c.dispatcher.register(id)
+		defer unregister()
+		defer c.trackInput(id, key, time.Time{})()
+
+		if err := c.notifier.Send(ctx, Note{Bucket: c.bucket, Key: key}); err != nil {
+			return Output{}, fmt.Errorf("trigger: %w", err)
+		}
+
+		output, err := c.await(ctx, op, id, key, w)
+		if err != nil {
+			return Output{}, fmt.Errorf("trigger: %w", err)
+		}
+		return output, nil
+	})
+}
+
+// uploadKey returns the key of the input of the request with the given id, see PrepareUpload.
+// The key is derived from the id only, so Trigger may be called from another process.
+func (c *Client) uploadKey(op, id string) (string, error) {
+	u, err := ulid.Parse(id)
+	if err != nil {
+		return "", fmt.Errorf("invalid request id %q: %w", id, err)
+	}
+	return c.keys.key(toServer, keyParts{op: op, id: id, name: uploadName}, ulid.Time(u.Time())), nil
+}
+
+func (b *s3BlobStore) PresignPut(ctx context.Context, key string, expires time.Duration) (string, error) {
+	req, err := s3.NewPresignClient(b.client).PresignPutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", newAWSError(err)
+	}
+	return req.URL, nil
+}
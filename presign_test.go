@@ -0,0 +1,56 @@
+package s3rpc
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestPrepareUploadAndTrigger(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	bus := newMemBus()
+	blobs := &presigningBlobStore{memBlobStore: newMemBlobStore()}
+	client := newTestClient(c, bus, blobs, ClientOptions{UploadURLExpiry: time.Minute})
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}})
+
+	putURL, id, err := client.PrepareUpload(ctx, "upper")
+	c.Assert(err, qt.IsNil)
+	c.Assert(putURL, qt.Equals, "https://example.com/to_server/upper/"+id+"_upload?expires=1m0s")
+
+	// The browser uploads the input without any s3rpc metadata.
+	key := strings.TrimSuffix(strings.TrimPrefix(putURL, "https://example.com/"), "?expires=1m0s")
+	c.Assert(blobs.Put(ctx, key, strings.NewReader("foo"), nil), qt.IsNil)
+
+	output, err := client.Trigger(ctx, "upper", strings.ToUpper(id))
+	c.Assert(err, qt.IsNil)
+	c.Assert(output.ID, qt.Equals, id)
+	b, err := os.ReadFile(output.Filename)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "FOO")
+	waitFor(c, func() bool { return !blobs.has(key) })
+
+	_, err = client.Trigger(ctx, "upper", "foo")
+	c.Assert(err, qt.ErrorMatches, `trigger: invalid request id "foo": .*`)
+
+	_, _, err = client.PrepareUpload(ctx, "up/per")
+	c.Assert(err, qt.ErrorMatches, `prepare upload: invalid op "up/per"`)
+
+	client = newTestClient(c, bus, newMemBlobStore(), ClientOptions{})
+	_, _, err = client.PrepareUpload(ctx, "upper")
+	c.Assert(err, qt.ErrorMatches, "prepare upload: BlobStore does not implement Presigner")
+}
+
+// presigningBlobStore returns fake pre-signed URLs.
+type presigningBlobStore struct {
+	*memBlobStore
+}
+
+func (b *presigningBlobStore) PresignPut(ctx context.Context, key string, expires time.Duration) (string, error) {
+	return "https://example.com/" + key + "?expires=" + expires.String(), nil
+}
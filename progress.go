@@ -0,0 +1,69 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+const kindProgress = "progress"
+
+// Progress is a progress notification from a handler.
+type Progress struct {
+	// The op and request ID this notification belongs to.
+	Op string
+	ID string
+
+	Percent float64
+	Message string
+}
+
+// ReportProgress reports the progress of the current request to the client.
+// It is a no-op if ctx is not a handler context or the client has not asked for progress
+// notifications, see ClientOptions.OnProgress.
+//
+// Progress notifications are best effort; they may be dropped or arrive out of order.
+func ReportProgress(ctx context.Context, percent float64, msg string) {
+	if r, ok := ctx.Value(progressReporterKey{}).(*progressReporter); ok {
+		r.report(ctx, percent, msg)
+	}
+}
+
+type progressReporterKey struct{}
+
+type progressBody struct {
+	Percent float64 `json:"percent"`
+	Message string  `json:"message"`
+}
+
+// progressReporter publishes progress notifications as small side objects next to the output.
+type progressReporter struct {
+	s       *Server
+	parts   keyParts
+	replyTo string
+
+	mu  sync.Mutex
+	seq int
+}
+
+func (r *progressReporter) report(ctx context.Context, percent float64, msg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+
+	parts := r.parts
+	parts.suffix = fmt.Sprintf("%sprogress-%d", keySuffixSep, r.seq)
+	key := r.s.responseKey(parts, r.replyTo)
+
+	b, err := json.Marshal(progressBody{Percent: percent, Message: msg})
+	if err == nil {
+		err = r.s.putBytes(ctx, key, b, "application/json", map[string]string{metaKind: kindProgress})
+	}
+	if err == nil {
+		err = r.s.notifyClient(ctx, r.replyTo, key, nil)
+	}
+	if err != nil {
+		r.s.infof("Failed to report progress for %q: %s", parts.id, err)
+	}
+}
@@ -0,0 +1,95 @@
+package s3rpc
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestProgress(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	var (
+		mu       sync.Mutex
+		progress = make(map[string][]Progress)
+	)
+
+	client := newTestClient(c, bus, blobs, ClientOptions{
+		OnProgress: func(p Progress) {
+			mu.Lock()
+			defer mu.Unlock()
+			progress[p.ID] = append(progress[p.ID], p)
+		},
+	})
+
+	handlers := Handlers{
+		"upper": func(ctx context.Context, input Input) (Output, error) {
+			b, err := os.ReadFile(input.Filename)
+			if err != nil {
+				return Output{}, err
+			}
+			for _, percent := range []float64{25, 50, 75} {
+				ReportProgress(ctx, percent, string(b))
+				time.Sleep(10 * time.Millisecond)
+			}
+			return upperHandler(ctx, input)
+		},
+	}
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: handlers})
+
+	var g errgroup.Group
+	for _, content := range []string{"foo", "bar"} {
+		content := content
+		g.Go(func() error {
+			_, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, content+".txt", content)})
+			return err
+		})
+	}
+	c.Assert(g.Wait(), qt.IsNil)
+
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(progress, qt.HasLen, 2)
+	var messages []string
+	for _, ps := range progress {
+		// We get at least the progress reported before the output.
+		c.Assert(len(ps) > 0, qt.IsTrue)
+		for _, p := range ps {
+			c.Assert(p.Op, qt.Equals, "upper")
+			c.Assert(p.Message, qt.Equals, ps[0].Message)
+		}
+		messages = append(messages, ps[0].Message)
+	}
+	c.Assert(messages, qt.ContentEquals, []string{"foo", "bar"})
+}
+
+func TestProgressNotRequested(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := &hookBlobStore{BlobStore: newMemBlobStore()}
+
+	client := newTestClient(c, bus, blobs, ClientOptions{})
+
+	handlers := Handlers{
+		"upper": func(ctx context.Context, input Input) (Output, error) {
+			ReportProgress(ctx, 50, "halfway")
+			return upperHandler(ctx, input)
+		},
+	}
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: handlers})
+
+	_, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.IsNil)
+	// Input and output only.
+	waitFor(c, func() bool { return len(blobs.deletedKeys()) >= 2 })
+	c.Assert(blobs.deletedKeys(), qt.HasLen, 2)
+}
@@ -0,0 +1,354 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/smithy-go"
+)
+
+// ResourceStatus is the outcome of provisioning a resource, see Resource.
+type ResourceStatus int
+
+const (
+	// ResourceCreated means that the resource was created,
+	// or for configuration such as policies, applied.
+	ResourceCreated ResourceStatus = iota + 1
+
+	// ResourceAlreadyExisted means that the resource already existed and is reused.
+	ResourceAlreadyExisted
+
+	// ResourceFailed means that the resource could not be provisioned, see Resource.Err.
+	ResourceFailed
+)
+
+func (s ResourceStatus) String() string {
+	switch s {
+	case ResourceCreated:
+		return "created"
+	case ResourceAlreadyExisted:
+		return "already existed"
+	case ResourceFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("ResourceStatus(%d)", int(s))
+}
+
+// Resource is an AWS resource provisioned by a Provisioner's Create.
+type Resource struct {
+	// Kind is the kind of resource, e.g. "queue" or "queue policy".
+	Kind string
+
+	// Name is the name of the resource, or the resource it belongs to.
+	Name string
+
+	Status ResourceStatus
+
+	// Err is set if Status is ResourceFailed.
+	// Resources depending on a failed resource are not attempted, and fail with an error saying so.
+	Err error
+}
+
+// err returns an error listing the failed resources, or nil if none failed.
+func (r ProvisionResult) err() error {
+	var failed []string
+	for _, res := range r.Resources {
+		if res.Status == ResourceFailed {
+			failed = append(failed, fmt.Sprintf("%s %s: %s", res.Kind, res.Name, res.Err))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("failed to provision %d resources: %s", len(failed), strings.Join(failed, "; "))
+}
+
+// provisionRun creates the resources of an s3rpc environment, proceeding as far as possible
+// and reusing resources that already exist.
+type provisionRun struct {
+	name            string
+	region          string
+	queueAttributes map[string]string
+
+	iam *iam.Client
+	sqs *sqs.Client
+	s3  *s3.Client
+
+	result ProvisionResult
+}
+
+func newProvisionRun(awsCfg aws.Config, name, region string, queueAttributes map[string]string) *provisionRun {
+	return &provisionRun{
+		name:            name,
+		region:          region,
+		queueAttributes: queueAttributes,
+		iam:             iam.NewFromConfig(awsCfg),
+		sqs:             sqs.NewFromConfig(awsCfg),
+		s3:              s3.NewFromConfig(awsCfg),
+	}
+}
+
+// record records the outcome of provisioning a resource and reports whether it succeeded.
+func (r *provisionRun) record(kind, name string, existed bool, err error) bool {
+	status := ResourceCreated
+	switch {
+	case err != nil:
+		status = ResourceFailed
+	case existed:
+		status = ResourceAlreadyExisted
+	}
+	r.result.Resources = append(r.result.Resources, Resource{Kind: kind, Name: name, Status: status, Err: err})
+	return err == nil
+}
+
+// skip records a resource not attempted because dependency failed.
+func (r *provisionRun) skip(kind, name, dependency string) {
+	r.record(kind, name, false, fmt.Errorf("skipped, %s failed", dependency))
+}
+
+func (r *provisionRun) create(ctx context.Context) (ProvisionResult, error) {
+	admin, err := r.iam.GetUser(ctx, &iam.GetUserInput{})
+	if err != nil {
+		return r.result, fmt.Errorf("failed to get admin user: %w", err)
+	}
+	accountID := strings.Split(*admin.User.Arn, ":")[4]
+
+	var (
+		clientName = r.name + "_client"
+		serverName = r.name + "_server"
+	)
+
+	// Users and their access keys.
+	// The users are only granted access by their user policies below,
+	// not by the resource policies of the queues and the bucket.
+	users := make(map[string]bool)
+	for _, userName := range []string{clientName, serverName} {
+		existed, err := r.createUser(ctx, userName)
+		if !r.record("user", userName, existed, err) {
+			continue
+		}
+		users[userName] = true
+
+		existed, err = r.createAccessKey(ctx, userName)
+		r.record("access key", userName, existed, err)
+	}
+
+	// Queues.
+	bucketARN := "arn:aws:s3:::" + r.name
+	queueARNs := make(map[string]string)
+	for _, queueName := range []string{clientName, serverName} {
+		queueURL, existed, err := r.createQueue(ctx, queueName)
+		if !r.record("queue", queueName, existed, err) {
+			r.skip("queue policy", queueName, "queue")
+			continue
+		}
+		r.result.Queues = append(r.result.Queues, &sqs.CreateQueueOutput{QueueUrl: aws.String(queueURL)})
+		queueARNs[queueName] = fmt.Sprintf("arn:aws:sqs:%s:%s:%s", r.region, accountID, queueName)
+
+		r.record("queue policy", queueName, false, r.putQueuePolicy(ctx, queueURL, queueARNs[queueName], bucketARN))
+	}
+
+	// The bucket.
+	existed, err := r.createBucket(ctx)
+	if r.record("bucket", r.name, existed, err) {
+		r.record("bucket lifecycle", r.name, false, r.putBucketLifecycle(ctx))
+		r.record("public access block", r.name, false, r.putPublicAccessBlock(ctx))
+		r.record("ownership controls", r.name, false, r.enforceBucketOwner(ctx))
+
+		if len(queueARNs) == 2 {
+			r.record("bucket notification", r.name, false,
+				putBucketNotification(ctx, r.s3, r.name, queueARNs[clientName], aws.String(queueARNs[serverName]), nil),
+			)
+		} else {
+			r.skip("bucket notification", r.name, "queue")
+		}
+	} else {
+		for _, kind := range []string{"bucket lifecycle", "public access block", "ownership controls", "bucket notification"} {
+			r.skip(kind, r.name, "bucket")
+		}
+	}
+
+	// Least-privilege user policies.
+	if len(queueARNs) == 2 {
+		r.result.ClientPolicy, r.result.ServerPolicy, err = userPolicies(r.name, queueARNs[clientName], queueARNs[serverName])
+		if err != nil {
+			return r.result, err
+		}
+		for userName, policy := range map[string]string{clientName: r.result.ClientPolicy, serverName: r.result.ServerPolicy} {
+			if !users[userName] {
+				r.skip("user policy", userName, "user")
+				continue
+			}
+			_, err := r.iam.PutUserPolicy(ctx, &iam.PutUserPolicyInput{
+				UserName:       aws.String(userName),
+				PolicyName:     aws.String(userPolicyName),
+				PolicyDocument: aws.String(policy),
+			})
+			r.record("user policy", userName, false, err)
+		}
+	} else {
+		r.skip("user policy", clientName, "queue")
+		r.skip("user policy", serverName, "queue")
+	}
+
+	return r.result, r.result.err()
+}
+
+// createUser creates the user userName, if needed.
+func (r *provisionRun) createUser(ctx context.Context, userName string) (bool, error) {
+	_, err := r.iam.CreateUser(ctx, &iam.CreateUserInput{UserName: aws.String(userName), Path: aws.String("/")})
+	if apiErrorCode(err) == "EntityAlreadyExists" {
+		return true, nil
+	}
+	return false, err
+}
+
+// createAccessKey creates an access key for userName, unless it already has one.
+// The secrets of existing access keys cannot be retrieved.
+func (r *provisionRun) createAccessKey(ctx context.Context, userName string) (bool, error) {
+	keys, err := r.iam.ListAccessKeys(ctx, &iam.ListAccessKeysInput{UserName: aws.String(userName)})
+	if err != nil {
+		return false, err
+	}
+	if len(keys.AccessKeyMetadata) > 0 {
+		return true, nil
+	}
+	a, err := r.iam.CreateAccessKey(ctx, &iam.CreateAccessKeyInput{UserName: aws.String(userName)})
+	if err != nil {
+		return false, err
+	}
+	r.result.AccessKeys = append(r.result.AccessKeys, a)
+	return false, nil
+}
+
+// newQueueAttributes returns the attributes of a provisioned queue, the defaults overridden by overrides,
+// see ProvisionerOptions.queueAttributes.
+func newQueueAttributes(overrides map[string]string) map[string]string {
+	attributes := map[string]string{
+		"MessageRetentionPeriod":        "7200", // 2 hours
+		"ReceiveMessageWaitTimeSeconds": "10",   // 10 seconds
+	}
+	for k, v := range overrides {
+		attributes[k] = v
+	}
+	return attributes
+}
+
+// createQueue creates the queue queueName, if needed, and returns its URL.
+func (r *provisionRun) createQueue(ctx context.Context, queueName string) (string, bool, error) {
+	attributes := newQueueAttributes(r.queueAttributes)
+
+	existing, err := r.sqs.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{QueueName: aws.String(queueName)})
+	if err == nil {
+		_, err = r.sqs.SetQueueAttributes(ctx, &sqs.SetQueueAttributesInput{QueueUrl: existing.QueueUrl, Attributes: attributes})
+		return *existing.QueueUrl, true, err
+	}
+	if !isNoSuchEntityErr(err) {
+		return "", false, err
+	}
+
+	q, err := r.sqs.CreateQueue(ctx, &sqs.CreateQueueInput{QueueName: aws.String(queueName), Attributes: attributes})
+	if err != nil {
+		return "", false, err
+	}
+	return *q.QueueUrl, false, nil
+}
+
+// putQueuePolicy allows the bucket to send its event notifications to the queue.
+func (r *provisionRun) putQueuePolicy(ctx context.Context, queueURL, queueARN, bucketARN string) error {
+	policy, err := json.Marshal(resourcePolicy("s3.amazonaws.com", "sqs:SendMessage", queueARN, bucketARN))
+	if err != nil {
+		return err
+	}
+	_, err = r.sqs.SetQueueAttributes(ctx, &sqs.SetQueueAttributesInput{
+		QueueUrl:   aws.String(queueURL),
+		Attributes: map[string]string{"Policy": string(policy)},
+	})
+	return err
+}
+
+// createBucket creates the bucket, unless it already exists.
+// In us-east-1, creating a bucket we already own succeeds, so it is looked up first.
+func (r *provisionRun) createBucket(ctx context.Context) (bool, error) {
+	_, err := r.s3.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(r.name)})
+	if err == nil {
+		return true, nil
+	}
+	var notFound *s3types.NotFound
+	if !errors.As(err, &notFound) {
+		return false, err
+	}
+
+	input := &s3.CreateBucketInput{Bucket: aws.String(r.name)}
+	if r.region != "us-east-1" {
+		input.CreateBucketConfiguration = &s3types.CreateBucketConfiguration{
+			LocationConstraint: s3types.BucketLocationConstraint(r.region),
+		}
+	}
+	_, err = r.s3.CreateBucket(ctx, input)
+	if apiErrorCode(err) == "BucketAlreadyOwnedByYou" {
+		return true, nil
+	}
+	return false, err
+}
+
+func (r *provisionRun) putBucketLifecycle(ctx context.Context) error {
+	_, err := r.s3.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket: aws.String(r.name),
+		LifecycleConfiguration: &s3types.BucketLifecycleConfiguration{
+			Rules: []s3types.LifecycleRule{
+				{
+					ID:         aws.String("Expire all after 1 day"),
+					Filter:     &s3types.LifecycleRuleFilterMemberPrefix{Value: ""},
+					Status:     s3types.ExpirationStatusEnabled,
+					Expiration: &s3types.LifecycleExpiration{Days: 1},
+				},
+			},
+		},
+	})
+	return err
+}
+
+func (r *provisionRun) putPublicAccessBlock(ctx context.Context) error {
+	_, err := r.s3.PutPublicAccessBlock(ctx, &s3.PutPublicAccessBlockInput{
+		Bucket: aws.String(r.name),
+		PublicAccessBlockConfiguration: &s3types.PublicAccessBlockConfiguration{
+			BlockPublicAcls:       true,
+			BlockPublicPolicy:     true,
+			IgnorePublicAcls:      true,
+			RestrictPublicBuckets: true,
+		},
+	})
+	return err
+}
+
+// enforceBucketOwner makes the bucket owner own all objects in the bucket, so objects written
+// by identities from other accounts are readable, see AWSConfig.ObjectACL.
+func (r *provisionRun) enforceBucketOwner(ctx context.Context) error {
+	_, err := r.s3.PutBucketOwnershipControls(ctx, &s3.PutBucketOwnershipControlsInput{
+		Bucket: aws.String(r.name),
+		OwnershipControls: &s3types.OwnershipControls{
+			Rules: []s3types.OwnershipControlsRule{
+				{ObjectOwnership: s3types.ObjectOwnershipBucketOwnerEnforced},
+			},
+		},
+	})
+	return err
+}
+
+// apiErrorCode returns the AWS error code of err, if any.
+func apiErrorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
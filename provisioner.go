@@ -1,20 +1,95 @@
 package s3rpc
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
 	"github.com/bep/awscreate"
 	"github.com/bep/awscreate/s3rpccreate"
 )
 
 // NewProvisioner returns a new Provisioner that can be used to create and destroy an AWS environment
 // with all the users, buckets and queues needed for s3rpc.
+// The bucket owner owns all objects in the bucket (Object Ownership BucketOwnerEnforced),
+// so a client or server from another account can be granted access with a bucket policy,
+// see AWSConfig.ObjectACL.
 // Pass the result into PrintProvisionResults.
+// Use NewProvisionerWithOptions to get the outcome of each resource and the user policies.
 func NewProvisioner(name, region string) (awscreate.Provisioner[s3rpccreate.CreateResults], error) {
+	p, err := NewProvisionerWithOptions(ProvisionerOptions{Name: name, Region: region})
+	if err != nil {
+		return nil, err
+	}
+	create := func(ctx context.Context) (s3rpccreate.CreateResults, error) {
+		result, err := p.Create(ctx)
+		return result.CreateResults, err
+	}
+	return awscreate.NewProvisioner(create, p.Destroy), nil
+}
+
+// ProvisionerOptions configures NewProvisionerWithOptions.
+type ProvisionerOptions struct {
+	// Name is the name of the bucket, and the prefix of the users and queues.
+	Name string
+
+	// Region is the AWS region to create the environment in.
+	Region string
+
+	// MessageRetentionPeriod is how long the queues keep messages not yet deleted,
+	// e.g. requests no server picked up.
+	// It must be between 60 seconds and 14 days, and is rounded down to whole seconds.
+	// Defaults to 2 hours.
+	MessageRetentionPeriod time.Duration
+
+	// Delay delays the delivery of new messages to the queues (both requests and responses).
+	// It must be between 0 and 15 minutes, and is rounded down to whole seconds.
+	Delay time.Duration
+}
+
+// queueAttributes returns the SQS queue attributes to set, if any.
+func (opts ProvisionerOptions) queueAttributes() (map[string]string, error) {
+	attributes := make(map[string]string)
+	if opts.MessageRetentionPeriod != 0 {
+		retention := opts.MessageRetentionPeriod / time.Second
+		if retention < 60 || retention > 14*24*60*60 {
+			return nil, fmt.Errorf("message retention period must be between 60s and 14 days (336h0m0s), got %s", opts.MessageRetentionPeriod)
+		}
+		attributes["MessageRetentionPeriod"] = strconv.Itoa(int(retention))
+	}
+	if opts.Delay != 0 {
+		delay := opts.Delay / time.Second
+		if delay < 0 || delay > 900 {
+			return nil, fmt.Errorf("delay must be between 0s and 15m0s, got %s", opts.Delay)
+		}
+		attributes["DelaySeconds"] = strconv.Itoa(int(delay))
+	}
+	return attributes, nil
+}
+
+// NewProvisionerWithOptions is like NewProvisioner, but allows configuring the queues,
+// and its Create returns a ProvisionResult.
+// Pass the result into PrintProvisionResult.
+func NewProvisionerWithOptions(opts ProvisionerOptions) (awscreate.Provisioner[ProvisionResult], error) {
+	name, region := opts.Name, opts.Region
+
+	queueAttributes, err := opts.queueAttributes()
+	if err != nil {
+		return nil, err
+	}
+
 	keyID := os.Getenv("S3RPC_ADMIN_ACCESS_KEY_ID")
 	keySecret := os.Getenv("S3RPC_ADMIN_ACCESS_KEY_SECRET")
 
@@ -27,32 +102,195 @@ func NewProvisioner(name, region string) (awscreate.Provisioner[s3rpccreate.Crea
 		Credentials: credentials.NewStaticCredentialsProvider(keyID, keySecret, ""),
 	}
 
-	return s3rpccreate.New(
+	p := s3rpccreate.New(
 		s3rpccreate.Options{
 			AdminCfg: awsCfg,
 			Name:     name,
 			Region:   region,
-		}), nil
+		})
+
+	create := func(ctx context.Context) (ProvisionResult, error) {
+		return newProvisionRun(awsCfg, name, region, queueAttributes).create(ctx)
+	}
+
+	destroy := func(ctx context.Context) error {
+		iamClient := iam.NewFromConfig(awsCfg)
+		for _, userName := range []string{name + "_client", name + "_server"} {
+			_, err := iamClient.DeleteUserPolicy(ctx, &iam.DeleteUserPolicyInput{
+				UserName:   aws.String(userName),
+				PolicyName: aws.String(userPolicyName),
+			})
+			if err != nil && !isNoSuchEntityErr(err) {
+				return fmt.Errorf("failed to delete user policy: %w", err)
+			}
+		}
+		return p.Destroy(ctx)
+	}
+
+	return awscreate.NewProvisioner(create, destroy), nil
+
+}
+
+// ProvisionResult is the result of a Provisioner's Create.
+//
+// Create proceeds as far as possible, reusing the resources that already exist,
+// so it can be run again after fixing the cause of a failure.
+// Only the access keys created in this run are included, as the secrets of existing
+// access keys cannot be retrieved.
+type ProvisionResult struct {
+	s3rpccreate.CreateResults
+
+	// Resources lists the outcome for each resource in the order they were provisioned.
+	Resources []Resource
+
+	// ClientPolicy and ServerPolicy are the IAM policy documents (JSON) attached
+	// to the client and server users.
+	// They only allow the S3 actions needed on the s3rpc key prefixes and the SQS actions
+	// needed on the user's own queue.
+	ClientPolicy string
+	ServerPolicy string
+}
+
+// userPolicyName is the name of the inline policy attached to the provisioned users.
+const userPolicyName = "s3rpc"
+
+type policyDocument struct {
+	Version   string
+	Statement []policyStatement
+}
+
+type policyStatement struct {
+	Effect   string
+	Action   []string
+	Resource []string
+}
+
+// userPolicies returns the client and server policy documents for bucket and the given queue ARNs.
+func userPolicies(bucket, clientQueue string, serverQueues ...string) (string, string, error) {
+	var (
+		bucketARN = "arn:aws:s3:::" + bucket
+		toServer  = bucketARN + "/" + toServer + "/*"
+		toClient  = bucketARN + "/" + toClient + "/*"
+		direct    = bucketARN + "/" + toClientDirect + "/*"
+		cache     = bucketARN + "/" + cachePrefix + "/*"
+		logs      = bucketARN + "/" + logPrefix + "/*"
+		manifest  = bucketARN + "/" + manifestKey
+		cancel    = bucketARN + "/" + cancelPrefix + "/*"
+
+		queueActions = []string{"sqs:ReceiveMessage", "sqs:DeleteMessage", "sqs:ChangeMessageVisibility", "sqs:GetQueueAttributes"}
+	)
+
+	allow := func(resource string, actions ...string) policyStatement {
+		return policyStatement{Effect: "Allow", Action: actions, Resource: []string{resource}}
+	}
+
+	clientPolicy := policyDocument{
+		Version: "2012-10-17",
+		Statement: []policyStatement{
+			// s3:ListBucket is needed by Client.Sweep.
+			allow(bucketARN, "s3:GetBucketLocation", "s3:ListBucket"),
+			// The client deletes the input if the server never picks it up,
+			// and reads it if the server responds with it unchanged.
+			allow(toServer, "s3:PutObject", "s3:PutObjectAcl", "s3:GetObject", "s3:DeleteObject"),
+			allow(toClient, "s3:GetObject", "s3:DeleteObject"),
+			allow(direct, "s3:GetObject", "s3:DeleteObject"),
+			allow(cache, "s3:GetObject"),
+			allow(logs, "s3:GetObject"),
+			allow(manifest, "s3:GetObject"),
+			allow(cancel, "s3:PutObject", "s3:PutObjectAcl"),
+			allow(clientQueue, queueActions...),
+		},
+	}
+
+	serverPolicy := policyDocument{
+		Version: "2012-10-17",
+		Statement: []policyStatement{
+			allow(bucketARN, "s3:GetBucketLocation"),
+			allow(toServer, "s3:GetObject", "s3:DeleteObject"),
+			allow(toClient, "s3:PutObject", "s3:PutObjectAcl"),
+			allow(direct, "s3:PutObject", "s3:PutObjectAcl"),
+			allow(cache, "s3:GetObject", "s3:PutObject", "s3:PutObjectAcl"),
+			allow(logs, "s3:PutObject", "s3:PutObjectAcl"),
+			allow(manifest, "s3:PutObject", "s3:PutObjectAcl"),
+			allow(cancel, "s3:GetObject"),
+			// See ClientOptions.ReplyTo.
+			allow(clientQueue, "sqs:SendMessage"),
+		},
+	}
+	for _, serverQueue := range serverQueues {
+		serverPolicy.Statement = append(serverPolicy.Statement, allow(serverQueue, queueActions...))
+	}
+
+	c, err := json.MarshalIndent(clientPolicy, "", "  ")
+	if err != nil {
+		return "", "", err
+	}
+	s, err := json.MarshalIndent(serverPolicy, "", "  ")
+	if err != nil {
+		return "", "", err
+	}
+
+	return string(c), string(s), nil
+}
+
+// queueARN returns the ARN of the SQS queue with the given URL,
+// e.g. https://sqs.eu-north-1.amazonaws.com/123456789012/myqueue.
+func queueARN(region, queue string) (string, error) {
+	u, err := url.Parse(queue)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid queue URL %q", queue)
+	}
+	return fmt.Sprintf("arn:aws:sqs:%s:%s:%s", region, parts[0], parts[1]), nil
+}
+
+var isNoSuchEntityRe = regexp.MustCompile(`NoSuchEntity|NonExistentQueue|NoSuchBucket`)
 
+func isNoSuchEntityErr(err error) bool {
+	return err != nil && isNoSuchEntityRe.MatchString(err.Error())
 }
 
 // PrintProvisionResults prints the config releventa parts of the provision results to stdout,
 // sutiable for sourcing in a shell script.
 func PrintProvisionResults(outputs s3rpccreate.CreateResults) {
-	for i, q := range outputs.Queues {
-		name := "CLIENT"
-		if i == 1 {
-			name = "SERVER"
+	printProvisionResults(os.Stdout, ProvisionResult{CreateResults: outputs})
+}
+
+// PrintProvisionResult is like PrintProvisionResults,
+// but also prints the status of each resource as comments.
+func PrintProvisionResult(result ProvisionResult) {
+	printProvisionResults(os.Stdout, result)
+}
+
+func printProvisionResults(w io.Writer, outputs ProvisionResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, res := range outputs.Resources {
+		status := res.Status.String()
+		if res.Err != nil {
+			status += ": " + res.Err.Error()
 		}
-		fmt.Printf("S3RPC_%s_QUEUE=%s\n", name, *q.QueueUrl)
+		fmt.Fprintf(tw, "# %s\t%s\t%s\n", res.Kind, res.Name, status)
 	}
+	tw.Flush()
 
-	for i, k := range outputs.AccessKeys {
-		name := "CLIENT"
-		if i == 1 {
-			name = "SERVER"
-		}
-		fmt.Printf("S3RPC_%s_ACCESS_KEY_ID=%s\n", name, *k.AccessKey.AccessKeyId)
-		fmt.Printf("S3RPC_%s_SECRET_ACCESS_KEY=%s\n", name, *k.AccessKey.SecretAccessKey)
+	for _, q := range outputs.Queues {
+		fmt.Fprintf(w, "S3RPC_%s_QUEUE=%s\n", roleOf(*q.QueueUrl), *q.QueueUrl)
+	}
+
+	for _, k := range outputs.AccessKeys {
+		role := roleOf(*k.AccessKey.UserName)
+		fmt.Fprintf(w, "S3RPC_%s_ACCESS_KEY_ID=%s\n", role, *k.AccessKey.AccessKeyId)
+		fmt.Fprintf(w, "S3RPC_%s_SECRET_ACCESS_KEY=%s\n", role, *k.AccessKey.SecretAccessKey)
+	}
+}
+
+// roleOf returns CLIENT or SERVER for the provisioned user or queue s.
+func roleOf(s string) string {
+	if strings.HasSuffix(s, "_server") {
+		return "SERVER"
 	}
+	return "CLIENT"
 }
@@ -0,0 +1,194 @@
+package s3rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	iamtypes "github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/bep/awscreate"
+	"github.com/bep/awscreate/s3rpccreate"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestUserPolicies(t *testing.T) {
+	c := qt.New(t)
+
+	clientQueue, err := queueARN("eu-north-1", "https://sqs.eu-north-1.amazonaws.com/656975317043/s3fptest_client")
+	c.Assert(err, qt.IsNil)
+	c.Assert(clientQueue, qt.Equals, "arn:aws:sqs:eu-north-1:656975317043:s3fptest_client")
+	_, err = queueARN("eu-north-1", "https://sqs.eu-north-1.amazonaws.com/s3fptest_client")
+	c.Assert(err, qt.ErrorMatches, "invalid queue URL.*")
+
+	clientPolicy, serverPolicy, err := userPolicies("s3fptest", clientQueue, "arn:aws:sqs:eu-north-1:656975317043:s3fptest_server")
+	c.Assert(err, qt.IsNil)
+
+	actions := func(policy string) map[string][]string {
+		var doc policyDocument
+		c.Assert(json.Unmarshal([]byte(policy), &doc), qt.IsNil)
+		c.Assert(doc.Version, qt.Equals, "2012-10-17")
+		m := make(map[string][]string)
+		for _, s := range doc.Statement {
+			c.Assert(s.Effect, qt.Equals, "Allow")
+			for _, r := range s.Resource {
+				m[r] = append(m[r], s.Action...)
+			}
+		}
+		return m
+	}
+
+	ca := actions(clientPolicy)
+	c.Assert(ca["arn:aws:s3:::s3fptest/to_server/*"], qt.DeepEquals, []string{"s3:PutObject", "s3:PutObjectAcl", "s3:GetObject", "s3:DeleteObject"})
+	c.Assert(ca["arn:aws:s3:::s3fptest/to_client/*"], qt.DeepEquals, []string{"s3:GetObject", "s3:DeleteObject"})
+	c.Assert(ca["arn:aws:sqs:eu-north-1:656975317043:s3fptest_client"], qt.Contains, "sqs:ReceiveMessage")
+	c.Assert(ca["arn:aws:sqs:eu-north-1:656975317043:s3fptest_server"], qt.IsNil)
+	c.Assert(ca["arn:aws:s3:::s3fptest/manifest.json"], qt.DeepEquals, []string{"s3:GetObject"})
+	c.Assert(ca["arn:aws:s3:::s3fptest/cancel/*"], qt.DeepEquals, []string{"s3:PutObject", "s3:PutObjectAcl"})
+	c.Assert(ca["arn:aws:s3:::s3fptest/*"], qt.IsNil)
+
+	sa := actions(serverPolicy)
+	c.Assert(sa["arn:aws:s3:::s3fptest/to_server/*"], qt.DeepEquals, []string{"s3:GetObject", "s3:DeleteObject"})
+	c.Assert(sa["arn:aws:s3:::s3fptest/to_client/*"], qt.DeepEquals, []string{"s3:PutObject", "s3:PutObjectAcl"})
+	c.Assert(sa["arn:aws:s3:::s3fptest/manifest.json"], qt.DeepEquals, []string{"s3:PutObject", "s3:PutObjectAcl"})
+	c.Assert(sa["arn:aws:s3:::s3fptest/cancel/*"], qt.DeepEquals, []string{"s3:GetObject"})
+	c.Assert(sa["arn:aws:sqs:eu-north-1:656975317043:s3fptest_server"], qt.Contains, "sqs:DeleteMessage")
+	c.Assert(sa["arn:aws:sqs:eu-north-1:656975317043:s3fptest_client"], qt.DeepEquals, []string{"sqs:SendMessage"})
+}
+
+func TestNewProvisioner(t *testing.T) {
+	c := qt.New(t)
+
+	t.Setenv("S3RPC_ADMIN_ACCESS_KEY_ID", "")
+	_, err := NewProvisioner("s3rpctest", "eu-north-1")
+	c.Assert(err, qt.ErrorMatches, "S3RPC_ADMIN_ACCESS_KEY_ID and S3RPC_ADMIN_ACCESS_KEY_SECRET must be set")
+
+	t.Setenv("S3RPC_ADMIN_ACCESS_KEY_ID", "id")
+	t.Setenv("S3RPC_ADMIN_ACCESS_KEY_SECRET", "secret")
+
+	// NewProvisioner keeps returning the results of s3rpccreate.
+	var p awscreate.Provisioner[s3rpccreate.CreateResults]
+	p, err = NewProvisioner("s3rpctest", "eu-north-1")
+	c.Assert(err, qt.IsNil)
+	c.Assert(p, qt.Not(qt.IsNil))
+
+	var pr awscreate.Provisioner[ProvisionResult]
+	pr, err = NewProvisionerWithOptions(ProvisionerOptions{Name: "s3rpctest", Region: "eu-north-1"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(pr, qt.Not(qt.IsNil))
+}
+
+func TestProvisionerOptionsQueueAttributes(t *testing.T) {
+	c := qt.New(t)
+
+	attributes, err := ProvisionerOptions{}.queueAttributes()
+	c.Assert(err, qt.IsNil)
+	c.Assert(attributes, qt.HasLen, 0)
+
+	attributes, err = ProvisionerOptions{MessageRetentionPeriod: 24 * time.Hour, Delay: 90 * time.Second}.queueAttributes()
+	c.Assert(err, qt.IsNil)
+	c.Assert(attributes, qt.DeepEquals, map[string]string{"MessageRetentionPeriod": "86400", "DelaySeconds": "90"})
+
+	_, err = ProvisionerOptions{MessageRetentionPeriod: 30 * time.Second}.queueAttributes()
+	c.Assert(err, qt.ErrorMatches, `message retention period must be between 60s and 14 days \(336h0m0s\), got 30s`)
+	_, err = ProvisionerOptions{MessageRetentionPeriod: 15 * 24 * time.Hour}.queueAttributes()
+	c.Assert(err, qt.ErrorMatches, `message retention period .*, got 360h0m0s`)
+	_, err = ProvisionerOptions{Delay: 16 * time.Minute}.queueAttributes()
+	c.Assert(err, qt.ErrorMatches, `delay must be between 0s and 15m0s, got 16m0s`)
+	_, err = ProvisionerOptions{Delay: -time.Minute}.queueAttributes()
+	c.Assert(err, qt.ErrorMatches, `delay must be between 0s and 15m0s, got -1m0s`)
+
+	_, err = NewProvisionerWithOptions(ProvisionerOptions{Name: "s3rpctest", Region: "eu-north-1", Delay: time.Hour})
+	c.Assert(err, qt.ErrorMatches, `delay must be .*`)
+}
+
+func TestProvisionRunCreate(t *testing.T) {
+	c := qt.New(t)
+
+	newRun := func(httpClient *fakeAWSHTTPClient) *provisionRun {
+		return newProvisionRun(aws.Config{
+			Region:      "eu-north-1",
+			Credentials: credentials.NewStaticCredentialsProvider("id", "secret", ""),
+			HTTPClient:  httpClient,
+		}, "s3rpctest", "eu-north-1", nil)
+	}
+
+	httpClient := &fakeAWSHTTPClient{notFound: map[string]bool{"HEAD ": true}}
+	result, err := newRun(httpClient).create(context.Background())
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.Resources, qt.Contains, Resource{Kind: "bucket", Name: "s3rpctest", Status: ResourceCreated})
+	c.Assert(httpClient.find("PUT "), qt.HasLen, 1)
+
+	// The users are only granted access by their user policies.
+	c.Assert(httpClient.find("PUT policy="), qt.HasLen, 0)
+	c.Assert(httpClient.find("PutUserPolicy"), qt.HasLen, 2)
+
+	// Only the bucket may send to the queues.
+	var policies []resourcePolicyStatement
+	for _, r := range httpClient.find("SetQueueAttributes") {
+		if policy, found := formMap(r.form, "Attribute", "Name", "Value")["Policy"]; found {
+			policies = append(policies, decodeResourcePolicy(c, policy))
+		}
+	}
+	c.Assert(policies, qt.HasLen, 2)
+	for i, queueName := range []string{"s3rpctest_client", "s3rpctest_server"} {
+		c.Assert(policies[i], qt.DeepEquals, resourcePolicyStatement{
+			Effect:    "Allow",
+			Principal: map[string]string{"Service": "s3.amazonaws.com"},
+			Action:    "sqs:SendMessage",
+			Resource:  "arn:aws:sqs:eu-north-1:656975317043:" + queueName,
+			Condition: map[string]map[string]string{"ArnLike": {"aws:SourceArn": "arn:aws:s3:::s3rpctest"}},
+		})
+	}
+
+	// An existing bucket is not created again,
+	// which in us-east-1 would succeed.
+	httpClient = &fakeAWSHTTPClient{}
+	result, err = newRun(httpClient).create(context.Background())
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.Resources, qt.Contains, Resource{Kind: "bucket", Name: "s3rpctest", Status: ResourceAlreadyExisted})
+	c.Assert(httpClient.find("PUT "), qt.HasLen, 0)
+}
+
+func TestPrintProvisionResults(t *testing.T) {
+	c := qt.New(t)
+
+	result := ProvisionResult{
+		Resources: []Resource{
+			{Kind: "user", Name: "s3rpctest_client", Status: ResourceAlreadyExisted},
+			{Kind: "access key", Name: "s3rpctest_client", Status: ResourceAlreadyExisted},
+			{Kind: "user", Name: "s3rpctest_server", Status: ResourceCreated},
+			{Kind: "access key", Name: "s3rpctest_server", Status: ResourceCreated},
+			{Kind: "bucket", Name: "s3rpctest", Status: ResourceFailed, Err: errors.New("BucketAlreadyExists")},
+			{Kind: "bucket lifecycle", Name: "s3rpctest", Status: ResourceFailed, Err: errors.New("skipped, bucket failed")},
+		},
+	}
+	result.Queues = []*sqs.CreateQueueOutput{
+		{QueueUrl: aws.String("https://sqs.eu-north-1.amazonaws.com/123456789012/s3rpctest_server")},
+	}
+	result.AccessKeys = []*iam.CreateAccessKeyOutput{
+		{AccessKey: &iamtypes.AccessKey{UserName: aws.String("s3rpctest_server"), AccessKeyId: aws.String("id"), SecretAccessKey: aws.String("secret")}},
+	}
+
+	c.Assert(result.err(), qt.ErrorMatches, "failed to provision 2 resources: bucket s3rpctest: BucketAlreadyExists; bucket lifecycle s3rpctest: skipped, bucket failed")
+	c.Assert(ProvisionResult{Resources: result.Resources[:4]}.err(), qt.IsNil)
+
+	var buf bytes.Buffer
+	printProvisionResults(&buf, result)
+	c.Assert(buf.String(), qt.Equals, `# user              s3rpctest_client  already existed
+# access key        s3rpctest_client  already existed
+# user              s3rpctest_server  created
+# access key        s3rpctest_server  created
+# bucket            s3rpctest         failed: BucketAlreadyExists
+# bucket lifecycle  s3rpctest         failed: skipped, bucket failed
+S3RPC_SERVER_QUEUE=https://sqs.eu-north-1.amazonaws.com/123456789012/s3rpctest_server
+S3RPC_SERVER_ACCESS_KEY_ID=id
+S3RPC_SERVER_SECRET_ACCESS_KEY=secret
+`)
+}
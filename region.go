@@ -0,0 +1,108 @@
+package s3rpc
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// newS3Client creates a new S3 client for the bucket in cfg.
+// With AWSConfig.AutoResolveRegion set, the bucket's region is looked up, which blocks
+// for up to regionLookupTimeout, and used if it differs from cfg.Region.
+func newS3Client(cfg AWSConfig, awsCfg aws.Config, infof func(format string, args ...interface{})) *s3.Client {
+	client := s3.NewFromConfig(awsCfg)
+	if !cfg.AutoResolveRegion {
+		return client
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), regionLookupTimeout)
+	defer cancel()
+	actual, err := bucketRegion(ctx, client, cfg.Bucket)
+	if err != nil {
+		// Most likely missing the s3:GetBucketLocation permission.
+		infof("Unable to determine the region of bucket %q: %s", cfg.Bucket, err)
+		return client
+	}
+	if actual == cfg.Region {
+		return client
+	}
+	infof("Using region %q for bucket %q", actual, cfg.Bucket)
+	return s3.NewFromConfig(awsCfg, func(o *s3.Options) { o.Region = actual })
+}
+
+// newSQSClient creates a new SQS client for the queue with the given URL.
+// If the URL tells that the queue lives in another region than cfg.Region, it either fails or uses
+// the queue's region, see AWSConfig.AutoResolveRegion.
+func newSQSClient(cfg AWSConfig, awsCfg aws.Config, queue string, infof func(format string, args ...interface{})) (*sqs.Client, error) {
+	region, err := resolveRegion(fmt.Sprintf("queue %q", queue), cfg.Region, queueRegion(queue), cfg.AutoResolveRegion)
+	if err != nil {
+		return nil, err
+	}
+	if region == cfg.Region {
+		return sqs.NewFromConfig(awsCfg), nil
+	}
+	infof("Using region %q for queue %q", region, queue)
+	return sqs.NewFromConfig(awsCfg, func(o *sqs.Options) { o.Region = region }), nil
+}
+
+// resolveRegion returns the region to use for the resource described by what.
+// An empty actual region means unknown.
+func resolveRegion(what, configured, actual string, auto bool) (string, error) {
+	if actual == "" || actual == configured {
+		return configured, nil
+	}
+	if auto {
+		return actual, nil
+	}
+	return "", fmt.Errorf("%s is in region %q, but the configured region is %q; fix AWSConfig.Region or set AWSConfig.AutoResolveRegion", what, actual, configured)
+}
+
+// bucketRegion returns the region bucket lives in.
+func bucketRegion(ctx context.Context, client *s3.Client, bucket string) (string, error) {
+	result, err := client.GetBucketLocation(ctx, &s3.GetBucketLocationInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		return "", err
+	}
+	return normalizeBucketLocation(string(result.LocationConstraint)), nil
+}
+
+// normalizeBucketLocation converts a bucket location constraint to a region.
+func normalizeBucketLocation(loc string) string {
+	switch loc {
+	case "":
+		// Buckets in us-east-1 have no location constraint.
+		return "us-east-1"
+	case "EU":
+		// Legacy.
+		return "eu-west-1"
+	}
+	return loc
+}
+
+// queueRegion infers the region from an SQS queue URL,
+// e.g. https://sqs.eu-north-1.amazonaws.com/123456789012/myqueue.
+// It returns an empty string if it can not be inferred, e.g. for a custom endpoint.
+func queueRegion(queue string) string {
+	u, err := url.Parse(queue)
+	if err != nil {
+		return ""
+	}
+	host := u.Hostname()
+	labels := strings.Split(host, ".")
+	if len(labels) < 4 || !strings.Contains(host, ".amazonaws.") {
+		return ""
+	}
+	switch {
+	case labels[0] == "sqs":
+		return labels[1]
+	case labels[1] == "queue":
+		// Legacy, e.g. https://eu-north-1.queue.amazonaws.com/123456789012/myqueue.
+		return labels[0]
+	}
+	return ""
+}
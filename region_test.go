@@ -0,0 +1,81 @@
+package s3rpc
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestQueueRegion(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(queueRegion("https://sqs.eu-north-1.amazonaws.com/656975317043/s3fptest_client"), qt.Equals, "eu-north-1")
+	c.Assert(queueRegion("https://sqs.cn-north-1.amazonaws.com.cn/656975317043/myqueue"), qt.Equals, "cn-north-1")
+	c.Assert(queueRegion("https://us-west-2.queue.amazonaws.com/656975317043/myqueue"), qt.Equals, "us-west-2")
+	c.Assert(queueRegion("http://localhost:4566/000000000000/myqueue"), qt.Equals, "")
+	c.Assert(queueRegion("myqueue"), qt.Equals, "")
+}
+
+func TestResolveRegion(t *testing.T) {
+	c := qt.New(t)
+
+	region, err := resolveRegion(`bucket "foo"`, "eu-north-1", "eu-north-1", false)
+	c.Assert(err, qt.IsNil)
+	c.Assert(region, qt.Equals, "eu-north-1")
+
+	region, err = resolveRegion(`bucket "foo"`, "eu-north-1", "", false)
+	c.Assert(err, qt.IsNil)
+	c.Assert(region, qt.Equals, "eu-north-1")
+
+	_, err = resolveRegion(`bucket "foo"`, "eu-north-1", "us-east-1", false)
+	c.Assert(err, qt.ErrorMatches, `bucket "foo" is in region "us-east-1", but the configured region is "eu-north-1".*`)
+
+	region, err = resolveRegion(`bucket "foo"`, "eu-north-1", "us-east-1", true)
+	c.Assert(err, qt.IsNil)
+	c.Assert(region, qt.Equals, "us-east-1")
+
+	c.Assert(normalizeBucketLocation(""), qt.Equals, "us-east-1")
+	c.Assert(normalizeBucketLocation("EU"), qt.Equals, "eu-west-1")
+	c.Assert(normalizeBucketLocation("eu-north-1"), qt.Equals, "eu-north-1")
+}
+
+func TestNewClientQueueRegionMismatch(t *testing.T) {
+	c := qt.New(t)
+
+	opts := ClientOptions{
+		Queue:     "https://sqs.us-east-1.amazonaws.com/656975317043/myqueue",
+		BlobStore: newMemBlobStore(),
+		Infof:     noopInfof,
+		AWSConfig: AWSConfig{Region: "eu-north-1", Bucket: testBucket, AccessKeyID: "foo", SecretAccessKey: "bar"},
+	}
+	_, err := NewClient(opts)
+	c.Assert(err, qt.ErrorMatches, `queue .* is in region "us-east-1", but the configured region is "eu-north-1".*`)
+
+	opts.AutoResolveRegion = true
+	client, err := NewClient(opts)
+	c.Assert(err, qt.IsNil)
+	c.Assert(client.Close(), qt.IsNil)
+}
+
+func TestNewS3ClientRegionLookup(t *testing.T) {
+	c := qt.New(t)
+
+	httpClient := &recordingHTTPClient{}
+	awsCfg := aws.Config{
+		Region:      "eu-north-1",
+		Credentials: credentials.NewStaticCredentialsProvider("id", "secret", ""),
+		HTTPClient:  httpClient,
+	}
+	cfg := AWSConfig{Region: "eu-north-1", Bucket: testBucket}
+
+	// No network calls unless asked for.
+	c.Assert(newS3Client(cfg, awsCfg, noopInfof), qt.Not(qt.IsNil))
+	c.Assert(httpClient.requests, qt.HasLen, 0)
+
+	cfg.AutoResolveRegion = true
+	c.Assert(newS3Client(cfg, awsCfg, noopInfof), qt.Not(qt.IsNil))
+	c.Assert(httpClient.requests, qt.HasLen, 1)
+	c.Assert(httpClient.requests[0].URL.RawQuery, qt.Equals, "location=")
+}
@@ -0,0 +1,102 @@
+package s3rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// toClientDirect is the prefix of responses sent directly to the client's reply-to queue.
+// It is deliberately not covered by the bucket's to_client/ event notification,
+// so the default client queue is not notified about them.
+const toClientDirect = "to_client_direct"
+
+// ReplyToSender is an optional interface a server's Notifier may implement to
+// notify a specific queue, see ClientOptions.ReplyTo.
+type ReplyToSender interface {
+	// SendTo notifies the queue with the given URL that note.Key is ready for processing.
+	SendTo(ctx context.Context, queue string, note Note) error
+}
+
+// normalizeReplyTo validates the reply-to queue and returns it as a URL.
+// The queue may be given as an SQS queue URL or ARN.
+func normalizeReplyTo(queue string) (string, error) {
+	if strings.HasPrefix(queue, "arn:") {
+		// arn:aws:sqs:eu-north-1:123456789012:myqueue
+		parts := strings.Split(queue, ":")
+		if len(parts) != 6 || parts[2] != "sqs" || parts[3] == "" || parts[4] == "" || parts[5] == "" {
+			return "", fmt.Errorf("invalid reply-to queue ARN %q", queue)
+		}
+		return fmt.Sprintf("https://sqs.%s.amazonaws.com/%s/%s", parts[3], parts[4], parts[5]), nil
+	}
+
+	u, err := url.Parse(queue)
+	if err != nil {
+		return "", fmt.Errorf("invalid reply-to queue URL %q: %w", queue, err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return "", fmt.Errorf("invalid reply-to queue URL %q", queue)
+	}
+	return queue, nil
+}
+
+// replyTo returns the queue to send the responses to a request with the given s3rpc metadata to,
+// followed by the queues to fall back to, if any, comma separated (see sendToReplyTo),
+// or an empty string to use the default route.
+func (s *Server) replyTo(internal map[string]string) string {
+	queue := internal[metaReplyTo]
+	if queue == "" {
+		return ""
+	}
+	if _, ok := s.notifier.(ReplyToSender); !ok {
+		s.infof("Notifier does not support reply-to, using the default route")
+		return ""
+	}
+	queue, err := normalizeReplyTo(queue)
+	if err != nil {
+		s.infof("%s, using the default route", err)
+		return ""
+	}
+	return strings.Join(append([]string{queue}, s.replyToFallbacks(internal)...), ",")
+}
+
+// responseKey returns the key of a response (or side object) to the request with the given parts.
+func (s *Server) responseKey(parts keyParts, replyTo string) string {
+	prefix := toClient
+	if replyTo != "" {
+		prefix = toClientDirect
+	}
+	// The client uses the ID in the key to identify the
+	// message in the output queue, so we need to preserve that.
+	// With that, we also know that it's unique.
+	return s.keys.key(prefix, parts, time.Now())
+}
+
+// notifyClient notifies the client that the response stored below key is ready.
+func (s *Server) notifyClient(ctx context.Context, replyTo, key string, attrs map[string]string) error {
+	note := Note{Bucket: s.bucket, Key: key, Attributes: attrs}
+	if replyTo != "" {
+		return s.sendToReplyTo(ctx, strings.Split(replyTo, ","), note)
+	}
+	return s.notifier.Send(ctx, note)
+}
+
+// s3EventBody returns an S3 event notification body for the object stored below key in bucket.
+func s3EventBody(bucket, key string) (string, error) {
+	type record struct {
+		EventSource string   `json:"eventSource"`
+		EventName   string   `json:"eventName"`
+		S3          s3Object `json:"s3"`
+	}
+	r := record{EventSource: "s3rpc", EventName: "ObjectCreated:Put"}
+	r.S3.Bucket.Name = bucket
+	r.S3.Object.Key = key
+
+	b, err := json.Marshal(struct {
+		Records []record `json:"Records"`
+	}{[]record{r}})
+	return string(b), err
+}
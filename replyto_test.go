@@ -0,0 +1,87 @@
+package s3rpc
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestReplyTo(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	queueA := "https://sqs.eu-north-1.amazonaws.com/656975317043/a"
+	queueB := "https://sqs.eu-north-1.amazonaws.com/656975317043/b"
+
+	clientA := newTestClient(c, bus, blobs, ClientOptions{Notifier: bus.notifier(queueA), ReplyTo: queueA})
+	clientB := newTestClient(c, bus, blobs, ClientOptions{Notifier: bus.notifier(queueB), ReplyTo: "arn:aws:sqs:eu-north-1:656975317043:b"})
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}})
+
+	for _, client := range []*Client{clientA, clientB} {
+		output, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+		c.Assert(err, qt.IsNil)
+		b, err := os.ReadFile(output.Filename)
+		c.Assert(err, qt.IsNil)
+		c.Assert(string(b), qt.Equals, "FOO")
+	}
+
+	// Nothing sent through the default route.
+	c.Assert(bus.queue(toClient).len(), qt.Equals, 0)
+	c.Assert(bus.queue(toClientDirect).len(), qt.Equals, 0)
+	waitFor(c, func() bool { return len(blobs.keys()) == 0 })
+}
+
+func TestNormalizeReplyTo(t *testing.T) {
+	c := qt.New(t)
+
+	queue, err := normalizeReplyTo("https://sqs.eu-north-1.amazonaws.com/656975317043/a")
+	c.Assert(err, qt.IsNil)
+	c.Assert(queue, qt.Equals, "https://sqs.eu-north-1.amazonaws.com/656975317043/a")
+
+	queue, err = normalizeReplyTo("arn:aws:sqs:eu-north-1:656975317043:a")
+	c.Assert(err, qt.IsNil)
+	c.Assert(queue, qt.Equals, "https://sqs.eu-north-1.amazonaws.com/656975317043/a")
+
+	_, err = normalizeReplyTo("arn:aws:sns:eu-north-1:656975317043:a")
+	c.Assert(err, qt.ErrorMatches, "invalid reply-to queue ARN.*")
+	_, err = normalizeReplyTo("myqueue")
+	c.Assert(err, qt.ErrorMatches, "invalid reply-to queue URL.*")
+
+	_, err = NewClient(ClientOptions{Notifier: newMemBus().notifier(toClient), BlobStore: newMemBlobStore(), ReplyTo: "myqueue"})
+	c.Assert(err, qt.ErrorMatches, "invalid reply-to queue URL.*")
+}
+
+func TestSQSNotifierSendToQueueRegion(t *testing.T) {
+	c := qt.New(t)
+
+	httpClient := &recordingHTTPClient{}
+	client := sqs.New(sqs.Options{
+		Region:      "eu-north-1",
+		Credentials: credentials.NewStaticCredentialsProvider("id", "secret", ""),
+		HTTPClient:  httpClient,
+	})
+	n := NewSQSNotifier(client, "https://sqs.eu-north-1.amazonaws.com/656975317043/server").(ReplyToSender)
+
+	for _, queue := range []string{
+		"https://sqs.us-east-1.amazonaws.com/656975317043/client",
+		"https://sqs.eu-north-1.amazonaws.com/656975317043/client",
+		// Not an AWS URL, so the client's region.
+		"http://localhost:4566/000000000000/client",
+	} {
+		// The empty response does not parse, which does not matter here.
+		_ = n.SendTo(context.Background(), queue, Note{Bucket: "s3rpctest", Key: "to_client_direct/upper/foo"})
+	}
+
+	c.Assert(httpClient.requests, qt.HasLen, 3)
+	for i, region := range []string{"us-east-1", "eu-north-1", "eu-north-1"} {
+		r := httpClient.requests[i]
+		c.Assert(r.URL.Host, qt.Equals, "sqs."+region+".amazonaws.com")
+		c.Assert(r.Header.Get("Authorization"), qt.Contains, "/"+region+"/sqs/aws4_request")
+	}
+}
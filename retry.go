@@ -0,0 +1,83 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrOutputUpload is returned (wrapped) by Execute when the handler succeeded,
+// but the server failed to upload the output, see ServerOptions.OutputUploadRetry.
+var ErrOutputUpload = errors.New("output upload failed")
+
+// RetryPolicy configures how a failing operation is retried with capped exponential backoff.
+type RetryPolicy struct {
+	// MaxRetries is the max number of retries after the first attempt.
+	// Zero means the default, set it to a negative value to not retry.
+	MaxRetries int
+
+	// MinBackoff is the wait before the first retry, doubled for every retry up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// The default retry policy for output uploads.
+const (
+	defaultOutputUploadRetries    = 3
+	defaultOutputUploadMinBackoff = 200 * time.Millisecond
+	defaultOutputUploadMaxBackoff = 5 * time.Second
+)
+
+func (p RetryPolicy) withDefaults(retries int, minBackoff, maxBackoff time.Duration) RetryPolicy {
+	if p.MaxRetries == 0 {
+		p.MaxRetries = retries
+	}
+	if p.MinBackoff <= 0 {
+		p.MinBackoff = minBackoff
+	}
+	if p.MaxBackoff < p.MinBackoff {
+		p.MaxBackoff = maxBackoff
+		if p.MaxBackoff < p.MinBackoff {
+			p.MaxBackoff = p.MinBackoff
+		}
+	}
+	return p
+}
+
+// retry calls fn until it succeeds, the retries are exhausted, it fails with a fatal error or ctx is done.
+func (p RetryPolicy) retry(ctx context.Context, infof func(format string, args ...interface{}), what string, fn func() error) error {
+	bo := backoff{min: p.MinBackoff, max: p.MaxBackoff}
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.MaxRetries || isFatalError(err) || ctx.Err() != nil {
+			return err
+		}
+		d := bo.next()
+		infof("Failed to %s (attempt %d of %d), retrying in %s: %s", what, attempt+1, p.MaxRetries+1, d, err)
+		if err := sleep(ctx, d); err != nil {
+			return err
+		}
+	}
+}
+
+// uploadOutput uploads the output in filename to key, retried as configured in OutputUploadRetry.
+func (s *Server) uploadOutput(ctx context.Context, filename, key string, user, internal map[string]string) error {
+	return s.outputUploadRetry.retry(ctx, s.infof, "upload output", func() error {
+		return s.upload(ctx, filename, key, user, internal)
+	})
+}
+
+// failOutputUpload responds to the request with ErrOutputUpload after the output upload failed with err.
+// If the client cannot be told either, err is returned, so the request is
+// delivered again (see DeliverySemantics) with the input kept for reprocessing.
+func (s *Server) failOutputUpload(ctx context.Context, parts keyParts, replyTo string, attrs map[string]string, err error) error {
+	if ctx.Err() != nil {
+		return err
+	}
+	s.infof("Failed to upload the output for %q: %s", parts.id, err)
+	if respErr := s.respondError(ctx, parts, replyTo, attrs, fmt.Errorf("%w: %s", ErrOutputUpload, err)); respErr != nil {
+		return err
+	}
+	return nil
+}
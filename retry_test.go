@@ -0,0 +1,97 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestServerOutputUploadRetry(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		failures int
+	}{
+		{"Recovers", 2},
+		{"Fails", 100},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			bus := newMemBus()
+			blobs := &flakyOutputBlobStore{memBlobStore: newMemBlobStore(), failures: test.failures}
+			client := newTestClient(c, bus, blobs, ClientOptions{})
+			newTestServer(c, bus, blobs, ServerOptions{
+				Handlers:          Handlers{"upper": upperHandler},
+				OutputUploadRetry: RetryPolicy{MaxRetries: 3, MinBackoff: time.Millisecond},
+			})
+
+			output, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+			if test.failures <= 3 {
+				c.Assert(err, qt.IsNil)
+				b, err := os.ReadFile(output.Filename)
+				c.Assert(err, qt.IsNil)
+				c.Assert(string(b), qt.Equals, "FOO")
+				c.Assert(blobs.attempts(), qt.Equals, 3)
+				return
+			}
+			c.Assert(errors.Is(err, ErrOutputUpload), qt.IsTrue, qt.Commentf("%v", err))
+			c.Assert(err, qt.ErrorMatches, "apply: output upload failed: upload: flaky")
+			c.Assert(blobs.attempts(), qt.Equals, 4)
+
+			// Both the input and the error response are deleted.
+			waitFor(c, func() bool { return len(blobs.keys()) == 0 })
+		})
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	c := qt.New(t)
+
+	p := RetryPolicy{}.withDefaults(3, time.Second, time.Minute)
+	c.Assert(p, qt.Equals, RetryPolicy{MaxRetries: 3, MinBackoff: time.Second, MaxBackoff: time.Minute})
+	p = RetryPolicy{MaxRetries: -1, MinBackoff: 2 * time.Minute}.withDefaults(3, time.Second, time.Minute)
+	c.Assert(p, qt.Equals, RetryPolicy{MaxRetries: -1, MinBackoff: 2 * time.Minute, MaxBackoff: 2 * time.Minute})
+
+	var calls int
+	err := p.retry(context.Background(), noopInfof, "fail", func() error {
+		calls++
+		return errors.New("failed")
+	})
+	c.Assert(err, qt.ErrorMatches, "failed")
+	c.Assert(calls, qt.Equals, 1)
+}
+
+// flakyOutputBlobStore fails the first failures uploads of handler outputs.
+type flakyOutputBlobStore struct {
+	*memBlobStore
+
+	mu       sync.Mutex
+	failures int
+	calls    int
+}
+
+func (b *flakyOutputBlobStore) Put(ctx context.Context, key string, body io.Reader, metadata map[string]string) error {
+	if strings.HasPrefix(key, toClient+"/") && metadata[metaKind] == "" {
+		b.mu.Lock()
+		b.calls++
+		fail := b.calls <= b.failures
+		b.mu.Unlock()
+		if fail {
+			return errors.New("flaky")
+		}
+	}
+	return b.memBlobStore.Put(ctx, key, body, metadata)
+}
+
+func (b *flakyOutputBlobStore) attempts() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.calls
+}
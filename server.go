@@ -4,15 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math/rand"
 	"os"
-	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/credentials"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -31,27 +30,89 @@ func NewServer(opts ServerOptions) (*Server, error) {
 		opts.PollInterval = 10 * time.Second
 	}
 
+	if opts.MaxPollInterval == 0 {
+		opts.MaxPollInterval = defaultMaxPollIntervalFactor * opts.PollInterval
+	}
+	if opts.MaxPollInterval < opts.PollInterval {
+		opts.MaxPollInterval = opts.PollInterval
+	}
+
 	if opts.Infof == nil {
 		opts.Infof = func(format string, args ...interface{}) {
 			fmt.Println("server: " + fmt.Sprintf(format, args...))
 		}
 	}
 
+	blobs := opts.BlobStore
+	if blobs == nil {
+		var err error
+		blobs, err = newS3BlobStore(newS3Client(opts.AWSConfig, awsCfg, opts.Infof), opts.AWSConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The notifiers to receive from, highest priority first.
+	var receivers []Notifier
+	if opts.Notifier != nil {
+		receivers = append(receivers, opts.Notifier)
+	}
+	receivers = append(receivers, opts.Notifiers...)
+	if len(receivers) == 0 {
+		for _, queue := range opts.queues() {
+			sqsClient, err := newSQSClient(opts.AWSConfig, awsCfg, queue, opts.Infof)
+			if err != nil {
+				return nil, err
+			}
+			receivers = append(receivers, NewSQSNotifier(sqsClient, queue))
+		}
+	}
+
+	keys, err := newKeyLayout(opts.KeyTemplate)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(keys.template, "{op}") && opts.ResolveOp == nil {
+		return nil, fmt.Errorf("key template %q must contain {op}", keys.template)
+	}
+
 	tempDir, err := os.MkdirTemp("", "s3rpc_server")
 	if err != nil {
 		return nil, err
 	}
 
 	return &Server{
-		handlers:      opts.Handlers,
-		pollIntervall: opts.PollInterval,
-		quit:          make(chan struct{}),
+		handlers:            copyHandlers(opts.Handlers),
+		pollIntervall:       opts.PollInterval,
+		maxPollInterval:     opts.MaxPollInterval,
+		handlerTimeout:      opts.HandlerTimeout,
+		opConfigs:           opts.Ops,
+		defaultOpConfig:     opts.DefaultOpConfig,
+		pools:               make(map[string]*opPool),
+		inflight:            make(map[*InFlightRequest]struct{}),
+		deliverySemantics:   opts.DeliverySemantics,
+		resultCacheTTL:      opts.ResultCacheTTL,
+		resultCacheOps:      opts.ResultCacheOps,
+		shadow:              opts.Shadow,
+		retainInputs:        opts.RetainInputs,
+		captureHandlerLogs:  opts.CaptureHandlerLogs,
+		maxRequestAge:       opts.MaxRequestAge,
+		clockSkewTolerance:  opts.ClockSkewTolerance,
+		handlerDeadline:     opts.HandlerClientDeadline,
+		onMetrics:           opts.OnMetrics,
+		outputUploadRetry:   opts.OutputUploadRetry.withDefaults(defaultOutputUploadRetries, defaultOutputUploadMinBackoff, defaultOutputUploadMaxBackoff),
+		manifestInterval:    opts.ManifestInterval,
+		cancelCheckInterval: opts.CancelCheckInterval,
+		quit:                make(chan struct{}),
 		common: &common{
 			bucket:    opts.Bucket,
-			queue:     opts.Queue,
-			s3Client:  s3.NewFromConfig(awsCfg),
-			sqsClient: sqs.NewFromConfig(awsCfg),
+			keys:      keys,
+			blobs:     blobs,
+			notifier:  receivers[0],
+			receivers: receivers,
 			tempDir:   tempDir,
+			hmacKey:   opts.ResponseHMACKey,
+			resolveOp: opts.ResolveOp,
 			infof:     opts.Infof,
 		},
 	}, nil
@@ -60,24 +121,89 @@ func NewServer(opts ServerOptions) (*Server, error) {
 
 // Output is the result of a handler invocation.
 type Output struct {
+	// Filename is the output's file.
+	// A handler may leave it empty to respond with no content,
+	// and the client then gets an empty file, as with an empty output file.
 	Filename string
 	Metadata map[string]string
+
+	// Unchanged may be set by a handler to respond with the input as is,
+	// e.g. when there is nothing to optimize.
+	// The client then downloads the uploaded input object with its metadata
+	// instead of the server uploading a copy. Filename and Metadata are ignored.
+	// It is always false in the Output returned by Client.Execute.
+	Unchanged bool
+
+	// ID is the request ID, set by Client.Execute, e.g. for Client.FetchLog.
+	// It is ignored when returned by a handler.
+	ID string
+
+	// Attributes are the request's attributes echoed back with the response,
+	// set by Client.Execute, see Input.Attributes.
+	// They are ignored when returned by a handler.
+	Attributes map[string]string
 }
 
 // Input is the input to a handler invocation.
 type Input struct {
 	Filename string
+
+	// Metadata is stored as object metadata along with the file.
+	// Keys must be valid HTTP header field names not starting with "s3rpc-",
+	// and they must be unique when lower cased, as S3 stores them in lower case.
+	// Their case is restored on the receiving side.
+	// The same applies to Output.Metadata.
 	Metadata map[string]string
+
+	// Attributes are propagated with the request in the s3rpc metadata of the objects,
+	// delivered to the handler and echoed back with the response, e.g. for routing or observability.
+	// Unlike Metadata, they are kept apart from the file's own metadata.
+	// They do not become SQS message attributes in the default setup, as S3 event notifications
+	// cannot carry them; they only do on the notifications s3rpc sends itself,
+	// i.e. to a ClientOptions.ReplyTo queue, or with a Notifier supporting them.
+	// At most 10 attributes are allowed, and their names must follow the SQS rules:
+	// at most 256 characters of A-Z, a-z, 0-9, underscore, hyphen and period,
+	// no AWS. or Amazon. prefix, and no leading, trailing or consecutive periods.
+	Attributes map[string]string
 }
 
 // Handlers is a map of operation names to handler functions.
-type Handlers map[string]func(ctx context.Context, input Input) (Output, error)
+//
+// The context passed to a handler carries the request's op, ID and metadata,
+// see OpFromContext, RequestIDFromContext and MetadataFromContext,
+// and its deadline reflects ServerOptions.HandlerTimeout.
+type Handlers map[string]HandlerFunc
+
+// HandlerFunc handles an operation, see Handlers.
+type HandlerFunc func(ctx context.Context, input Input) (Output, error)
 
 // Server is a server that processes files from an S3 bucket.
 type Server struct {
-	handlers      Handlers
-	pollIntervall time.Duration
-	quit          chan struct{}
+	handlersMu          sync.RWMutex
+	handlers            Handlers
+	pollIntervall       time.Duration
+	maxPollInterval     time.Duration
+	handlerTimeout      time.Duration
+	opConfigs           map[string]OpConfig
+	defaultOpConfig     OpConfig
+	poolsMu             sync.Mutex
+	pools               map[string]*opPool
+	inflightMu          sync.Mutex
+	inflight            map[*InFlightRequest]struct{}
+	deliverySemantics   DeliverySemantics
+	resultCacheTTL      time.Duration
+	resultCacheOps      []string
+	shadow              bool
+	retainInputs        bool
+	captureHandlerLogs  bool
+	maxRequestAge       time.Duration
+	clockSkewTolerance  time.Duration
+	handlerDeadline     bool
+	onMetrics           func(Metrics)
+	outputUploadRetry   RetryPolicy
+	manifestInterval    time.Duration
+	cancelCheckInterval time.Duration
+	quit                chan struct{}
 	*common
 }
 
@@ -91,11 +217,52 @@ func (s *Server) Close() error {
 	return err
 }
 
+// Handle registers fn as the handler for op, replacing any existing handler.
+// It is safe to call concurrently with ListenAndServe;
+// requests already being processed keep using the handler they started with.
+func (s *Server) Handle(op string, fn HandlerFunc) {
+	s.handlersMu.Lock()
+	defer s.handlersMu.Unlock()
+	s.handlers[op] = fn
+}
+
+// Remove removes the handler for op.
+// Requests for op are then left in the queue for other servers, as with any op without a handler.
+// It is safe to call concurrently with ListenAndServe.
+func (s *Server) Remove(op string) {
+	s.handlersMu.Lock()
+	defer s.handlersMu.Unlock()
+	delete(s.handlers, op)
+}
+
+func (s *Server) handler(op string) HandlerFunc {
+	s.handlersMu.RLock()
+	defer s.handlersMu.RUnlock()
+	return s.handlers[op]
+}
+
+func copyHandlers(handlers Handlers) Handlers {
+	m := make(Handlers, len(handlers))
+	for op, fn := range handlers {
+		m[op] = fn
+	}
+	return m
+}
+
 // ListenAndServe listens for messages and processes them.
 // It blocks until the server is closed.
 func (s *Server) ListenAndServe(ctx context.Context) error {
 	g, ctx := errgroup.WithContext(ctx)
+	if s.manifestInterval > 0 && !s.shadow {
+		g.Go(func() error {
+			s.publishManifests(ctx)
+			return nil
+		})
+	}
 	g.Go(func() error {
+		// Seeded per server, as the global source is not seeded and so the same for every server.
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+		interval := pollInterval{bo: backoff{min: s.pollIntervall, max: s.maxPollInterval}}
 		for {
 			select {
 			case <-s.quit:
@@ -104,73 +271,12 @@ func (s *Server) ListenAndServe(ctx context.Context) error {
 			case <-ctx.Done():
 				return nil
 			default:
-				s.infof("Checking queue %q for new messages", s.queue)
-				ms, err := s.Receive(ctx)
+				handled, busy, err := s.serveBatch(ctx, g)
 				if err != nil {
 					return err
 				}
 
-				for _, m := range ms {
-					if m.Bucket != s.bucket {
-						return fmt.Errorf("expected bucket %q, got %q", s.bucket, m.Bucket)
-					}
-
-					s.infof("Got message with key %q", m.Key)
-
-					op := strings.Split(m.Key, "/")[1]
-					handle := s.handlers[op]
-					if handle == nil {
-						if err := s.releaseMessage(ctx, m.ReceiptHandle); err != nil {
-							return err
-						}
-						continue
-					}
-
-					// We have a handler for this operation, so we can process the file.
-					// Delete the message from the queue before the visibility timeout expires.
-					if err := s.deleteMessage(ctx, m.ReceiptHandle); err != nil {
-						return err
-					}
-
-					baseKey := path.Base(m.Key)
-
-					err = func() error {
-						f, err := os.CreateTemp(s.tempDir, "*_"+baseKey)
-						if err != nil {
-							return fmt.Errorf("tempfile: %w", err)
-						}
-						defer f.Close()
-						defer os.Remove(f.Name())
-
-						metaData, err := s.getObject(ctx, f, m.Key)
-						if err != nil {
-							return err
-						}
-
-						result, err := handle(ctx, Input{Filename: f.Name(), Metadata: metaData})
-						if err != nil {
-							return fmt.Errorf("handle: %w", err)
-						}
-
-						// The client uses an UUID in the base name of the file to identify the
-						// message in the output quueue, so we need to preserve that.
-						// With that, we also know that it's unique.
-						key := toClient + "/" + op + "/" + baseKey
-
-						if err := s.upload(result.Filename, key, result.Metadata); err != nil {
-							return err
-						}
-
-						return err
-
-					}()
-
-					if err != nil {
-						return err
-					}
-				}
-
-				time.Sleep(s.pollIntervall)
+				_ = sleep(ctx, jitter(rnd, interval.next(handled, busy)))
 			}
 		}
 	})
@@ -179,18 +285,561 @@ func (s *Server) ListenAndServe(ctx context.Context) error {
 
 }
 
+// ServeOnce receives a single batch of messages and processes them.
+// It blocks until all of them are processed and returns the number of requests
+// handed to a handler; messages released to be delivered again are not counted.
+//
+// This is useful in tests and when the server is run by a scheduler,
+// e.g. as a cron job, instead of with ListenAndServe.
+func (s *Server) ServeOnce(ctx context.Context) (int, error) {
+	g, gctx := errgroup.WithContext(ctx)
+	handled, _, err := s.serveBatch(gctx, g)
+	if werr := g.Wait(); err == nil {
+		err = werr
+	}
+	return handled, err
+}
+
+// serveBatch receives the next batch of messages and dispatches them to g, see dispatch.
+// It returns the number of messages handed to a handler and released as their op was busy.
+func (s *Server) serveBatch(ctx context.Context, g *errgroup.Group) (handled, busy int, err error) {
+	s.infof("Checking for new messages")
+	ms, err := s.Receive(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, m := range ms {
+		result, err := s.dispatch(ctx, g, m)
+		if err != nil {
+			return handled, busy, err
+		}
+		switch result {
+		case dispatchHandled:
+			handled++
+		case dispatchBusy:
+			busy++
+		}
+	}
+	return handled, busy, nil
+}
+
+// pollInterval is the interval between polls, see ServerOptions.MaxPollInterval.
+type pollInterval struct {
+	bo backoff
+	d  time.Duration
+}
+
+// next returns the interval to wait after a poll where handled messages were handed to a handler
+// and busy messages were released as their op was busy.
+func (p *pollInterval) next(handled, busy int) time.Duration {
+	switch {
+	case handled > 0:
+		// There may be more where that came from.
+		p.bo.reset()
+		p.d = p.bo.next()
+	case busy > 0 && p.d > 0:
+		// Not idle, so keep the interval.
+	default:
+		p.d = p.bo.next()
+	}
+	return p.d
+}
+
+// handleMessage handles a single message received from the notifier.
+func (s *Server) handleMessage(ctx context.Context, m Message) error {
+	if m.Bucket != s.bucket {
+		// The queue may be (mis)shared across buckets; never download from an unexpected bucket.
+		// The message is released, so it ends up in the queue's dead-letter queue, if any.
+		s.infof("Releasing message with key %q for bucket %q, expected bucket %q", m.Key, m.Bucket, s.bucket)
+		return s.ReleaseMessage(ctx, m)
+	}
+
+	if isProbeKey(m.Key) {
+		// Written by Client.Validate.
+		return s.DeleteMessage(ctx, m)
+	}
+
+	s.infof("Got message with key %q", m.Key)
+
+	err := m.Err()
+	if err == nil && !m.Request {
+		err = fmt.Errorf("key %q is not a request", m.Key)
+	}
+	if err != nil {
+		s.infof("Skipping message: %s", err)
+		return s.ReleaseMessage(ctx, m)
+	}
+
+	if m.unresolved {
+		// No server will handle it, so it would be delivered again forever.
+		s.infof("Dropping request %q, no op resolved", m.Key)
+		if err := s.DeleteMessage(ctx, m); err != nil || s.shadow {
+			return err
+		}
+		return s.deleteObject(ctx, m.Key)
+	}
+
+	handle := s.handler(m.Op)
+	if handle == nil {
+		return s.ReleaseMessage(ctx, m)
+	}
+
+	done := s.track(m)
+	defer done()
+
+	// We have a handler for this operation, so we can process the file.
+	if s.deliverySemantics == AtMostOnce {
+		// Delete the message from the queue before the visibility timeout expires.
+		if err := s.DeleteMessage(ctx, m); err != nil {
+			return err
+		}
+		_, err := s.process(ctx, m, handle)
+		return err
+	}
+
+	// Keep the message from being delivered to another server while we're working on it.
+	// If we fail or crash, it will be delivered again once the visibility timeout expires.
+	stop := s.heartbeat(ctx, m)
+	keepInput, err := s.process(ctx, m, handle)
+	stop()
+	if err != nil {
+		return err
+	}
+	if err := s.DeleteMessage(ctx, m); err != nil {
+		return err
+	}
+
+	if !s.shadow && !keepInput {
+		// We now own the input, and the client will not touch it again.
+		_ = s.deleteObject(ctx, m.Key)
+	}
+
+	return nil
+}
+
+// process downloads the input of m, invokes handle and uploads the output.
+// It reports whether the input was handed over to the client (see Output.Unchanged),
+// in which case the server must leave it alone.
+func (s *Server) process(ctx context.Context, m Message, handle HandlerFunc) (_ bool, err error) {
+	pickedUp := time.Now()
+	var internal map[string]string
+	defer func() { s.reportMetrics(m, internal, pickedUp, err) }()
+
+	parts := m.parts
+
+	f, err := os.CreateTemp(s.tempDir, tempPattern(m))
+	if err != nil {
+		return false, noSpaceErr(fmt.Errorf("tempfile: %w", err))
+	}
+	defer f.Close()
+	defer os.Remove(f.Name())
+
+	metaData, internal, err := s.getObject(ctx, f, m.Key)
+	if err != nil {
+		if s.shadow {
+			// Most likely already handled and deleted by the primary server.
+			s.infof("Skipping request %q: %s", m.Key, err)
+			return false, nil
+		}
+		if errors.Is(err, ErrUnsupportedProtocol) {
+			// Sent by a newer client; let it know.
+			s.infof("Rejecting request %q: %s", m.Key, err)
+			return false, s.respondError(ctx, parts, s.replyTo(internal), messageAttributes(m.Note, internal), err)
+		}
+		if s.isCancelled(ctx, parts.id) {
+			// Already dropped and its input deleted, e.g. by another server.
+			s.infof("Dropping cancelled request %q: %s", m.Key, err)
+			return false, s.respondError(ctx, parts, s.replyTo(internal), messageAttributes(m.Note, internal), ErrRequestCancelled)
+		}
+		return false, err
+	}
+
+	stale := s.isStale(internal, time.Now())
+	expired := s.isExpired(internal, time.Now())
+
+	if s.shadow {
+		if stale || expired {
+			s.infof("Skipping stale or expired request %q", m.Key)
+			return false, nil
+		}
+		return false, s.processShadow(ctx, Input{Filename: f.Name(), Metadata: metaData, Attributes: messageAttributes(m.Note, internal)}, m, handle)
+	}
+
+	keepInput := internal[metaKeep] == "true"
+	if keepInput {
+		s.infof("Keeping %s as requested by the client, see ClientOptions.KeepObjects", m.Key)
+	}
+	// Left to the bucket's lifecycle rule for the shadow servers, see RetainInputs.
+	keepInput = keepInput || s.retainInputs
+	if s.deliverySemantics == AtMostOnce {
+		// We now own the input, and the client will not touch it again
+		// unless we hand it over.
+		// The message is already gone, so there is no need to keep the input around.
+		defer func() {
+			if !keepInput {
+				_ = s.deleteObject(ctx, m.Key)
+			}
+		}()
+	}
+
+	replyTo := s.replyTo(internal)
+	attrs := messageAttributes(m.Note, internal)
+
+	if stale {
+		// The input is deleted as with any other handled request.
+		s.infof("Rejecting stale request %q", m.Key)
+		return keepInput, s.respondError(ctx, parts, replyTo, attrs, ErrStaleRequest)
+	}
+
+	if expired {
+		// No one is waiting for the response; the input is deleted as with any other handled request.
+		s.infof("Dropping expired request %q, the client has given up", m.Key)
+		return keepInput, nil
+	}
+
+	if s.isCancelled(ctx, parts.id) {
+		// The input is deleted as with any other handled request.
+		s.infof("Dropping cancelled request %q", m.Key)
+		return keepInput, s.respondError(ctx, parts, replyTo, attrs, ErrRequestCancelled)
+	}
+
+	var cacheKey string
+	if s.isCacheable(m.Op) {
+		cacheKey, err = resultCacheKey(m.Op, f.Name(), metaData)
+		if err != nil {
+			return keepInput, err
+		}
+		if checksum, found := s.lookupCache(ctx, cacheKey); found {
+			s.infof("Using cached result %s", cacheKey)
+			return keepInput, s.respondRef(ctx, parts, replyTo, attrs, cacheKey, checksum, false)
+		}
+	}
+
+	info := &requestInfo{op: m.Op, id: parts.id, metadata: metaData}
+	defer info.removeTempFiles()
+	hctx := withRequestInfo(ctx, info)
+	if timeout := s.pool(m.Op).timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		hctx, cancel = context.WithTimeout(hctx, timeout)
+		defer cancel()
+	}
+	if deadline, ok := s.clientDeadline(internal); ok && s.handlerDeadline {
+		var cancel context.CancelFunc
+		hctx, cancel = context.WithDeadline(hctx, deadline)
+		defer cancel()
+	}
+	if internal[metaWantProgress] == "true" {
+		hctx = context.WithValue(hctx, progressReporterKey{}, &progressReporter{s: s, parts: parts, replyTo: replyTo})
+	}
+
+	cancelled := func() bool { return false }
+	if s.cancelCheckInterval > 0 {
+		var stop func()
+		hctx, cancelled, stop = s.watchCancel(hctx, parts.id)
+		defer stop()
+	}
+
+	var log *handlerLog
+	if s.captureHandlerLogs {
+		log = &handlerLog{}
+		hctx = context.WithValue(hctx, handlerLogKey{}, log)
+	}
+
+	result, err := handle(hctx, Input{Filename: f.Name(), Metadata: metaData, Attributes: attrs})
+	if log != nil {
+		// Store it before responding, so it is there when the client gets the response.
+		s.storeLog(ctx, parts.id, log)
+	}
+	if cancelled() {
+		// Whatever the handler made of it, the output is discarded.
+		s.infof("Discarding the result of cancelled request %q", m.Key)
+		return keepInput, s.respondError(ctx, parts, replyTo, attrs, ErrRequestCancelled)
+	}
+	if err != nil {
+		if s.handlerDeadline && s.isExpired(internal, time.Now()) {
+			s.infof("Dropping expired request %q, the client has given up: %s", m.Key, err)
+			return keepInput, nil
+		}
+		return keepInput, fmt.Errorf("handle: %w", err)
+	}
+
+	if result.Filename == "" && !result.Unchanged {
+		// No output, which the client gets as an empty file.
+		empty, err := s.writeTemp(emptyOutputName, nil)
+		if err != nil {
+			return keepInput, err
+		}
+		defer os.Remove(empty)
+		result.Filename = empty
+	}
+
+	if result.Unchanged {
+		if cacheKey == "" {
+			// Point the client at the input, which it deletes once downloaded,
+			// unless retained for the shadow servers.
+			// The header was read when downloading the input.
+			h, _ := readHeader(internal)
+			if err := s.respondRef(ctx, parts, replyTo, attrs, m.Key, h.Checksum, !s.retainInputs); err != nil {
+				return keepInput, err
+			}
+			keepInput = true
+			return keepInput, nil
+		}
+		result = Output{Filename: f.Name(), Metadata: metaData}
+	}
+
+	if cacheKey != "" {
+		checksum, err := s.cacheResult(ctx, cacheKey, result)
+		if err != nil {
+			return keepInput, s.failOutputUpload(ctx, parts, replyTo, attrs, err)
+		}
+		return keepInput, s.respondRef(ctx, parts, replyTo, attrs, cacheKey, checksum, false)
+	}
+
+	key := s.responseKey(parts, replyTo)
+
+	signature, err := s.signFile(parts.id, result.Filename)
+	if err != nil {
+		return keepInput, err
+	}
+	attrsMeta, err := encodeAttributes(attrs)
+	if err != nil {
+		return keepInput, err
+	}
+	if err := s.uploadOutput(ctx, result.Filename, key, result.Metadata, mergeMetadata(signature, attrsMeta)); err != nil {
+		return keepInput, s.failOutputUpload(ctx, parts, replyTo, attrs, err)
+	}
+
+	return keepInput, s.notifyClient(ctx, replyTo, key, attrs)
+}
+
+func (s *Server) processShadow(ctx context.Context, input Input, m Message, handle HandlerFunc) error {
+	info := &requestInfo{op: m.Op, id: m.ID, metadata: input.Metadata}
+	defer info.removeTempFiles()
+	hctx := withRequestInfo(ctx, info)
+	if timeout := s.pool(m.Op).timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		hctx, cancel = context.WithTimeout(hctx, timeout)
+		defer cancel()
+	}
+
+	result, err := handle(hctx, input)
+	if err != nil {
+		// Don't let a failing canary take the server down.
+		s.infof("Shadow handler failed for %q: %s", m.Key, err)
+		return nil
+	}
+	s.infof("Discarding shadow result %s for %q", result.Filename, m.Key)
+	if result.Filename != "" && result.Filename != input.Filename {
+		_ = os.Remove(result.Filename)
+	}
+	return nil
+}
+
+// heartbeat periodically extends the visibility of m, if supported by the notifier,
+// until the returned func is called.
+func (s *Server) heartbeat(ctx context.Context, m Message) func() {
+	e, ok := m.source(s.common).(VisibilityExtender)
+	if !ok {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(heartbeatInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if err := e.Extend(ctx, m.Note, visibilitySeconds*time.Second); err != nil && ctx.Err() == nil {
+					s.infof("Failed to extend visibility of %q: %s", m.Key, err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// DeliverySemantics controls when the server acknowledges a request message.
+type DeliverySemantics int
+
+const (
+	// AtLeastOnce acknowledges the message after the response has been sent.
+	// While the handler runs, the message is kept invisible to other servers,
+	// given that the Notifier implements VisibilityExtender.
+	// If the server crashes or the handler fails, the message is delivered again,
+	// so handlers should be idempotent.
+	// This is the default.
+	AtLeastOnce DeliverySemantics = iota
+
+	// AtMostOnce acknowledges the message, and deletes the input once downloaded, before
+	// the handler is invoked.
+	// A request is never processed twice, but if the server crashes or the handler fails,
+	// the request is lost and the client will eventually time out.
+	// This can be a good fit for non-idempotent, non-critical ops.
+	AtMostOnce
+)
+
 // ServerOptions are options for the server.
 type ServerOptions struct {
 	// Handlers maps an operation to a handler.
 	// The operation is also the first path segment below in/out in the bucket.
+	// Handlers can also be added and removed later, see Server.Handle and Server.Remove.
 	Handlers Handlers
 
 	// The in queue to poll for new messages.
+	// Not used if Notifier or Notifiers is set.
 	Queue string
 
+	// Queues are additional in queues to poll, in priority order.
+	// Queue, if set, has the highest priority.
+	// A lower priority queue is only polled when all higher priority queues are empty,
+	// so with SQS long polling, each empty queue adds its wait time to the latency
+	// of the queues below it.
+	// Not used if Notifier or Notifiers is set.
+	Queues []string
+
+	// Notifier is used to receive requests from clients.
+	// If neither Notifier nor Notifiers is set, an SQS notifier polling Queue (and Queues) is used.
+	Notifier Notifier
+
+	// Notifiers are additional notifiers to receive requests from, in priority order,
+	// see Queues.
+	// Notifier, if set, has the highest priority.
+	Notifiers []Notifier
+
+	// BlobStore is used to fetch inputs and store outputs.
+	// If not set, an S3 blob store using Bucket is used.
+	BlobStore BlobStore
+
 	// PollInterval is the interval between polling for new messages.
+	// The actual wait is randomized between half of it and one and a half of it, averaging PollInterval,
+	// so a fleet of servers polling the same queue does not poll in lockstep.
+	// Defaults to 10 seconds.
 	PollInterval time.Duration
 
+	// MaxPollInterval is the cap of the interval, which doubles after every poll where no request
+	// was handled, e.g. on an empty queue, and is reset to PollInterval as soon as one is.
+	// Polls where requests were only released as their op was busy (see Ops) leave it as is.
+	// Defaults to 4 times PollInterval; set it to PollInterval to poll at a fixed interval.
+	MaxPollInterval time.Duration
+
+	// HandlerTimeout, if set, is the maximum time a handler invocation may take.
+	// It is applied as a deadline on the handler's context.
+	// It can be overridden per op, see Ops.
+	HandlerTimeout time.Duration
+
+	// Ops configures the concurrency, timeout and rate limit per op.
+	// Each op is handled by its own pool of workers, so a slow op does not hold up the others.
+	// Requests for an op with all its workers busy (or over its rate limit) are released
+	// to be delivered again later, possibly to another server.
+	Ops map[string]OpConfig
+
+	// DefaultOpConfig is used for ops not in Ops.
+	DefaultOpConfig OpConfig
+
+	// DeliverySemantics controls when a request message is acknowledged.
+	// Defaults to AtLeastOnce, see AtMostOnce for the tradeoffs.
+	DeliverySemantics DeliverySemantics
+
+	// ResultCacheTTL, if set, enables the result cache.
+	// Results are then cached keyed by the op, the SHA-256 of the input and its metadata,
+	// and identical requests are answered from the cache without invoking the handler.
+	// Cached results are stored below the cache/ prefix in the bucket; set up a lifecycle
+	// rule expiring them after the same duration.
+	ResultCacheTTL time.Duration
+
+	// ResultCacheOps limits the result cache to the given ops.
+	// If empty, the results of all ops are cached.
+	ResultCacheOps []string
+
+	// Shadow, if set, makes this a shadow server that invokes the handlers,
+	// but never responds to the client, deletes the input or reports progress.
+	//
+	// This is meant for SNS fan-out setups (see NewFanOutProvisioner), where every
+	// server fleet reads from its own subscriber queue and so receives a copy of every request.
+	// Exactly one fleet, the primary, must be non-shadow; it writes the single response
+	// the client waits for and deletes the input once done, unless RetainInputs is set.
+	// A typical use is canarying a new handler version as a shadow fleet next to the primary fleet.
+	// Set RetainInputs on the primary, else shadow servers are best effort: if the primary
+	// is done before a shadow server gets to a request, the input is gone and the shadow server skips it.
+	Shadow bool
+
+	// RetainInputs, if set, leaves the inputs of the requests handled to the bucket's lifecycle rule,
+	// which expires them after a day (see NewProvisioner), instead of deleting them once done.
+	// Set this on the primary in fan-out setups so the shadow servers find the inputs, see Shadow.
+	RetainInputs bool
+
+	// CaptureHandlerLogs, if set, stores what the handlers write to HandlerLog
+	// in the bucket below logs/, to be fetched with Client.FetchLog.
+	// Set up a lifecycle rule expiring them.
+	// Shadow servers never store logs.
+	CaptureHandlerLogs bool
+
+	// MaxRequestAge, if set, is the max time from a client submitting a request
+	// to a server picking it up.
+	// Older requests are not handled; the input is deleted and Execute fails with ErrStaleRequest.
+	// This is meant for time-sensitive ops where a late result is of no use.
+	MaxRequestAge time.Duration
+
+	// ClockSkewTolerance is added to MaxRequestAge and to the client's deadline
+	// to allow for the client's and the server's clocks not being in sync.
+	ClockSkewTolerance time.Duration
+
+	// HandlerClientDeadline, if set, applies the client's deadline (see ClientOptions.Timeout)
+	// to the handler's context, so a handler can stop working on a request no one waits for anymore.
+	// Requests past the client's deadline when picked up are always dropped without invoking the handler.
+	HandlerClientDeadline bool
+
+	// ResponseHMACKey, if set, is the key the responses are signed with,
+	// see ClientOptions.ResponseHMACKey.
+	ResponseHMACKey []byte
+
+	// ResolveOp, if set, resolves the op, and so the handler, of a request, overriding the op
+	// parsed from the key, e.g. for a KeyTemplate without {op} or to route legacy op names.
+	// It is called for request messages matching the key template, with Op set from the key, if any.
+	// If it returns false, the request is dropped, i.e. its message and input are deleted,
+	// as it would else be delivered again forever.
+	// The op in the key is still used for the response's key.
+	ResolveOp func(m Message) (op string, ok bool)
+
+	// OnMetrics, if set, receives the queue wait and processing time of every request picked up,
+	// see Metrics, e.g. to tell whether to add servers (long waits) or optimize the handlers.
+	// It may be called concurrently.
+	OnMetrics func(Metrics)
+
+	// OutputUploadRetry configures the retries of a failing upload of a handler's output.
+	// Defaults to 3 retries with a backoff from 200ms up to 5s.
+	// If the upload ultimately fails, the server responds with ErrOutputUpload,
+	// and the request is done, with the input deleted as for any other response.
+	// If that response fails as well, the request is delivered again
+	// (see DeliverySemantics) and the input is kept for reprocessing.
+	OutputUploadRetry RetryPolicy
+
+	// ManifestInterval, if set, makes ListenAndServe publish the server's manifest
+	// when started and then at this interval, see Server.PublishManifest.
+	// Shadow servers never publish it.
+	// Keep it well below the expiry of any lifecycle rule covering the manifest,
+	// e.g. the provisioned bucket's rule expiring all objects after a day.
+	ManifestInterval time.Duration
+
+	// CancelCheckInterval, if set, makes the server check whether a request was cancelled
+	// (see Client.Cancel) at this interval while its handler runs, cancelling the handler's context when it is.
+	// Each check is a HEAD request for the cancellation marker (a GET if the BlobStore does not implement Stater),
+	// so do not set it lower than needed.
+	// Without it, only requests cancelled before being picked up are dropped,
+	// which the server checks for with one such request for every request it picks up.
+	CancelCheckInterval time.Duration
+
 	// Infof logs info messages.
 	Infof func(format string, args ...interface{})
 
@@ -203,17 +852,32 @@ func (opts *ServerOptions) init() error {
 		opts.Region = defaultRegion
 	}
 
-	if opts.AccessKeyID == "" {
-		return errors.New("access key id is required")
-	}
+	hasNotifier := opts.Notifier != nil || len(opts.Notifiers) > 0
+
+	if opts.BlobStore == nil || !hasNotifier {
+		if opts.AccessKeyID == "" {
+			return errors.New("access key id is required")
+		}
 
-	if opts.SecretAccessKey == "" {
-		return errors.New("secret access key is required")
+		if opts.SecretAccessKey == "" {
+			return errors.New("secret access key is required")
+		}
 	}
 
-	if opts.Queue == "" {
+	if len(opts.queues()) == 0 && !hasNotifier {
 		return fmt.Errorf("queue is required")
 	}
 
 	return nil
 }
+
+// queues returns the configured queues, highest priority first.
+func (opts *ServerOptions) queues() []string {
+	var queues []string
+	for _, queue := range append([]string{opts.Queue}, opts.Queues...) {
+		if queue != "" {
+			queues = append(queues, queue)
+		}
+	}
+	return queues
+}
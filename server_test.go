@@ -0,0 +1,595 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestDeliverySemanticsCrash(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		semantics DeliverySemantics
+	}{
+		{"AtLeastOnce", AtLeastOnce},
+		{"AtMostOnce", AtMostOnce},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			bus := newMemBus()
+			blobs := newMemBlobStore()
+
+			started := make(chan struct{})
+			crash := make(chan struct{})
+			crashingHandlers := Handlers{
+				"upper": func(ctx context.Context, input Input) (Output, error) {
+					close(started)
+					<-crash
+					return Output{}, errors.New("crash")
+				},
+			}
+
+			client := newTestClient(c, bus, blobs, ClientOptions{Timeout: 2 * time.Second})
+			crashed := newTestServer(c, bus, blobs, ServerOptions{Handlers: crashingHandlers, DeliverySemantics: test.semantics})
+
+			type result struct {
+				output Output
+				err    error
+			}
+			done := make(chan result, 1)
+			go func() {
+				output, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+				done <- result{output, err}
+			}()
+
+			<-started
+			close(crash)
+			// A failing request does not stop the server, so stop it.
+			crashed.Close()
+
+			// Wait for the crashed server to stop.
+			time.Sleep(50 * time.Millisecond)
+
+			requests := bus.queue(toServer)
+			switch test.semantics {
+			case AtLeastOnce:
+				c.Assert(requests.len(), qt.Equals, 1)
+				c.Assert(blobs.keys(), qt.HasLen, 1)
+			case AtMostOnce:
+				c.Assert(requests.len(), qt.Equals, 0)
+				c.Assert(blobs.keys(), qt.HasLen, 0)
+			}
+
+			// Let the visibility timeout expire and start a healthy server.
+			requests.expire()
+			newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}, DeliverySemantics: test.semantics})
+
+			r := <-done
+			switch test.semantics {
+			case AtLeastOnce:
+				c.Assert(r.err, qt.IsNil)
+				b, err := os.ReadFile(r.output.Filename)
+				c.Assert(err, qt.IsNil)
+				c.Assert(string(b), qt.Equals, "FOO")
+			case AtMostOnce:
+				c.Assert(r.err, qt.ErrorMatches, ".*deadline exceeded")
+			}
+			// The server acknowledges after the response is sent.
+			waitFor(c, func() bool { return requests.len() == 0 && len(blobs.keys()) == 0 })
+		})
+	}
+}
+
+func TestServerQueuePriority(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+	keys, err := newKeyLayout("")
+	c.Assert(err, qt.IsNil)
+
+	// Queue up requests before the server starts.
+	for i, queue := range []string{"low", "high", "low", "high", "low", "high"} {
+		key := keys.key(toServer, keyParts{op: "upper", id: fmt.Sprintf("%s%02d", testID[:24], i), name: "in.txt"}, time.Now())
+		c.Assert(blobs.Put(context.Background(), key, strings.NewReader(queue), nil), qt.IsNil)
+		bus.queue(queue).push(Note{Bucket: testBucket, Key: key})
+	}
+
+	var (
+		mu      sync.Mutex
+		handled []string
+	)
+	handlers := Handlers{
+		"upper": func(ctx context.Context, input Input) (Output, error) {
+			b, err := os.ReadFile(input.Filename)
+			if err != nil {
+				return Output{}, err
+			}
+			mu.Lock()
+			handled = append(handled, string(b))
+			mu.Unlock()
+			return upperHandler(ctx, input)
+		},
+	}
+	newTestServer(c, bus, blobs, ServerOptions{
+		Handlers:  handlers,
+		Notifier:  bus.notifier("high"),
+		Notifiers: []Notifier{bus.notifier("low")},
+	})
+
+	// The server acknowledges after the response is sent.
+	waitFor(c, func() bool {
+		return bus.queue(toClient).len() == 6 && bus.queue("high").len() == 0 && bus.queue("low").len() == 0
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(handled, qt.DeepEquals, []string{"high", "high", "high", "low", "low", "low"})
+}
+
+func TestServerOptionsQueues(t *testing.T) {
+	c := qt.New(t)
+
+	opts := ServerOptions{Queue: "a", Queues: []string{"b", "", "c"}}
+	c.Assert(opts.queues(), qt.DeepEquals, []string{"a", "b", "c"})
+	opts = ServerOptions{Queues: []string{"b"}}
+	c.Assert(opts.queues(), qt.DeepEquals, []string{"b"})
+}
+
+// fanOutNotifier wraps a Notifier and also sends requests to the given queues,
+// like an SNS topic with multiple subscribers.
+type fanOutNotifier struct {
+	Notifier
+	bus    *memBus
+	queues []string
+}
+
+func (n *fanOutNotifier) Send(ctx context.Context, note Note) error {
+	if strings.HasPrefix(note.Key, toServer+"/") {
+		for _, queue := range n.queues {
+			n.bus.queue(queue).push(note)
+		}
+	}
+	return n.Notifier.Send(ctx, note)
+}
+
+func TestServerShadow(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	shadowed := make(chan string, 10)
+	shadowHandlers := Handlers{
+		"upper": func(ctx context.Context, input Input) (Output, error) {
+			b, err := os.ReadFile(input.Filename)
+			if err != nil {
+				return Output{}, err
+			}
+			shadowed <- string(b)
+			filename := input.Filename + ".shadow"
+			return Output{Filename: filename}, os.WriteFile(filename, []byte("shadow"), 0644)
+		},
+	}
+
+	client := newTestClient(c, bus, blobs, ClientOptions{
+		Notifier: &fanOutNotifier{Notifier: bus.notifier(toClient), bus: bus, queues: []string{"canary"}},
+	})
+	// Start the shadow first so it gets to the request before the primary deletes the input.
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: shadowHandlers, Notifier: bus.notifier("canary"), Shadow: true})
+	time.Sleep(20 * time.Millisecond)
+
+	primaryBlocked := make(chan struct{})
+	primaryHandlers := Handlers{
+		"upper": func(ctx context.Context, input Input) (Output, error) {
+			<-primaryBlocked
+			return upperHandler(ctx, input)
+		},
+	}
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: primaryHandlers})
+
+	go func() {
+		c.Check(<-shadowed, qt.Equals, "foo")
+		close(primaryBlocked)
+	}()
+
+	output, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.IsNil)
+	b, err := os.ReadFile(output.Filename)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "FOO")
+
+	// The shadow server may still be acknowledging its copy of the request.
+	waitFor(c, func() bool { return len(blobs.keys()) == 0 && bus.queue("canary").len() == 0 })
+	c.Assert(bus.queue(toClient).len(), qt.Equals, 0)
+}
+
+func TestServerShadowRetainInputs(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	shadowed := make(chan string, 10)
+	shadowHandlers := Handlers{
+		"upper": func(ctx context.Context, input Input) (Output, error) {
+			b, err := os.ReadFile(input.Filename)
+			if err != nil {
+				return Output{}, err
+			}
+			shadowed <- string(b)
+			return upperHandler(ctx, input)
+		},
+	}
+
+	client := newTestClient(c, bus, blobs, ClientOptions{
+		Notifier: &fanOutNotifier{Notifier: bus.notifier(toClient), bus: bus, queues: []string{"canary"}},
+	})
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}, RetainInputs: true})
+
+	output, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.IsNil)
+	input := "to_server/upper/" + output.ID + "_in.txt"
+	waitFor(c, func() bool { return bus.queue(toServer).len() == 0 })
+	c.Assert(blobs.has(input), qt.IsTrue)
+
+	// The primary is done, but the input is still there for the shadow server.
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: shadowHandlers, Notifier: bus.notifier("canary"), Shadow: true})
+	c.Assert(<-shadowed, qt.Equals, "foo")
+	waitFor(c, func() bool { return bus.queue("canary").len() == 0 })
+	c.Assert(blobs.keys(), qt.DeepEquals, []string{input})
+}
+
+func TestServerUnchanged(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts ServerOptions
+	}{
+		{"AtLeastOnce", ServerOptions{}},
+		{"AtMostOnce", ServerOptions{DeliverySemantics: AtMostOnce}},
+		{"ResultCache", ServerOptions{ResultCacheTTL: time.Hour}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			bus := newMemBus()
+			blobs := newMemBlobStore()
+
+			opts := test.opts
+			opts.Handlers = Handlers{
+				"noop": func(ctx context.Context, input Input) (Output, error) {
+					return Output{Unchanged: true}, nil
+				},
+			}
+			client := newTestClient(c, bus, blobs, ClientOptions{})
+			newTestServer(c, bus, blobs, opts)
+
+			output, err := client.Execute(context.Background(), "noop", Input{Filename: writeTestFile(c, "in.txt", "foo"), Metadata: map[string]string{"a": "b"}})
+			c.Assert(err, qt.IsNil)
+			c.Assert(output.Unchanged, qt.IsFalse)
+			c.Assert(output.Metadata, qt.DeepEquals, map[string]string{"a": "b"})
+			b, err := os.ReadFile(output.Filename)
+			c.Assert(err, qt.IsNil)
+			c.Assert(string(b), qt.Equals, "foo")
+
+			// The input is cleaned up, only the cached result (if any) is left.
+			waitFor(c, func() bool {
+				for _, key := range blobs.keys() {
+					if !strings.HasPrefix(key, cachePrefix+"/") {
+						return false
+					}
+				}
+				return true
+			})
+		})
+	}
+}
+
+func TestServerHandle(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	client := newTestClient(c, bus, blobs, ClientOptions{Timeout: 500 * time.Millisecond})
+	server := newTestServer(c, bus, blobs, ServerOptions{})
+
+	execute := func(op string) (string, error) {
+		output, err := client.Execute(context.Background(), op, Input{Filename: writeTestFile(c, "in.txt", "foo")})
+		if err != nil {
+			return "", err
+		}
+		b, err := os.ReadFile(output.Filename)
+		return string(b), err
+	}
+
+	server.Handle("upper", upperHandler)
+	s, err := execute("upper")
+	c.Assert(err, qt.IsNil)
+	c.Assert(s, qt.Equals, "FOO")
+
+	// Replace it.
+	server.Handle("upper", func(ctx context.Context, input Input) (Output, error) {
+		filename := input.Filename + ".out"
+		return Output{Filename: filename}, os.WriteFile(filename, []byte("replaced"), 0644)
+	})
+	s, err = execute("upper")
+	c.Assert(err, qt.IsNil)
+	c.Assert(s, qt.Equals, "replaced")
+
+	server.Remove("upper")
+	_, err = execute("upper")
+	c.Assert(err, qt.ErrorMatches, ".*context deadline exceeded")
+}
+
+func TestServerServeOnce(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	client := newTestClient(c, bus, blobs, ClientOptions{})
+	server, err := NewServer(ServerOptions{
+		Notifier:  bus.notifier(toServer),
+		BlobStore: blobs,
+		Handlers:  Handlers{"upper": upperHandler},
+		Infof:     noopInfof,
+		AWSConfig: AWSConfig{Bucket: testBucket},
+	})
+	c.Assert(err, qt.IsNil)
+	defer server.Close()
+
+	// Nothing to do.
+	handled, err := server.ServeOnce(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(handled, qt.Equals, 0)
+
+	type result struct {
+		output Output
+		err    error
+	}
+	done := make(chan result, 2)
+	go func() {
+		output, err := client.Execute(ctx, "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+		done <- result{output, err}
+	}()
+	go func() {
+		_, err := client.Execute(ctx, "unknown", Input{Filename: writeTestFile(c, "in2.txt", "bar")})
+		done <- result{err: err}
+	}()
+
+	waitFor(c, func() bool { return bus.queue(toServer).len() == 2 })
+
+	// The request for the unknown op is released.
+	handled, err = server.ServeOnce(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(handled, qt.Equals, 1)
+
+	r := <-done
+	c.Assert(r.err, qt.IsNil)
+	b, err := os.ReadFile(r.output.Filename)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "FOO")
+}
+
+func TestServerForeignBucket(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	var (
+		mu  sync.Mutex
+		got []string
+	)
+	blobs := &hookBlobStore{BlobStore: newMemBlobStore(), onGet: func(key string) {
+		mu.Lock()
+		got = append(got, key)
+		mu.Unlock()
+	}}
+
+	client := newTestClient(c, bus, blobs, ClientOptions{})
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}})
+
+	foreign := "to_server/upper/01gd0m5k5kh5vm3kfr3qmdq4zs_in.txt"
+	bus.queue(toServer).push(Note{Bucket: "foreign", Key: foreign})
+
+	// The server keeps running and serves requests for its own bucket.
+	output, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.IsNil)
+	b, err := os.ReadFile(output.Filename)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "FOO")
+
+	// The foreign message is released, not downloaded.
+	// The request message may not be deleted yet when the response arrives.
+	waitFor(c, func() bool { return bus.queue(toServer).len() == 1 })
+	mu.Lock()
+	defer mu.Unlock()
+	for _, key := range got {
+		c.Assert(key, qt.Not(qt.Equals), foreign)
+	}
+}
+
+func TestServerResolveOp(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	// A layout without the op, which is resolved from the file extension instead.
+	const keyTemplate = "{id}_{name}"
+	client := newTestClient(c, bus, blobs, ClientOptions{AWSConfig: AWSConfig{KeyTemplate: keyTemplate}})
+	server, err := NewServer(ServerOptions{
+		Notifier:  bus.notifier(toServer),
+		BlobStore: blobs,
+		Handlers:  Handlers{"upper": upperHandler},
+		ResolveOp: func(m Message) (string, bool) {
+			if strings.HasSuffix(m.Key, ".txt") {
+				return "upper", true
+			}
+			return "", false
+		},
+		Infof:     noopInfof,
+		AWSConfig: AWSConfig{Bucket: testBucket, KeyTemplate: keyTemplate},
+	})
+	c.Assert(err, qt.IsNil)
+	defer server.Close()
+
+	key := server.keys.key(toServer, keyParts{id: testID, name: "in.bin"}, time.Now())
+	c.Assert(blobs.Put(ctx, key, strings.NewReader("foo"), nil), qt.IsNil)
+	bus.queue(toServer).push(Note{Bucket: testBucket, Key: key})
+
+	// Dropped, as no op is resolved.
+	handled, err := server.ServeOnce(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(handled, qt.Equals, 0)
+	c.Assert(blobs.has(key), qt.IsFalse)
+	bus.queue(toServer).expire()
+	c.Assert(bus.queue(toServer).len(), qt.Equals, 0)
+	handled, err = server.ServeOnce(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(handled, qt.Equals, 0)
+
+	done := make(chan error, 1)
+	go func() {
+		handled, err := server.ServeOnce(ctx)
+		if err == nil && handled != 1 {
+			err = fmt.Errorf("handled %d", handled)
+		}
+		done <- err
+	}()
+	output, err := client.Execute(ctx, "ignored", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.IsNil)
+	c.Assert(<-done, qt.IsNil)
+	b, err := os.ReadFile(output.Filename)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "FOO")
+}
+
+func TestServerPollBackoff(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+	notifier := &instantNotifier{memNotifier: bus.notifier(toServer)}
+
+	client := newTestClient(c, bus, blobs, ClientOptions{})
+	newTestServer(c, bus, blobs, ServerOptions{
+		Notifier:        notifier,
+		PollInterval:    time.Millisecond,
+		MaxPollInterval: 50 * time.Millisecond,
+		Handlers:        Handlers{"upper": upperHandler},
+	})
+
+	// Without the backoff, this would be a few hundred polls.
+	time.Sleep(300 * time.Millisecond)
+	c.Assert(notifier.receiveCalls() < 30, qt.IsTrue, qt.Commentf("%d polls", notifier.receiveCalls()))
+
+	// Picked up within the capped interval.
+	start := time.Now()
+	_, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(err, qt.IsNil)
+	c.Assert(time.Since(start) < time.Second, qt.IsTrue)
+}
+
+func TestJitter(t *testing.T) {
+	c := qt.New(t)
+
+	rnd := rand.New(rand.NewSource(32))
+	seen := make(map[time.Duration]bool)
+	var sum time.Duration
+	const n = 10000
+	for i := 0; i < n; i++ {
+		d := jitter(rnd, 10*time.Millisecond)
+		c.Assert(d >= 5*time.Millisecond && d <= 15*time.Millisecond, qt.IsTrue, qt.Commentf("%s", d))
+		seen[d] = true
+		sum += d
+	}
+	c.Assert(len(seen) > 1, qt.IsTrue)
+	// The mean is kept.
+	mean := sum / n
+	c.Assert(mean > 9800*time.Microsecond && mean < 10200*time.Microsecond, qt.IsTrue, qt.Commentf("%s", mean))
+	c.Assert(jitter(rnd, 0), qt.Equals, time.Duration(0))
+}
+
+func TestPollInterval(t *testing.T) {
+	c := qt.New(t)
+
+	p := pollInterval{bo: backoff{min: time.Second, max: 4 * time.Second}}
+	for _, test := range []struct {
+		handled, busy int
+		expect        time.Duration
+	}{
+		{0, 0, time.Second},
+		{0, 0, 2 * time.Second},
+		// Only released as busy, not idle.
+		{0, 3, 2 * time.Second},
+		{0, 0, 4 * time.Second},
+		{0, 0, 4 * time.Second},
+		{1, 2, time.Second},
+		{0, 1, time.Second},
+		{0, 0, 2 * time.Second},
+	} {
+		c.Assert(p.next(test.handled, test.busy), qt.Equals, test.expect, qt.Commentf("%+v", test))
+	}
+
+	// Busy on the first poll.
+	p = pollInterval{bo: backoff{min: time.Second, max: 4 * time.Second}}
+	c.Assert(p.next(0, 1), qt.Equals, time.Second)
+	c.Assert(p.next(0, 1), qt.Equals, time.Second)
+}
+
+func TestNewServerPollInterval(t *testing.T) {
+	c := qt.New(t)
+
+	newServer := func(opts ServerOptions) *Server {
+		opts.Notifier = newMemBus().notifier(toServer)
+		opts.BlobStore = newMemBlobStore()
+		opts.Infof = noopInfof
+		opts.Bucket = testBucket
+		s, err := NewServer(opts)
+		c.Assert(err, qt.IsNil)
+		c.Cleanup(func() { s.Close() })
+		return s
+	}
+
+	s := newServer(ServerOptions{})
+	c.Assert(s.pollIntervall, qt.Equals, 10*time.Second)
+	c.Assert(s.maxPollInterval, qt.Equals, 40*time.Second)
+	s = newServer(ServerOptions{PollInterval: time.Second, MaxPollInterval: time.Millisecond})
+	c.Assert(s.maxPollInterval, qt.Equals, time.Second)
+	s = newServer(ServerOptions{PollInterval: time.Second, MaxPollInterval: time.Minute})
+	c.Assert(s.maxPollInterval, qt.Equals, time.Minute)
+}
+
+// instantNotifier returns right away from Receive when there are no messages, unlike long polling,
+// and counts the Receive calls.
+type instantNotifier struct {
+	*memNotifier
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (n *instantNotifier) Receive(ctx context.Context) ([]Note, error) {
+	n.mu.Lock()
+	n.calls++
+	n.mu.Unlock()
+	return n.bus.queue(n.queue).pop(5), nil
+}
+
+func (n *instantNotifier) receiveCalls() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.calls
+}
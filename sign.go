@@ -0,0 +1,61 @@
+package s3rpc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+// ErrInvalidResponseSignature is returned (wrapped) by Execute when ClientOptions.ResponseHMACKey
+// is set and the response is not signed with it.
+var ErrInvalidResponseSignature = errors.New("invalid response signature")
+
+// sign returns the hex encoded HMAC-SHA256 of the response to the request with the given id
+// and content checksum.
+func (c *common) sign(id, checksum string) string {
+	h := hmac.New(sha256.New, c.hmacKey)
+	io.WriteString(h, id)
+	h.Write([]byte{0})
+	io.WriteString(h, checksum)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// signature returns the s3rpc metadata signing the response to the request with the given id
+// and content checksum, or nil if ResponseHMACKey is not set.
+func (c *common) signature(id, checksum string) map[string]string {
+	if len(c.hmacKey) == 0 {
+		return nil
+	}
+	return map[string]string{metaSignature: c.sign(id, checksum)}
+}
+
+// signFile is like signature, but for the content in filename.
+// The object header is included so it doesn't need to be created again on upload.
+func (c *common) signFile(id, filename string) (map[string]string, error) {
+	if len(c.hmacKey) == 0 {
+		return nil, nil
+	}
+	h, err := fileHeader(filename)
+	if err != nil {
+		return nil, err
+	}
+	return mergeMetadata(h.metadata(), c.signature(id, h.Checksum)), nil
+}
+
+// verifySignature verifies the signature of the response to the request with the given id
+// and content checksum, if ResponseHMACKey is set.
+// The content itself is verified against checksum on download.
+func (c *common) verifySignature(id, checksum, signature string) error {
+	if len(c.hmacKey) == 0 {
+		return nil
+	}
+	if checksum == "" || signature == "" {
+		return ErrInvalidResponseSignature
+	}
+	if !hmac.Equal([]byte(signature), []byte(c.sign(id, checksum))) {
+		return ErrInvalidResponseSignature
+	}
+	return nil
+}
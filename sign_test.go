@@ -0,0 +1,78 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestResponseHMACKey(t *testing.T) {
+	handlers := Handlers{
+		"upper": upperHandler,
+		"noop": func(ctx context.Context, input Input) (Output, error) {
+			return Output{Unchanged: true}, nil
+		},
+	}
+
+	for _, test := range []struct {
+		name       string
+		op         string
+		serverKey  []byte
+		serverOpts ServerOptions
+		tamper     bool
+		expect     string
+	}{
+		{name: "Signed", op: "upper", serverKey: []byte("secret"), expect: "FOO"},
+		{name: "SignedUnchanged", op: "noop", serverKey: []byte("secret"), expect: "foo"},
+		{name: "SignedCached", op: "upper", serverKey: []byte("secret"), serverOpts: ServerOptions{ResultCacheTTL: time.Hour}, expect: "FOO"},
+		{name: "Unsigned", op: "upper"},
+		{name: "WrongKey", op: "upper", serverKey: []byte("other")},
+		{name: "Tampered", op: "upper", serverKey: []byte("secret"), tamper: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			bus := newMemBus()
+			blobs := newMemBlobStore()
+
+			opts := test.serverOpts
+			opts.Handlers = handlers
+			opts.ResponseHMACKey = test.serverKey
+			if test.tamper {
+				opts.BlobStore = &tamperingBlobStore{BlobStore: blobs}
+			}
+			client := newTestClient(c, bus, blobs, ClientOptions{ResponseHMACKey: []byte("secret")})
+			newTestServer(c, bus, blobs, opts)
+
+			output, err := client.Execute(context.Background(), test.op, Input{Filename: writeTestFile(c, "in.txt", "foo")})
+			if test.expect == "" {
+				c.Assert(errors.Is(err, ErrInvalidResponseSignature), qt.IsTrue, qt.Commentf("%v", err))
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			b, err := os.ReadFile(output.Filename)
+			c.Assert(err, qt.IsNil)
+			c.Assert(string(b), qt.Equals, test.expect)
+		})
+	}
+}
+
+// tamperingBlobStore replaces the content of the responses, updating the checksum to match.
+type tamperingBlobStore struct {
+	BlobStore
+}
+
+func (b *tamperingBlobStore) Put(ctx context.Context, key string, body io.Reader, metadata map[string]string) error {
+	if strings.HasPrefix(key, toClient+"/") {
+		const evil = "EVIL"
+		metadata = mergeMetadata(metadata, bytesHeader([]byte(evil), "").metadata())
+		body = strings.NewReader(evil)
+	}
+	return b.BlobStore.Put(ctx, key, body, metadata)
+}
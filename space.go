@@ -0,0 +1,132 @@
+package s3rpc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// ErrNoSpace is returned (wrapped) when there is no room for a temporary file,
+// either because the file system is full or because the download would exceed
+// ClientOptions.MaxTempBytes.
+var ErrNoSpace = errors.New("no space left for temporary files")
+
+// noSpaceErr wraps err in ErrNoSpace if it is caused by a full file system.
+func noSpaceErr(err error) error {
+	if err != nil && errors.Is(err, syscall.ENOSPC) && !errors.Is(err, ErrNoSpace) {
+		return fmt.Errorf("%w: %s", ErrNoSpace, err)
+	}
+	return err
+}
+
+// reserveTemp reserves room for a temporary file of n bytes (from the object header)
+// in the client's temp directory, see ClientOptions.MaxTempBytes.
+// The download must be read through the reservation's limit, which enforces n,
+// or, if n is negative (unknown), counts the bytes as they are read.
+// The reservation's release must be called when done.
+func (c *Client) reserveTemp(n int64) (*tempReservation, error) {
+	if c.maxTempBytes <= 0 {
+		return &tempReservation{}, nil
+	}
+	if n < 0 {
+		// A negative size means uploaded by an older version; we count the bytes as they are downloaded.
+		return &tempReservation{c: c, grow: true}, nil
+	}
+	if err := c.reserveTempBytes(n); err != nil {
+		return nil, err
+	}
+	return &tempReservation{c: c, n: n}, nil
+}
+
+// reserveTempBytes adds n bytes to tempBytes, unless that exceeds MaxTempBytes.
+func (c *Client) reserveTempBytes(n int64) error {
+	c.tempMu.Lock()
+	defer c.tempMu.Unlock()
+
+	if c.tempBytes+n > c.maxTempBytes {
+		// The caller may have removed some outputs since.
+		c.pruneTempOutputs()
+	}
+	if c.tempBytes+n > c.maxTempBytes {
+		return fmt.Errorf("%w: downloading %d bytes would exceed MaxTempBytes (%d bytes, %d in use)", ErrNoSpace, n, c.maxTempBytes, c.tempBytes)
+	}
+	c.tempBytes += n
+	return nil
+}
+
+// tempReservation is room reserved for a temporary file, see Client.reserveTemp.
+// A reservation with no client is unlimited.
+type tempReservation struct {
+	c *Client
+
+	// n is the number of bytes reserved.
+	n int64
+
+	// grow is set if the size is unknown, so n grows with the bytes read.
+	grow bool
+}
+
+// limit returns body limited to the reservation.
+func (r *tempReservation) limit(body io.Reader) io.Reader {
+	if r.c == nil {
+		return body
+	}
+	return &reservedReader{r: r, body: body}
+}
+
+// release must be called when done: with the file's name if it is handed over
+// to the caller, so it is counted until the caller removes it, else with an empty name
+// once the file is removed (or never created).
+func (r *tempReservation) release(filename string) {
+	if r.c == nil {
+		return
+	}
+	r.c.tempMu.Lock()
+	defer r.c.tempMu.Unlock()
+	if filename == "" {
+		r.c.tempBytes -= r.n
+		return
+	}
+	if r.c.tempOutputs == nil {
+		r.c.tempOutputs = make(map[string]int64)
+	}
+	r.c.tempOutputs[filename] = r.n
+}
+
+// reservedReader fails with ErrNoSpace when reading more than reserved,
+// or reserves more as needed if the size is unknown.
+type reservedReader struct {
+	r    *tempReservation
+	body io.Reader
+	read int64
+}
+
+func (rr *reservedReader) Read(p []byte) (int, error) {
+	n, err := rr.body.Read(p)
+	if rr.read+int64(n) > rr.r.n {
+		if !rr.r.grow {
+			return 0, fmt.Errorf("%w: the download exceeds its size of %d bytes", ErrNoSpace, rr.r.n)
+		}
+		more := rr.read + int64(n) - rr.r.n
+		if err := rr.r.c.reserveTempBytes(more); err != nil {
+			return 0, err
+		}
+		rr.r.n += more
+	}
+	rr.read += int64(n)
+	return n, err
+}
+
+// pruneTempOutputs stops counting the outputs removed by the caller, see reserveTemp.
+// c.tempMu must be held.
+func (c *Client) pruneTempOutputs() {
+	for filename, n := range c.tempOutputs {
+		if _, err := os.Stat(filename); errors.Is(err, fs.ErrNotExist) {
+			delete(c.tempOutputs, filename)
+			c.tempBytes -= n
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/iotest"
+
+	qt "github.com/frankban/quicktest"
+)
+
+type fullWriter struct{}
+
+func (fullWriter) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: "full", Err: syscall.ENOSPC}
+}
+
+func TestNoSpaceErr(t *testing.T) {
+	c := qt.New(t)
+
+	err := noSpaceErr(copyVerified(context.Background(), fullWriter{}, strings.NewReader("foo"), ""))
+	c.Assert(errors.Is(err, ErrNoSpace), qt.IsTrue)
+	c.Assert(errors.Is(noSpaceErr(err), ErrNoSpace), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, "no space left for temporary files: write full: no space left on device")
+
+	c.Assert(noSpaceErr(nil), qt.IsNil)
+	c.Assert(errors.Is(noSpaceErr(errors.New("foo")), ErrNoSpace), qt.IsFalse)
+}
+
+// noSpaceBlobStore wraps a BlobStore and fails reading the response objects
+// as if the disk filled up halfway through the download.
+type noSpaceBlobStore struct {
+	BlobStore
+}
+
+func (b *noSpaceBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, map[string]string, error) {
+	body, metadata, err := b.BlobStore.Get(ctx, key)
+	if err != nil || !strings.HasPrefix(key, toClient+"/") {
+		return body, metadata, err
+	}
+	return io.NopCloser(io.MultiReader(io.LimitReader(body, 2), iotest.ErrReader(syscall.ENOSPC))), metadata, nil
+}
+
+func TestExecuteNoSpace(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	client := newTestClient(c, bus, &noSpaceBlobStore{BlobStore: blobs}, ClientOptions{})
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}})
+
+	_, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+	c.Assert(errors.Is(err, ErrNoSpace), qt.IsTrue)
+
+	entries, err := os.ReadDir(client.tempDir)
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 0)
+}
+
+func TestExecuteMaxTempBytes(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	client := newTestClient(c, bus, blobs, ClientOptions{MaxTempBytes: 10})
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}})
+
+	execute := func(content string) (Output, error) {
+		return client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", content)})
+	}
+
+	output, err := execute("abcdef")
+	c.Assert(err, qt.IsNil)
+
+	// The previous output is still in the temp dir.
+	_, err = execute("abcdef")
+	c.Assert(errors.Is(err, ErrNoSpace), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, `apply: no space left for temporary files: downloading 6 bytes would exceed MaxTempBytes \(10 bytes, 6 in use\)`)
+
+	c.Assert(os.Remove(output.Filename), qt.IsNil)
+	_, err = execute("abcdef")
+	c.Assert(err, qt.IsNil)
+}
+
+func TestReserveTemp(t *testing.T) {
+	c := qt.New(t)
+
+	client := newTestClient(c, newMemBus(), newMemBlobStore(), ClientOptions{MaxTempBytes: 10})
+
+	// Released once the file is removed.
+	r, err := client.reserveTemp(8)
+	c.Assert(err, qt.IsNil)
+	_, err = client.reserveTemp(3)
+	c.Assert(errors.Is(err, ErrNoSpace), qt.IsTrue)
+	r.release("")
+	c.Assert(client.tempBytes, qt.Equals, int64(0))
+
+	// Handed over to the caller, counted until removed.
+	filename, err := client.writeTemp("out.txt", []byte("abcdefgh"))
+	c.Assert(err, qt.IsNil)
+	r, err = client.reserveTemp(8)
+	c.Assert(err, qt.IsNil)
+	r.release(filename)
+	_, err = client.reserveTemp(3)
+	c.Assert(err, qt.ErrorMatches, `no space left for temporary files: downloading 3 bytes would exceed MaxTempBytes \(10 bytes, 8 in use\)`)
+
+	// Files not reserved are not counted.
+	_, err = client.writeTemp("other.txt", []byte("abcdefgh"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(os.Remove(filename), qt.IsNil)
+	r, err = client.reserveTemp(10)
+	c.Assert(err, qt.IsNil)
+	c.Assert(client.tempOutputs, qt.HasLen, 0)
+	r.release("")
+	c.Assert(client.tempBytes, qt.Equals, int64(0))
+
+	// Unlimited.
+	client = newTestClient(c, newMemBus(), newMemBlobStore(), ClientOptions{})
+	r, err = client.reserveTemp(1 << 40)
+	c.Assert(err, qt.IsNil)
+	r.release("foo")
+	c.Assert(client.tempOutputs, qt.HasLen, 0)
+}
+
+func TestReserveTempLimit(t *testing.T) {
+	c := qt.New(t)
+
+	client := newTestClient(c, newMemBus(), newMemBlobStore(), ClientOptions{MaxTempBytes: 10})
+
+	// More than the size in the header.
+	r, err := client.reserveTemp(3)
+	c.Assert(err, qt.IsNil)
+	_, err = io.ReadAll(r.limit(strings.NewReader("abcdef")))
+	c.Assert(errors.Is(err, ErrNoSpace), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, `no space left for temporary files: the download exceeds its size of 3 bytes`)
+	r.release("")
+	c.Assert(client.tempBytes, qt.Equals, int64(0))
+
+	// Unknown size, counted as read.
+	r, err = client.reserveTemp(-1)
+	c.Assert(err, qt.IsNil)
+	b, err := io.ReadAll(r.limit(iotest.OneByteReader(strings.NewReader("abcdef"))))
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "abcdef")
+	c.Assert(client.tempBytes, qt.Equals, int64(6))
+	r.release("")
+	c.Assert(client.tempBytes, qt.Equals, int64(0))
+
+	// Unknown size, over budget.
+	r, err = client.reserveTemp(-1)
+	c.Assert(err, qt.IsNil)
+	_, err = io.ReadAll(r.limit(iotest.OneByteReader(strings.NewReader("abcdefghijk"))))
+	c.Assert(err, qt.ErrorMatches, `no space left for temporary files: downloading 1 bytes would exceed MaxTempBytes \(10 bytes, 10 in use\)`)
+	r.release("")
+	c.Assert(client.tempBytes, qt.Equals, int64(0))
+}
@@ -0,0 +1,103 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// kindError marks an error response, with the error message as its body.
+const kindError = "error"
+
+// ErrStaleRequest is returned (wrapped) by Execute when the server refused the request
+// because it was older than ServerOptions.MaxRequestAge when picked up.
+var ErrStaleRequest = errors.New("stale request")
+
+// remoteErrors are the errors a server may respond with, possibly wrapped with more details.
+// They are matched by message, so errors.Is works on the client.
+var remoteErrors = []error{ErrStaleRequest, ErrUnsupportedProtocol, ErrOutputUpload, ErrRequestCancelled}
+
+// remoteError returns the error a server responded with.
+func remoteError(msg string) error {
+	for _, err := range remoteErrors {
+		if msg == err.Error() {
+			return err
+		}
+		if strings.HasPrefix(msg, err.Error()+": ") {
+			return fmt.Errorf("%w%s", err, strings.TrimPrefix(msg, err.Error()))
+		}
+	}
+	return errors.New(msg)
+}
+
+// isStale reports whether the request with the given s3rpc metadata is older than
+// MaxRequestAge, allowing for ClockSkewTolerance between the client's and the server's clocks.
+// Requests without a (valid) submission time are never stale.
+func (s *Server) isStale(internal map[string]string, now time.Time) bool {
+	if s.maxRequestAge <= 0 {
+		return false
+	}
+	submittedAt, err := time.Parse(time.RFC3339Nano, internal[metaSubmittedAt])
+	if err != nil {
+		return false
+	}
+	return now.Sub(submittedAt) > s.maxRequestAge+s.clockSkewTolerance
+}
+
+// clientDeadline returns the time the client gives up waiting for the response to the request
+// with the given s3rpc metadata, allowing for ClockSkewTolerance, if known.
+func (s *Server) clientDeadline(internal map[string]string) (time.Time, bool) {
+	deadline, err := time.Parse(time.RFC3339Nano, internal[metaDeadline])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return deadline.Add(s.clockSkewTolerance), true
+}
+
+// isExpired reports whether the client of the request with the given s3rpc metadata has given up waiting.
+func (s *Server) isExpired(internal map[string]string, now time.Time) bool {
+	deadline, ok := s.clientDeadline(internal)
+	return ok && now.After(deadline)
+}
+
+// deadline returns the time the client gives up waiting for the response to a request submitted now,
+// if known, i.e. if ctx has a deadline or both UploadTimeout and Timeout are set.
+func (c *Client) deadline(ctx context.Context, now time.Time) (time.Time, bool) {
+	deadline, ok := ctx.Deadline()
+	if c.uploadTimeout > 0 && c.timeout > 0 {
+		if d := now.Add(c.uploadTimeout + c.timeout); !ok || d.Before(deadline) {
+			deadline, ok = d, true
+		}
+	}
+	return deadline, ok
+}
+
+// respondError responds to the request with the given error.
+func (s *Server) respondError(ctx context.Context, parts keyParts, replyTo string, attrs map[string]string, respErr error) error {
+	key := s.responseKey(parts, replyTo)
+	body := []byte(respErr.Error())
+	meta := mergeMetadata(map[string]string{metaKind: kindError}, s.signature(parts.id, bytesHeader(body, "").Checksum))
+	if err := s.putBytes(ctx, key, body, "text/plain; charset=utf-8", meta); err != nil {
+		return err
+	}
+	return s.notifyClient(ctx, replyTo, key, attrs)
+}
+
+// readError reads the error response to the request with the given id from body.
+func (c *Client) readError(ctx context.Context, id string, body io.Reader, internal map[string]string) error {
+	h, err := readHeader(internal)
+	if err != nil {
+		return err
+	}
+	if err := c.verifySignature(id, h.Checksum, internal[metaSignature]); err != nil {
+		return err
+	}
+	b, err := readBytes(ctx, body, internal)
+	if err != nil {
+		return err
+	}
+	return remoteError(string(b))
+}
@@ -0,0 +1,157 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestServerMaxRequestAge(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		maxAge    time.Duration
+		expectErr error
+	}{
+		{"Fresh", time.Minute, nil},
+		{"Stale", time.Nanosecond, ErrStaleRequest},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			bus := newMemBus()
+			blobs := newMemBlobStore()
+
+			var called bool
+			handlers := Handlers{
+				"upper": func(ctx context.Context, input Input) (Output, error) {
+					called = true
+					return upperHandler(ctx, input)
+				},
+			}
+			client := newTestClient(c, bus, blobs, ClientOptions{ResponseHMACKey: []byte("secret")})
+			newTestServer(c, bus, blobs, ServerOptions{Handlers: handlers, MaxRequestAge: test.maxAge, ResponseHMACKey: []byte("secret")})
+
+			_, err := client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, "in.txt", "foo")})
+			if test.expectErr == nil {
+				c.Assert(err, qt.IsNil)
+				c.Assert(called, qt.IsTrue)
+				return
+			}
+			c.Assert(errors.Is(err, test.expectErr), qt.IsTrue, qt.Commentf("%v", err))
+			c.Assert(err, qt.ErrorMatches, "apply: stale request")
+			c.Assert(called, qt.IsFalse)
+
+			// Both the input and the error response are deleted.
+			waitFor(c, func() bool { return len(blobs.keys()) == 0 })
+		})
+	}
+}
+
+func TestServerIsStale(t *testing.T) {
+	c := qt.New(t)
+
+	now := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	submitted := func(d time.Duration) map[string]string {
+		return map[string]string{metaSubmittedAt: now.Add(-d).Format(time.RFC3339Nano)}
+	}
+
+	s := &Server{maxRequestAge: time.Minute, clockSkewTolerance: 10 * time.Second}
+	c.Assert(s.isStale(submitted(30*time.Second), now), qt.IsFalse)
+	c.Assert(s.isStale(submitted(65*time.Second), now), qt.IsFalse)
+	c.Assert(s.isStale(submitted(75*time.Second), now), qt.IsTrue)
+	// Submitted "in the future" by a client with its clock ahead.
+	c.Assert(s.isStale(submitted(-time.Minute), now), qt.IsFalse)
+	c.Assert(s.isStale(nil, now), qt.IsFalse)
+	c.Assert(s.isStale(map[string]string{metaSubmittedAt: "invalid"}, now), qt.IsFalse)
+
+	s = &Server{}
+	c.Assert(s.isStale(submitted(time.Hour), now), qt.IsFalse)
+}
+
+func TestServerClientDeadline(t *testing.T) {
+	for _, test := range []struct {
+		name            string
+		deadline        time.Duration
+		handlerDeadline bool
+		expectCalled    bool
+	}{
+		{"Expired", -time.Second, false, false},
+		{"ExpiresWhileHandling", 50 * time.Millisecond, true, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := qt.New(t)
+			ctx := context.Background()
+
+			bus := newMemBus()
+			blobs := newMemBlobStore()
+
+			var handlerErr error
+			server, err := NewServer(ServerOptions{
+				Notifier:  bus.notifier(toServer),
+				BlobStore: blobs,
+				Handlers: Handlers{
+					"upper": func(ctx context.Context, input Input) (Output, error) {
+						<-ctx.Done()
+						handlerErr = ctx.Err()
+						return Output{}, handlerErr
+					},
+				},
+				HandlerClientDeadline: test.handlerDeadline,
+				Infof:                 noopInfof,
+				AWSConfig:             AWSConfig{Bucket: testBucket},
+			})
+			c.Assert(err, qt.IsNil)
+			defer server.Close()
+
+			// A request from a client giving up at the deadline.
+			key := server.keys.key(toServer, keyParts{op: "upper", id: testID, name: "in.txt"}, time.Now())
+			deadline := time.Now().Add(test.deadline).UTC().Format(time.RFC3339Nano)
+			c.Assert(blobs.Put(ctx, key, strings.NewReader("foo"), map[string]string{metaDeadline: deadline}), qt.IsNil)
+			bus.queue(toServer).push(Note{Bucket: testBucket, Key: key})
+
+			handled, err := server.ServeOnce(ctx)
+			c.Assert(err, qt.IsNil)
+			c.Assert(handled, qt.Equals, 1)
+			if test.expectCalled {
+				c.Assert(handlerErr, qt.Equals, context.DeadlineExceeded)
+			} else {
+				c.Assert(handlerErr, qt.IsNil)
+			}
+
+			// Dropped without a response.
+			c.Assert(blobs.keys(), qt.HasLen, 0)
+			c.Assert(bus.queue(toServer).len(), qt.Equals, 0)
+			c.Assert(bus.queue(toClient).len(), qt.Equals, 0)
+		})
+	}
+}
+
+func TestClientDeadline(t *testing.T) {
+	c := qt.New(t)
+
+	now := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	ctx, cancel := context.WithDeadline(context.Background(), now.Add(time.Hour))
+	defer cancel()
+
+	client := &Client{}
+	_, ok := client.deadline(context.Background(), now)
+	c.Assert(ok, qt.IsFalse)
+	deadline, ok := client.deadline(ctx, now)
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(deadline, qt.Equals, now.Add(time.Hour))
+
+	// The upload may take all of UploadTimeout.
+	client = &Client{timeout: time.Minute}
+	_, ok = client.deadline(context.Background(), now)
+	c.Assert(ok, qt.IsFalse)
+	client.uploadTimeout = time.Minute
+	deadline, ok = client.deadline(context.Background(), now)
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(deadline, qt.Equals, now.Add(2*time.Minute))
+	deadline, _ = client.deadline(ctx, now)
+	c.Assert(deadline, qt.Equals, now.Add(2*time.Minute))
+}
@@ -0,0 +1,130 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ObjectLister is an optional interface a BlobStore may implement
+// to support Client.Sweep.
+type ObjectLister interface {
+	// ListObjects calls fn for each object below prefix.
+	ListObjects(ctx context.Context, prefix string, fn func(key string, lastModified time.Time) error) error
+
+	// DeleteObjects deletes the objects with the given keys.
+	// Keys that do not exist are ignored.
+	DeleteObjects(ctx context.Context, keys []string) error
+}
+
+// sweepBatchSize is the max number of keys deleted in one request, which is the S3 limit.
+const sweepBatchSize = 1000
+
+// Sweep deletes the requests and responses last modified more than olderThan ago
+// and returns the number of deleted objects.
+//
+// s3rpc deletes these objects on a best effort basis, but objects may be left behind,
+// e.g. if a client is cancelled or a server crashes.
+// olderThan should be well above the longest running request,
+// as objects still in use would otherwise be deleted.
+// Cached results and handler logs are not touched.
+//
+// Sweep requires a BlobStore implementing ObjectLister, which the default does.
+func (c *Client) Sweep(ctx context.Context, olderThan time.Duration) (int, error) {
+	lister, ok := c.blobs.(ObjectLister)
+	if !ok {
+		return 0, errors.New("sweep: BlobStore does not implement ObjectLister")
+	}
+	if olderThan <= 0 {
+		return 0, fmt.Errorf("sweep: invalid age %s", olderThan)
+	}
+	cutoff := time.Now().Add(-olderThan)
+
+	var (
+		deleted int
+		batch   []string
+	)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		c.infof("Sweeping %d objects from %s", len(batch), c.bucket)
+		if err := lister.DeleteObjects(ctx, batch); err != nil {
+			return err
+		}
+		deleted += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	for _, prefix := range []string{toServer, toClient, toClientDirect} {
+		err := lister.ListObjects(ctx, prefix+"/", func(key string, lastModified time.Time) error {
+			if !lastModified.Before(cutoff) {
+				return nil
+			}
+			batch = append(batch, key)
+			if len(batch) == sweepBatchSize {
+				return flush()
+			}
+			return nil
+		})
+		if err == nil {
+			err = flush()
+		}
+		if err != nil {
+			return deleted, fmt.Errorf("sweep: %w", err)
+		}
+	}
+
+	return deleted, nil
+}
+
+func (b *s3BlobStore) ListObjects(ctx context.Context, prefix string, fn func(key string, lastModified time.Time) error) error {
+	p := s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return newAWSError(err)
+		}
+		for _, o := range page.Contents {
+			if err := fn(aws.ToString(o.Key), aws.ToTime(o.LastModified)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *s3BlobStore) DeleteObjects(ctx context.Context, keys []string) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > sweepBatchSize {
+			n = sweepBatchSize
+		}
+		objects := make([]types.ObjectIdentifier, n)
+		for i, key := range keys[:n] {
+			objects[i] = types.ObjectIdentifier{Key: aws.String(key)}
+		}
+		res, err := b.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(b.bucket),
+			Delete: &types.Delete{Objects: objects, Quiet: true},
+		})
+		if err != nil {
+			return newAWSError(err)
+		}
+		if len(res.Errors) > 0 {
+			e := res.Errors[0]
+			return fmt.Errorf("delete %s: %s: %s (and %d more)", aws.ToString(e.Key), aws.ToString(e.Code), aws.ToString(e.Message), len(res.Errors)-1)
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
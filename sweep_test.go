@@ -0,0 +1,81 @@
+package s3rpc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestSweep(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+	client := newTestClient(c, bus, blobs, ClientOptions{})
+
+	put := func(key string, age time.Duration) {
+		c.Assert(blobs.Put(ctx, key, strings.NewReader("foo"), nil), qt.IsNil)
+		blobs.age(key, age)
+	}
+
+	put("to_server/upper/old1", 2*time.Hour)
+	put("to_client/upper/old2", 2*time.Hour)
+	put("to_client_direct/upper/old3", 2*time.Hour)
+	put("to_server/upper/live", time.Minute)
+	put("cache/upper/old", 2*time.Hour)
+	put("logs/old.log", 2*time.Hour)
+
+	deleted, err := client.Sweep(ctx, time.Hour)
+	c.Assert(err, qt.IsNil)
+	c.Assert(deleted, qt.Equals, 3)
+	c.Assert(blobs.keys(), qt.DeepEquals, []string{"cache/upper/old", "logs/old.log", "to_server/upper/live"})
+
+	_, err = client.Sweep(ctx, 0)
+	c.Assert(err, qt.ErrorMatches, "sweep: invalid age 0s")
+}
+
+func TestSweepBatches(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	bus := newMemBus()
+	blobs := &batchCountingBlobStore{memBlobStore: newMemBlobStore()}
+	client := newTestClient(c, bus, blobs, ClientOptions{})
+
+	for i := 0; i < 2500; i++ {
+		key := fmt.Sprintf("to_server/upper/%04d", i)
+		c.Assert(blobs.Put(ctx, key, strings.NewReader("foo"), nil), qt.IsNil)
+		blobs.age(key, 2*time.Hour)
+	}
+
+	deleted, err := client.Sweep(ctx, time.Hour)
+	c.Assert(err, qt.IsNil)
+	c.Assert(deleted, qt.Equals, 2500)
+	c.Assert(blobs.batches, qt.DeepEquals, []int{1000, 1000, 500})
+	c.Assert(blobs.keys(), qt.HasLen, 0)
+}
+
+func TestSweepNotSupported(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	client := newTestClient(c, bus, struct{ BlobStore }{newMemBlobStore()}, ClientOptions{})
+
+	_, err := client.Sweep(context.Background(), time.Hour)
+	c.Assert(err, qt.ErrorMatches, "sweep: BlobStore does not implement ObjectLister")
+}
+
+type batchCountingBlobStore struct {
+	*memBlobStore
+	batches []int
+}
+
+func (b *batchCountingBlobStore) DeleteObjects(ctx context.Context, keys []string) error {
+	b.batches = append(b.batches, len(keys))
+	return b.memBlobStore.DeleteObjects(ctx, keys)
+}
@@ -0,0 +1,85 @@
+package s3rpc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrTooManyTempFiles is returned (wrapped) by Execute when ClientOptions.MaxTempFiles
+// is reached and ClientOptions.TempFilePolicy is RejectTempFiles.
+var ErrTooManyTempFiles = errors.New("too many temporary files")
+
+// TempFilePolicy controls what happens when ClientOptions.MaxTempFiles is reached.
+type TempFilePolicy int
+
+const (
+	// RejectTempFiles makes Execute fail with ErrTooManyTempFiles
+	// until the caller removes some of the outputs.
+	// This is the default.
+	RejectTempFiles TempFilePolicy = iota
+
+	// EvictOldestTempFile removes the oldest outputs to make room for new ones.
+	// Only use this if the outputs are consumed quickly, as a caller may find
+	// an output gone before reading it.
+	EvictOldestTempFile
+)
+
+// TempFileCount returns the number of outputs not yet removed,
+// see ClientOptions.MaxTempFiles.
+// The outputs are only tracked if MaxTempFiles is set, else this is always 0.
+func (c *Client) TempFileCount() int {
+	c.tempMu.Lock()
+	defer c.tempMu.Unlock()
+	c.pruneTempFiles()
+	return len(c.tempFiles)
+}
+
+// checkTempFiles fails if MaxTempFiles is reached and the policy is RejectTempFiles.
+func (c *Client) checkTempFiles() error {
+	if c.maxTempFiles <= 0 || c.tempFilePolicy != RejectTempFiles {
+		return nil
+	}
+	c.tempMu.Lock()
+	defer c.tempMu.Unlock()
+	c.pruneTempFiles()
+	if len(c.tempFiles) >= c.maxTempFiles {
+		return fmt.Errorf("%w: %d outputs not removed, see MaxTempFiles", ErrTooManyTempFiles, len(c.tempFiles))
+	}
+	return nil
+}
+
+// trackTempFile registers the output filename if MaxTempFiles is set,
+// evicting the oldest outputs beyond MaxTempFiles if the policy is EvictOldestTempFile.
+func (c *Client) trackTempFile(filename string) {
+	if c.maxTempFiles <= 0 {
+		return
+	}
+	c.tempMu.Lock()
+	defer c.tempMu.Unlock()
+	c.pruneTempFiles()
+	c.tempFiles = append(c.tempFiles, filename)
+	if c.tempFilePolicy != EvictOldestTempFile {
+		return
+	}
+	for len(c.tempFiles) > c.maxTempFiles {
+		oldest := c.tempFiles[0]
+		c.tempFiles = c.tempFiles[1:]
+		c.infof("Evicting output %s, see MaxTempFiles (%d)", oldest, c.maxTempFiles)
+		if err := os.Remove(oldest); err != nil && !errors.Is(err, os.ErrNotExist) {
+			c.infof("Failed to evict output %s: %s", oldest, err)
+		}
+	}
+}
+
+// pruneTempFiles forgets the outputs removed by the caller.
+// c.tempMu must be held.
+func (c *Client) pruneTempFiles() {
+	live := c.tempFiles[:0]
+	for _, filename := range c.tempFiles {
+		if _, err := os.Stat(filename); err == nil {
+			live = append(live, filename)
+		}
+	}
+	c.tempFiles = live
+}
@@ -0,0 +1,104 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestExecuteMaxTempFiles(t *testing.T) {
+	c := qt.New(t)
+
+	execute := func(client *Client, i int) (Output, error) {
+		return client.Execute(context.Background(), "upper", Input{Filename: writeTestFile(c, fmt.Sprintf("in%d.txt", i), "foo")})
+	}
+
+	c.Run("Unlimited", func(c *qt.C) {
+		bus := newMemBus()
+		blobs := newMemBlobStore()
+		client := newTestClient(c, bus, blobs, ClientOptions{})
+		newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}})
+
+		for i := 0; i < 3; i++ {
+			_, err := execute(client, i)
+			c.Assert(err, qt.IsNil)
+		}
+		// Not tracked.
+		c.Assert(client.tempFiles, qt.HasLen, 0)
+		c.Assert(client.TempFileCount(), qt.Equals, 0)
+	})
+
+	c.Run("Reject", func(c *qt.C) {
+		bus := newMemBus()
+		blobs := newMemBlobStore()
+		client := newTestClient(c, bus, blobs, ClientOptions{MaxTempFiles: 2})
+		newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}})
+
+		var outputs []Output
+		for i := 0; i < 2; i++ {
+			output, err := execute(client, i)
+			c.Assert(err, qt.IsNil)
+			outputs = append(outputs, output)
+		}
+		c.Assert(client.TempFileCount(), qt.Equals, 2)
+
+		_, err := execute(client, 2)
+		c.Assert(errors.Is(err, ErrTooManyTempFiles), qt.IsTrue)
+		c.Assert(err, qt.ErrorMatches, `apply: too many temporary files: 2 outputs not removed, see MaxTempFiles`)
+		c.Assert(client.TempFileCount(), qt.Equals, 2)
+
+		// Removing an output makes room for another.
+		c.Assert(os.Remove(outputs[0].Filename), qt.IsNil)
+		c.Assert(client.TempFileCount(), qt.Equals, 1)
+		_, err = execute(client, 3)
+		c.Assert(err, qt.IsNil)
+		c.Assert(client.TempFileCount(), qt.Equals, 2)
+	})
+
+	c.Run("EvictOldest", func(c *qt.C) {
+		var mu sync.Mutex
+		var logs []string
+		infof := func(format string, args ...interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			logs = append(logs, fmt.Sprintf(format, args...))
+		}
+
+		bus := newMemBus()
+		blobs := newMemBlobStore()
+		client := newTestClient(c, bus, blobs, ClientOptions{MaxTempFiles: 2, TempFilePolicy: EvictOldestTempFile, Infof: infof})
+		newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}})
+
+		var outputs []Output
+		for i := 0; i < 4; i++ {
+			output, err := execute(client, i)
+			c.Assert(err, qt.IsNil)
+			outputs = append(outputs, output)
+		}
+		c.Assert(client.TempFileCount(), qt.Equals, 2)
+
+		for i, output := range outputs {
+			_, err := os.Stat(output.Filename)
+			c.Assert(os.IsNotExist(err), qt.Equals, i < 2, qt.Commentf("output %d", i))
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		var evicted []string
+		for _, msg := range logs {
+			if strings.HasPrefix(msg, "Evicting output") {
+				evicted = append(evicted, msg)
+			}
+		}
+		c.Assert(evicted, qt.DeepEquals, []string{
+			fmt.Sprintf("Evicting output %s, see MaxTempFiles (2)", outputs[0].Filename),
+			fmt.Sprintf("Evicting output %s, see MaxTempFiles (2)", outputs[1].Filename),
+		})
+	})
+}
@@ -0,0 +1,64 @@
+package s3rpc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Validator is an optional interface a BlobStore or a Notifier may implement
+// to check that it is accessible, see Client.Validate.
+type Validator interface {
+	// Validate checks that the underlying resource exists and is accessible.
+	Validate(ctx context.Context) error
+}
+
+// probeKeyPrefix is the base name prefix of the probe objects written by Client.Validate.
+// Servers ignore notifications about them.
+const probeKeyPrefix = "s3rpc-probe-"
+
+func isProbeKey(key string) bool {
+	return strings.HasPrefix(key, toServer+"/"+probeKeyPrefix)
+}
+
+// Validate checks that the client has the access it needs to the bucket and queue
+// without involving a server:
+//
+//   - that the bucket and queue exist and are accessible (if the BlobStore and Notifier implement Validator).
+//   - that the client can store and delete a request.
+//
+// It does so by storing a tiny probe object below the request prefix which is deleted immediately,
+// so it's safe to run in production.
+// All checks are run, and the returned error describes all failures.
+func (c *Client) Validate(ctx context.Context) error {
+	var failures []string
+	fail := func(what string, err error) {
+		failures = append(failures, fmt.Sprintf("%s: %s", what, err))
+	}
+
+	if v, ok := c.blobs.(Validator); ok {
+		if err := v.Validate(ctx); err != nil {
+			fail(fmt.Sprintf("bucket %q", c.bucket), err)
+		}
+	}
+	if v, ok := c.notifier.(Validator); ok {
+		if err := v.Validate(ctx); err != nil {
+			fail("queue", err)
+		}
+	}
+
+	key := toServer + "/" + probeKeyPrefix + strings.ToLower(ulid.Make().String())
+	if err := c.blobs.Put(ctx, key, bytes.NewReader([]byte("probe")), nil); err != nil {
+		fail("put probe object", err)
+	} else if err := c.deleteObject(ctx, key); err != nil {
+		fail(fmt.Sprintf("delete probe object %q", key), err)
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("validate: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package s3rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+type invalidBlobStore struct {
+	BlobStore
+}
+
+func (b *invalidBlobStore) Validate(ctx context.Context) error {
+	return errors.New("NoSuchBucket")
+}
+
+func (b *invalidBlobStore) Put(ctx context.Context, key string, body io.Reader, metadata map[string]string) error {
+	return errors.New("AccessDenied")
+}
+
+type invalidNotifier struct {
+	Notifier
+}
+
+func (n *invalidNotifier) Validate(ctx context.Context) error {
+	return errors.New("NonExistentQueue")
+}
+
+func TestValidate(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	blobs := newMemBlobStore()
+
+	client := newTestClient(c, bus, blobs, ClientOptions{})
+	newTestServer(c, bus, blobs, ServerOptions{Handlers: Handlers{"upper": upperHandler}})
+
+	c.Assert(client.Validate(context.Background()), qt.IsNil)
+	c.Assert(blobs.keys(), qt.HasLen, 0)
+
+	// The server ignores the probe.
+	waitFor(c, func() bool { return bus.queue(toServer).len() == 0 })
+}
+
+func TestValidateFailures(t *testing.T) {
+	c := qt.New(t)
+
+	bus := newMemBus()
+	client := newTestClient(c, bus, &invalidBlobStore{BlobStore: newMemBlobStore()}, ClientOptions{
+		Notifier: &invalidNotifier{Notifier: bus.notifier(toClient)},
+	})
+
+	err := client.Validate(context.Background())
+	c.Assert(err, qt.ErrorMatches, `validate: bucket "s3rpctest": NoSuchBucket; queue: NonExistentQueue; put probe object: AccessDenied`)
+}